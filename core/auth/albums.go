@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const albumCookiePrefix = "album_"
+
+// albumUnlock is the cookie value proving a browser has entered an album's password.
+// It is keyed by the password hash, so changing or removing the password locks the album again.
+func albumUnlock(album types.Album) string {
+	mac := hmac.New(sha256.New, []byte(album.PasswordHash))
+	mac.Write([]byte(album.Slug))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HasAlbumUnlock reports whether the request carries a cookie unlocking a password protected album.
+func HasAlbumUnlock(r *http.Request, album types.Album) bool {
+	if !album.Protected {
+		return false
+	}
+	cookie, err := r.Cookie(albumCookiePrefix + album.Slug)
+	return err == nil && hmac.Equal([]byte(cookie.Value), []byte(albumUnlock(album)))
+}
+
+// UnlockedAlbums lists the slugs of the password protected albums the request carries a valid unlock cookie for.
+func UnlockedAlbums(r *http.Request) []string {
+	var unlocked []string
+	for _, cookie := range r.Cookies() {
+		slug, found := strings.CutPrefix(cookie.Name, albumCookiePrefix)
+		if !found || slices.Contains(unlocked, slug) {
+			continue
+		}
+		if album, err := database.GetAlbum(r.Context(), slug); err == nil && HasAlbumUnlock(r, album) {
+			unlocked = append(unlocked, slug)
+		}
+	}
+	return unlocked
+}
+
+// UnlockAlbumHandler checks an album's password and sets a cookie that opens the
+// album, and the images only reachable through it, for this browser.
+func UnlockAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	if !unlockAlbum(w, r) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Album unlocked successfully"))
+}
+
+// UnlockAlbumHandlerV2 is UnlockAlbumHandler for the v2 API, which replies with no content.
+func UnlockAlbumHandlerV2(w http.ResponseWriter, r *http.Request) {
+	if unlockAlbum(w, r) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unlockAlbum checks the password for the album in the request path and sets its unlock
+// cookie, writing an error and returning false if the album cannot be unlocked.
+func unlockAlbum(w http.ResponseWriter, r *http.Request) bool {
+	albumSlug := r.PathValue("albumSlug")
+	album, err := database.GetAlbum(r.Context(), albumSlug)
+	if err != nil || album.Visibility == types.VisibilityPrivate || !album.Protected {
+		net.Error(w, "Album not found", http.StatusNotFound)
+		return false
+	}
+
+	type Unlock struct {
+		Password string `json:"password"`
+	}
+	var unlock Unlock
+	if err := json.NewDecoder(r.Body).Decode(&unlock); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return false
+	}
+
+	ip := net.ClientIP(r)
+	attemptKey := "album:" + album.Slug
+	if wait := unlockRetryAfter(ip, attemptKey); wait > 0 {
+		writeRetryAfter(w, wait)
+		return false
+	}
+	if !checkPassword(album.PasswordHash, unlock.Password) {
+		recordUnlockFailure(r.Context(), ip, attemptKey)
+		net.Error(w, "Incorrect password", http.StatusUnauthorized)
+		return false
+	}
+	recordUnlockSuccess(ip, attemptKey)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     albumCookiePrefix + album.Slug,
+		Value:    albumUnlock(album),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: cookieSameSite(),
+		Path:     config.URLPath("/api"),
+		MaxAge:   int(config.SessionMaxAge.Seconds()),
+	})
+	return true
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const auditDefaultLimit = 50
+const auditMaxLimit = 500
+
+// Audit records a change made by the request's user. before and after are stored as
+// JSON and may be nil, for example when something is created or deleted.
+func Audit(r *http.Request, action string, target string, albumSlug string, before any, after any) {
+	actor := ""
+	if user, ok := GetUser(r); ok {
+		actor = user.Username
+	}
+
+	entry := types.AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		AlbumSlug: albumSlug,
+		Before:    auditJson(r.Context(), before),
+		After:     auditJson(r.Context(), after),
+		IPAddress: net.ClientIP(r),
+	}
+	if err := database.InsertAuditLogRow(r.Context(), entry); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record audit log entry", "action", action, "target", target, "user", actor, "error", err)
+	}
+}
+
+func auditJson(ctx context.Context, value any) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode audit value", "error", err)
+		return nil
+	}
+	return encoded
+}
+
+// parseAuditTime accepts either an RFC 3339 timestamp or a plain date.
+func parseAuditTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func HandleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := types.AuditFilter{
+		Actor:     query.Get("actor"),
+		Action:    query.Get("action"),
+		Target:    query.Get("target"),
+		AlbumSlug: query.Get("album"),
+		Limit:     auditDefaultLimit,
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			net.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(limit, auditMaxLimit)
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			net.Error(w, "offset must not be negative", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := parseAuditTime(value)
+		if err != nil {
+			net.Error(w, "since must be a date or RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if value := query.Get("until"); value != "" {
+		until, err := parseAuditTime(value)
+		if err != nil {
+			net.Error(w, "until must be a date or RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Until = until
+	}
+
+	entries, total, err := database.GetAuditLog(r.Context(), filter)
+	if err != nil {
+		net.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	page := types.AuditPage{Entries: entries, Total: total, Limit: filter.Limit, Offset: filter.Offset}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		net.InternalError(w)
+	}
+}
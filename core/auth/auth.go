@@ -1,14 +1,23 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"gallery/core/config"
-	"log"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
-var sessionToken = make(map[string]bool)
+type contextKey string
+
+const userContextKey contextKey = "user"
 
 func generateToken() string {
 	b := make([]byte, 32)
@@ -16,64 +25,148 @@ func generateToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// GetUser returns the authenticated user attached to the request by AuthMiddleware.
+func GetUser(r *http.Request) (types.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(types.User)
+	return user, ok
+}
+
+// HasRole reports whether role grants at least the access of requiredRole.
+func HasRole(role string, requiredRole string) bool {
+	return types.RoleRanks[role] >= types.RoleRanks[requiredRole] && types.RoleRanks[role] > 0
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	passedUsername := r.FormValue("username")
 	passedPassword := r.FormValue("password")
-	log.Printf("User attempting to log in: %s", passedUsername)
+	ip := net.ClientIP(r)
+	slog.DebugContext(r.Context(), "User attempting to log in", "user", passedUsername, "ip", ip)
 
-	if passedUsername == config.AdminUser && passedPassword == config.AdminPassword {
-		token := generateToken()
-		sessionToken[token] = true
-		http.SetCookie(w, &http.Cookie{
-			Name:     "appSession",
-			Value:    token,
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteNoneMode,
-			Path:     "/",
-			MaxAge:   604800,
-		})
-		log.Printf("Login successful for user: %s", passedUsername)
+	if wait := loginRetryAfter(ip, passedUsername); wait > 0 {
+		slog.WarnContext(r.Context(), "Login locked out", "user", passedUsername, "ip", ip)
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	user, ok := checkCredentials(r.Context(), passedUsername, passedPassword)
+	if ok && user.TotpEnabled {
+		type TotpChallenge struct {
+			TotpRequired bool   `json:"totpRequired"`
+			LoginToken   string `json:"loginToken"`
+		}
+		slog.InfoContext(r.Context(), "Two-factor code required", "user", passedUsername)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(TotpChallenge{TotpRequired: true, LoginToken: beginPendingLogin(user.Username)})
+	} else if ok {
+		if err := createSession(w, r, user.Username); err != nil {
+			net.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		recordLoginSuccess(ip, passedUsername)
+		slog.InfoContext(r.Context(), "Login successful", "user", passedUsername, "ip", ip)
 		_, _ = w.Write([]byte("Login successful"))
 	} else {
-		log.Printf("Login unsuccessful for user: %s", passedUsername)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		recordLoginFailure(r.Context(), ip, passedUsername)
+		slog.WarnContext(r.Context(), "Login unsuccessful", "user", passedUsername, "ip", ip)
+		net.Error(w, "Invalid credentials", http.StatusUnauthorized)
 	}
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	net.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+}
+
+// AuthMiddleware requires a session cookie, trusted proxy header or API token for a
+// user holding at least requiredRole. Requests authenticated by an API token also need requiredScope,
+// and browser requests that change state must pass the CSRF check.
+func AuthMiddleware(requiredRole string, requiredScope string, next http.Handler) http.Handler {
+	return authMiddleware(func(user types.User) bool {
+		return HasRole(user.Role, requiredRole)
+	}, requiredScope, next)
+}
+
+// UploadMiddleware is AuthMiddleware for the upload endpoint, which guest uploaders can call as well as editors.
+func UploadMiddleware(next http.Handler) http.Handler {
+	return authMiddleware(func(user types.User) bool {
+		return user.Role == types.RoleUploader || HasRole(user.Role, types.RoleEditor)
+	}, types.ScopeUpload, next)
+}
+
+func authMiddleware(allowed func(types.User) bool, requiredScope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("appSession")
-		if err != nil || !sessionToken[cookie.Value] {
-			log.Printf("Unauthorized access attempt for user: %s", r.FormValue("username"))
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		ctx := r.Context()
+
+		var user types.User
+		var ok bool
+		if r.Header.Get("Authorization") != "" {
+			var token types.ApiToken
+			token, user, ok = getBearerToken(r)
+			if ok && !HasScope(token.Scopes, requiredScope) {
+				slog.WarnContext(ctx, "Forbidden access attempt", "token", token.ID, "scopes", token.Scopes, "method", r.Method, "path", r.URL.Path)
+				net.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			ctx = context.WithValue(ctx, tokenContextKey, token)
+		} else {
+			user, ok = getRequestUser(r)
+		}
+
+		if !ok {
+			slog.WarnContext(ctx, "Unauthorized access attempt", "method", r.Method, "path", r.URL.Path)
+			net.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		if r.Header.Get("Authorization") == "" && !checkCsrf(r) {
+			net.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !allowed(user) {
+			slog.WarnContext(ctx, "Forbidden access attempt", "user", user.Username, "role", user.Role, "method", r.Method, "path", r.URL.Path)
+			net.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ctx = context.WithValue(ctx, userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// LogoutHandler ends the request's session. It needs the CSRF token like any other change,
+// so that pages on other sites cannot log users out.
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("User logging out")
-	cookie, err := r.Cookie("appSession")
+	if !checkCsrf(r) {
+		net.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	slog.InfoContext(r.Context(), "User logging out")
+	_, err := r.Cookie(sessionCookieName)
 	if err == nil {
-		delete(sessionToken, cookie.Value)
+		deleteCurrentSession(r)
 		http.SetCookie(w, &http.Cookie{
-			Name:   "appSession",
+			Name:   sessionCookieName,
 			Value:  "",
 			MaxAge: -1,
-			Path:   "/",
+			Path:   config.URLPath("/"),
 		})
+		clearCsrfCookie(w)
 	}
 	w.WriteHeader(http.StatusUnauthorized)
 	_, _ = w.Write([]byte("Logged out"))
 }
 
 func CheckSessionHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("appSession")
-	if err != nil || !sessionToken[cookie.Value] {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	user, ok := getRequestUser(r)
+	if !ok {
+		net.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	// refresh the CSRF cookie, so sessions created before it existed can still make changes
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		setCsrfCookie(w, cookie.Value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		net.InternalError(w)
+	}
 }
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"gallery/core/config"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+const csrfCookieName = "csrfToken"
+const csrfHeaderName = "X-CSRF-Token"
+
+// csrfTokenFor derives the CSRF token from a session token, so it is tied to the
+// session without being stored. Pages on other sites cannot read either value.
+func csrfTokenFor(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cookieSameSite keeps cookies same-site unless other origins have been allowed to call the API.
+func cookieSameSite() http.SameSite {
+	if config.CrossOriginEnabled() {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// setCsrfCookie gives the frontend a readable copy of the CSRF token for a session,
+// and also returns it as a header for frontends served from another origin.
+func setCsrfCookie(w http.ResponseWriter, sessionToken string) {
+	token := csrfTokenFor(sessionToken)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Secure:   true,
+		SameSite: cookieSameSite(),
+		Path:     config.URLPath("/"),
+		MaxAge:   int(config.SessionMaxAge.Seconds()),
+	})
+	w.Header().Set(csrfHeaderName, token)
+}
+
+func clearCsrfCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: "", MaxAge: -1, Path: config.URLPath("/")})
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// isAllowedOrigin reports whether a request was sent by a page on this gallery's
+// own origin or one of CORS_ALLOWED_ORIGINS, falling back to the Referer when there is no Origin.
+func isAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || referer.Host == "" {
+			return false
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return parsed.Host == r.Host || slices.Contains(config.CorsAllowedOrigins, origin)
+}
+
+// checkCsrf protects browser-authenticated requests that change state. Session
+// requests must echo the session's CSRF token in the X-CSRF-Token header, and
+// proxy authenticated requests, which have no session, must come from an allowed origin.
+func checkCsrf(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if _, ok := getSession(r); ok {
+			header := r.Header.Get(csrfHeaderName)
+			valid := header != "" && hmac.Equal([]byte(header), []byte(csrfTokenFor(cookie.Value)))
+			if !valid {
+				slog.WarnContext(r.Context(), "Missing or invalid CSRF token", "method", r.Method, "path", r.URL.Path)
+			}
+			return valid
+		}
+	}
+
+	if !isAllowedOrigin(r) {
+		slog.WarnContext(r.Context(), "Cross-origin request rejected", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateCookieName = "oidcState"
+const oidcLoginLifetime = 10 * time.Minute
+
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+var oidcProvider *oidc.Provider
+var oidcProviderMutex sync.Mutex
+
+var oidcLogins = make(map[string]oidcLogin)
+var oidcLoginsMutex sync.Mutex
+
+// getOidcProvider runs discovery against the issuer on first use, so the gallery
+// can start before the identity provider is reachable.
+func getOidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, config.OidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "OIDC discovery complete", "issuer", config.OidcIssuer)
+	oidcProvider = provider
+	return oidcProvider, nil
+}
+
+func oidcOAuthConfig(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     config.OidcClientID,
+		ClientSecret: config.OidcClientSecret,
+		RedirectURL:  config.OidcRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       config.OidcScopes,
+	}
+}
+
+func storeOidcLogin(state string, login oidcLogin) {
+	oidcLoginsMutex.Lock()
+	defer oidcLoginsMutex.Unlock()
+
+	now := time.Now()
+	for key, existing := range oidcLogins {
+		if now.After(existing.expires) {
+			delete(oidcLogins, key)
+		}
+	}
+	oidcLogins[state] = login
+}
+
+func takeOidcLogin(state string) (oidcLogin, bool) {
+	oidcLoginsMutex.Lock()
+	defer oidcLoginsMutex.Unlock()
+
+	login, ok := oidcLogins[state]
+	delete(oidcLogins, state)
+	if !ok || time.Now().After(login.expires) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+// oidcRole maps the groups claim to a gallery role, falling back to OIDC_DEFAULT_ROLE.
+// The second result reports whether any groups are mapped to roles, in which case the
+// role is applied on every login, so users removed from a group lose its role.
+func oidcRole(groups []string) (string, bool) {
+	mapped := len(config.OidcAdminGroups)+len(config.OidcEditorGroups)+len(config.OidcViewerGroups) > 0
+	hasAny := func(configured []string) bool {
+		for _, group := range groups {
+			if slices.Contains(configured, group) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case hasAny(config.OidcAdminGroups):
+		return types.RoleAdmin, mapped
+	case hasAny(config.OidcEditorGroups):
+		return types.RoleEditor, mapped
+	case hasAny(config.OidcViewerGroups):
+		return types.RoleViewer, mapped
+	}
+	if _, ok := types.RoleRanks[config.OidcDefaultRole]; ok {
+		return config.OidcDefaultRole, mapped
+	}
+	return "", mapped
+}
+
+// claimStrings reads a claim that may be a single string or a list of strings.
+func claimStrings(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return []string{}
+}
+
+// oidcClaims returns the verified ID token claims, topped up from the userinfo
+// endpoint when the username or groups claims are not in the ID token.
+func oidcClaims(ctx context.Context, provider *oidc.Provider, token *oauth2.Token, idToken *oidc.IDToken) (map[string]any, error) {
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	_, hasUsername := claims[config.OidcUsernameClaim]
+	_, hasGroups := claims[config.OidcGroupsClaim]
+	if hasUsername && hasGroups {
+		return claims, nil
+	}
+
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		slog.ErrorContext(ctx, "OIDC userinfo request failed", "error", err)
+		return claims, nil
+	}
+	if userInfo.Subject != idToken.Subject {
+		return nil, errors.New("userinfo subject does not match the ID token")
+	}
+	extra := map[string]any{}
+	if err := userInfo.Claims(&extra); err == nil {
+		for key, value := range extra {
+			if _, exists := claims[key]; !exists {
+				claims[key] = value
+			}
+		}
+	}
+	return claims, nil
+}
+
+// errOidcUsernameTaken is returned when a new identity provider account asks for the username
+// of an existing local account, which it is only allowed to use once an admin has linked them.
+var errOidcUsernameTaken = errors.New("username belongs to an account that is not linked to this identity")
+
+// provisionOidcUser finds the local account linked to an identity provider account, or
+// creates one, keeping its role in step with the identity provider's groups. Accounts are
+// matched on the issuer and subject, which the provider never reassigns, rather than on
+// the username claim, which users can often change themselves.
+func provisionOidcUser(ctx context.Context, issuer string, subject string, username string, role string, syncRole bool) (types.User, error) {
+	user, err := database.GetUserByOidcSubject(ctx, issuer, subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := database.GetUser(ctx, username); err == nil {
+			return types.User{}, errOidcUsernameTaken
+		}
+		password, err := HashPassword(generateToken())
+		if err != nil {
+			return types.User{}, err
+		}
+		newUser := types.NewUser{Username: username, Password: password, Role: role, OidcIssuer: issuer, OidcSubject: subject}
+		if err := database.InsertUserRow(ctx, newUser); err != nil {
+			return types.User{}, err
+		}
+		slog.InfoContext(ctx, "Created user from single sign-on", "user", username, "role", role)
+		return database.GetUser(ctx, username)
+	}
+	if err != nil {
+		return types.User{}, err
+	}
+
+	if user.Disabled {
+		return types.User{}, fmt.Errorf("user %s is disabled", user.Username)
+	}
+	if syncRole && user.Role != role {
+		if user.Role == types.RoleAdmin && isLastEnabledAdmin(ctx, user) {
+			slog.WarnContext(ctx, "Keeping user as admin despite single sign-on groups, as they are the last admin", "user", user.Username)
+			return user, nil
+		}
+		if err := database.UpdateUserRole(ctx, user.Username, role); err != nil {
+			return types.User{}, err
+		}
+		user.Role = role
+	}
+	return user, nil
+}
+
+func HandleGetOidc(w http.ResponseWriter, r *http.Request) {
+	type OidcStatus struct {
+		Enabled bool `json:"enabled"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(OidcStatus{Enabled: config.OidcEnabled()}); err != nil {
+		net.InternalError(w)
+	}
+}
+
+// OidcLoginHandler starts an authorization code flow with PKCE against the configured issuer.
+func OidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.OidcEnabled() {
+		net.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	provider, err := getOidcProvider(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC discovery failed", "issuer", config.OidcIssuer, "error", err)
+		net.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := generateToken()
+	login := oidcLogin{
+		verifier: oauth2.GenerateVerifier(),
+		nonce:    generateToken(),
+		expires:  time.Now().Add(oidcLoginLifetime),
+	}
+	storeOidcLogin(state, login)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     config.URLPath("/api/oidc"),
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+	})
+
+	authURL := oidcOAuthConfig(provider).AuthCodeURL(state, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OidcCallbackHandler completes the authorization code flow and creates a local session.
+func OidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.OidcEnabled() {
+		net.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", MaxAge: -1, Path: config.URLPath("/api/oidc")})
+
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		slog.WarnContext(r.Context(), "OIDC login rejected by identity provider", "error", errorCode, "description", r.URL.Query().Get("error_description"))
+		net.Error(w, "Login rejected by identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		net.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	login, ok := takeOidcLogin(state)
+	if !ok {
+		net.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	provider, err := getOidcProvider(r.Context())
+	if err != nil {
+		net.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	token, err := oidcOAuthConfig(provider).Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange failed", "error", err)
+		net.Error(w, "Failed to complete login", http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		net.Error(w, "Identity provider did not return an ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.OidcClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != login.nonce {
+		slog.WarnContext(r.Context(), "OIDC ID token rejected", "error", err)
+		net.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := oidcClaims(r.Context(), provider, token, idToken)
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC claims rejected", "error", err)
+		net.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	usernames := claimStrings(claims, config.OidcUsernameClaim)
+	if len(usernames) == 0 || strings.TrimSpace(usernames[0]) == "" {
+		slog.WarnContext(r.Context(), "OIDC login has no username claim", "subject", idToken.Subject, "claim", config.OidcUsernameClaim)
+		net.Error(w, "Identity provider did not return a username", http.StatusForbidden)
+		return
+	}
+	username := strings.TrimSpace(usernames[0])
+
+	role, syncRole := oidcRole(claimStrings(claims, config.OidcGroupsClaim))
+	if role == "" {
+		slog.WarnContext(r.Context(), "OIDC login denied, no matching groups", "user", username, "ip", net.ClientIP(r))
+		net.Error(w, "Your account is not allowed to use this gallery", http.StatusForbidden)
+		return
+	}
+
+	user, err := provisionOidcUser(r.Context(), idToken.Issuer, idToken.Subject, username, role, syncRole)
+	if err != nil {
+		// the subject is what an admin needs to link the identity to an existing account
+		slog.WarnContext(r.Context(), "OIDC login denied", "user", username, "issuer", idToken.Issuer, "subject", idToken.Subject, "error", err)
+		net.Error(w, "Your account is not allowed to use this gallery", http.StatusForbidden)
+		return
+	}
+
+	if err := createSession(w, r, user.Username); err != nil {
+		net.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Single sign-on login successful", "user", user.Username, "role", user.Role)
+	http.Redirect(w, r, config.URLPath("/"), http.StatusFound)
+}
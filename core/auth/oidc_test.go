@@ -0,0 +1,420 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID provider with just enough of the protocol for the gallery's
+// login flow: discovery, signing keys and a token endpoint that checks the PKCE verifier.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex  sync.Mutex
+	grants map[string]mockGrant
+}
+
+// mockGrant is what the authorization endpoint would have remembered about a code.
+type mockGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, grants: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]any{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mutex.Lock()
+		grant, ok := issuer.grants[r.FormValue("code")]
+		delete(issuer.grants, r.FormValue("code"))
+		issuer.mutex.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		writeTestJSON(w, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.sign(t, grant.claims),
+		})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func writeTestJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// sign returns an RS256 ID token with the standard claims filled in for the gallery.
+func (issuer *mockIssuer) sign(t *testing.T, claims map[string]any) string {
+	payload := map[string]any{
+		"iss": issuer.server.URL,
+		"aud": config.OidcClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	body, _ := json.Marshal(payload)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize stands in for the user signing in at the identity provider, returning the code
+// it would redirect back with.
+func (issuer *mockIssuer) authorize(challenge string, claims map[string]any) string {
+	code := generateToken()
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+	issuer.grants[code] = mockGrant{challenge: challenge, claims: claims}
+	return code
+}
+
+// setupOidc points the gallery at a fresh mock issuer and an empty database.
+func setupOidc(t *testing.T) *mockIssuer {
+	t.Helper()
+	config.DatabaseDirectory = t.TempDir()
+	if database.Initialise() == nil {
+		t.Fatal("failed to initialise database")
+	}
+	t.Cleanup(database.Close)
+
+	issuer := newMockIssuer(t)
+	config.OidcIssuer = issuer.server.URL
+	config.OidcClientID = "gallery"
+	config.OidcClientSecret = "secret"
+	config.OidcRedirectURL = "https://gallery.test/api/oidc/callback"
+	config.OidcScopes = []string{"openid", "profile", "groups"}
+	config.OidcUsernameClaim = "preferred_username"
+	config.OidcGroupsClaim = "groups"
+	config.OidcAdminGroups = []string{"admins"}
+	config.OidcEditorGroups = []string{"editors"}
+	config.OidcViewerGroups = []string{"family"}
+	config.OidcDefaultRole = ""
+
+	oidcProviderMutex.Lock()
+	oidcProvider = nil
+	oidcProviderMutex.Unlock()
+	return issuer
+}
+
+// oidcStart is a login that has been redirected to the identity provider.
+type oidcStart struct {
+	state     string
+	nonce     string
+	challenge string
+	cookie    *http.Cookie
+}
+
+func startOidcLogin(t *testing.T, issuer *mockIssuer) oidcStart {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	OidcLoginHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login returned %d: %s", recorder.Code, recorder.Body)
+	}
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), issuer.server.URL+"/authorize?") {
+		t.Fatalf("login redirected to %s rather than the discovered authorization endpoint", location)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("login did not send a PKCE challenge: %s", location)
+	}
+
+	start := oidcStart{state: query.Get("state"), nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == oidcStateCookieName {
+			start.cookie = cookie
+		}
+	}
+	if start.state == "" || start.nonce == "" || start.cookie == nil || start.cookie.Value != start.state {
+		t.Fatalf("login did not set up state and nonce: %s", location)
+	}
+	return start
+}
+
+func finishOidcLogin(start oidcStart, code string, state string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	request.AddCookie(start.cookie)
+	recorder := httptest.NewRecorder()
+	OidcCallbackHandler(recorder, request)
+	return recorder
+}
+
+func hasSessionCookie(recorder *httptest.ResponseRecorder) bool {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOidcDiscovery(t *testing.T) {
+	issuer := setupOidc(t)
+
+	provider, err := getOidcProvider(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Endpoint().TokenURL != issuer.server.URL+"/token" {
+		t.Errorf("token endpoint = %s", provider.Endpoint().TokenURL)
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	issuer := setupOidc(t)
+	start := startOidcLogin(t, issuer)
+
+	code := issuer.authorize(start.challenge, map[string]any{
+		"sub": "subject-1", "nonce": start.nonce, "preferred_username": "alice", "groups": []string{"editors"},
+	})
+	recorder := finishOidcLogin(start, code, start.state)
+	if recorder.Code != http.StatusFound || !hasSessionCookie(recorder) {
+		t.Fatalf("callback returned %d without a session: %s", recorder.Code, recorder.Body)
+	}
+
+	user, err := database.GetUser(t.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != types.RoleEditor || user.OidcIssuer != issuer.server.URL || user.OidcSubject != "subject-1" {
+		t.Errorf("user = %+v", user)
+	}
+
+	// the state can only be used once
+	recorder = finishOidcLogin(start, issuer.authorize(start.challenge, nil), start.state)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("reused state returned %d", recorder.Code)
+	}
+}
+
+func TestOidcCallbackRejections(t *testing.T) {
+	claims := func(start oidcStart) map[string]any {
+		return map[string]any{"sub": "subject-1", "nonce": start.nonce, "preferred_username": "alice", "groups": []string{"family"}}
+	}
+
+	tests := []struct {
+		name   string
+		finish func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder
+		status int
+	}{
+		{
+			name: "state not matching the cookie",
+			finish: func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder {
+				return finishOidcLogin(start, issuer.authorize(start.challenge, claims(start)), "forged")
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "state that was never issued",
+			finish: func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder {
+				start.cookie = &http.Cookie{Name: oidcStateCookieName, Value: "forged"}
+				return finishOidcLogin(start, issuer.authorize(start.challenge, claims(start)), "forged")
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "code issued for another PKCE challenge",
+			finish: func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder {
+				other := sha256.Sum256([]byte("someone else's verifier"))
+				return finishOidcLogin(start, issuer.authorize(base64.RawURLEncoding.EncodeToString(other[:]), claims(start)), start.state)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "ID token with another nonce",
+			finish: func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder {
+				replayed := claims(start)
+				replayed["nonce"] = "replayed"
+				return finishOidcLogin(start, issuer.authorize(start.challenge, replayed), start.state)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "ID token without a nonce",
+			finish: func(issuer *mockIssuer, start oidcStart) *httptest.ResponseRecorder {
+				missing := claims(start)
+				delete(missing, "nonce")
+				return finishOidcLogin(start, issuer.authorize(start.challenge, missing), start.state)
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := setupOidc(t)
+			recorder := test.finish(issuer, startOidcLogin(t, issuer))
+			if recorder.Code != test.status || hasSessionCookie(recorder) {
+				t.Errorf("callback returned %d, want %d without a session: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if _, err := database.GetUser(t.Context(), "alice"); err == nil {
+				t.Error("rejected login created a user")
+			}
+		})
+	}
+}
+
+func TestOidcDoesNotTakeOverLocalAccounts(t *testing.T) {
+	issuer := setupOidc(t)
+	if err := database.InsertUserRow(t.Context(), types.NewUser{Username: "admin", Password: "hash", Role: types.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	login := func() *httptest.ResponseRecorder {
+		start := startOidcLogin(t, issuer)
+		return finishOidcLogin(start, issuer.authorize(start.challenge, map[string]any{
+			"sub": "subject-1", "nonce": start.nonce, "preferred_username": "admin", "groups": []string{"family"},
+		}), start.state)
+	}
+
+	if recorder := login(); recorder.Code != http.StatusForbidden || hasSessionCookie(recorder) {
+		t.Fatalf("login as an unlinked local account returned %d", recorder.Code)
+	}
+
+	if err := database.UpdateUserOidcSubject(t.Context(), "admin", issuer.server.URL, "subject-1"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := login(); recorder.Code != http.StatusFound || !hasSessionCookie(recorder) {
+		t.Fatalf("login as a linked account returned %d: %s", recorder.Code, recorder.Body)
+	}
+	// the last admin keeps their role whatever their groups say
+	if user, _ := database.GetUser(t.Context(), "admin"); user.Role != types.RoleAdmin {
+		t.Errorf("role = %s", user.Role)
+	}
+}
+
+func TestOidcRole(t *testing.T) {
+	tests := []struct {
+		groups      []string
+		mapped      bool
+		defaultRole string
+		role        string
+	}{
+		{groups: []string{"admins"}, mapped: true, role: types.RoleAdmin},
+		{groups: []string{"family", "editors"}, mapped: true, role: types.RoleEditor},
+		{groups: []string{"editors", "admins"}, mapped: true, role: types.RoleAdmin},
+		{groups: []string{"family"}, mapped: true, role: types.RoleViewer},
+		{groups: []string{"strangers"}, mapped: true, role: ""},
+		{groups: []string{}, mapped: true, defaultRole: types.RoleViewer, role: types.RoleViewer},
+		{groups: []string{"strangers"}, mapped: true, defaultRole: "superuser", role: ""},
+		{groups: []string{"admins"}, defaultRole: types.RoleViewer, role: types.RoleViewer},
+	}
+	for _, test := range tests {
+		config.OidcAdminGroups = []string{}
+		config.OidcEditorGroups = []string{}
+		config.OidcViewerGroups = []string{}
+		if test.mapped {
+			config.OidcAdminGroups = []string{"admins"}
+			config.OidcEditorGroups = []string{"editors"}
+			config.OidcViewerGroups = []string{"family"}
+		}
+		config.OidcDefaultRole = test.defaultRole
+		role, syncRole := oidcRole(test.groups)
+		if role != test.role || syncRole != test.mapped {
+			t.Errorf("oidcRole(%v) with default %q = %q, %v; want %q, %v", test.groups, test.defaultRole, role, syncRole, test.role, test.mapped)
+		}
+	}
+}
+
+func TestOidcRoleFollowsGroups(t *testing.T) {
+	issuer := setupOidc(t)
+	config.OidcDefaultRole = types.RoleViewer
+	// another admin, so alice is not kept as the last one
+	if err := database.InsertUserRow(t.Context(), types.NewUser{Username: "admin", Password: "hash", Role: types.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	login := func(groups []string) string {
+		t.Helper()
+		start := startOidcLogin(t, issuer)
+		recorder := finishOidcLogin(start, issuer.authorize(start.challenge, map[string]any{
+			"sub": "subject-1", "nonce": start.nonce, "preferred_username": "alice", "groups": groups,
+		}), start.state)
+		if recorder.Code != http.StatusFound {
+			t.Fatalf("login with groups %v returned %d: %s", groups, recorder.Code, recorder.Body)
+		}
+		user, err := database.GetUser(t.Context(), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Role
+	}
+
+	if role := login([]string{"admins"}); role != types.RoleAdmin {
+		t.Errorf("role in the admin group = %s", role)
+	}
+	// removed from every group, the default role replaces the one the groups gave
+	if role := login([]string{}); role != types.RoleViewer {
+		t.Errorf("role in no groups = %s, want the default %s", role, types.RoleViewer)
+	}
+
+	config.OidcDefaultRole = ""
+	start := startOidcLogin(t, issuer)
+	recorder := finishOidcLogin(start, issuer.authorize(start.challenge, map[string]any{
+		"sub": "subject-1", "nonce": start.nonce, "preferred_username": "alice", "groups": []string{},
+	}), start.state)
+	if recorder.Code != http.StatusForbidden || hasSessionCookie(recorder) {
+		t.Errorf("login in no groups without a default role returned %d", recorder.Code)
+	}
+}
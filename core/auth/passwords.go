@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// dummyHash is compared against when a username does not exist, so failed
+// logins take the same time whether or not the account is real.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gallery-dummy-password"), bcrypt.DefaultCost)
+
+func HashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func IsPasswordHash(value string) bool {
+	_, err := bcrypt.Cost([]byte(value))
+	return err == nil
+}
+
+func checkPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkCredentials returns the user for a username/password pair, taking
+// roughly the same time for unknown users as for a wrong password.
+func checkCredentials(ctx context.Context, username string, password string) (types.User, bool) {
+	user, err := database.GetUser(ctx, username)
+	if err != nil {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return types.User{}, false
+	}
+	if !checkPassword(user.Password, password) || user.Disabled {
+		return types.User{}, false
+	}
+	return user, true
+}
+
+// upgradePlaintextPasswords hashes any user passwords stored before hashing was introduced.
+func upgradePlaintextPasswords() {
+	users, err := database.GetAllUsers(context.Background())
+	if err != nil {
+		slog.Error("Failed to fetch users for password upgrade", "error", err)
+		return
+	}
+
+	for _, listed := range users {
+		user, err := database.GetUser(context.Background(), listed.Username)
+		if err != nil || IsPasswordHash(user.Password) {
+			continue
+		}
+		hash, err := HashPassword(user.Password)
+		if err != nil {
+			slog.Error("Failed to hash password", "user", user.Username, "error", err)
+			continue
+		}
+		if err := database.UpdateUserPassword(context.Background(), user.Username, hash); err == nil {
+			slog.Info("Upgraded plaintext password to a hash", "user", user.Username)
+		}
+	}
+}
+
+func adminPasswordHash() (string, error) {
+	if config.AdminPasswordHash != "" {
+		if !IsPasswordHash(config.AdminPasswordHash) {
+			return "", errors.New("ADMIN_PASSWORD_HASH is not a valid bcrypt hash")
+		}
+		return config.AdminPasswordHash, nil
+	}
+	slog.Warn("ADMIN_PASSWORD is stored in plaintext, consider replacing it with ADMIN_PASSWORD_HASH from `gallery hash-password`")
+	return HashPassword(config.AdminPassword)
+}
+
+// seedAdminUser creates the configured admin account when the users table is empty,
+// so existing single-user installs keep working after upgrading. A configured
+// ADMIN_PASSWORD_HASH is also applied to an existing admin account, so the hash can be rotated.
+func seedAdminUser() {
+	users, err := database.GetAllUsers(context.Background())
+	if err != nil {
+		slog.Error("Error counting users", "error", err)
+		return
+	}
+
+	if len(users) > 0 {
+		if config.AdminPasswordHash == "" {
+			return
+		}
+		user, err := database.GetUser(context.Background(), config.AdminUser)
+		if err != nil || user.Password == config.AdminPasswordHash {
+			return
+		}
+		hash, err := adminPasswordHash()
+		if err != nil {
+			slog.Error("Error applying admin password hash", "error", err)
+			return
+		}
+		if err := database.UpdateUserPassword(context.Background(), config.AdminUser, hash); err == nil {
+			slog.Info("Admin password hash updated", "user", config.AdminUser)
+		}
+		return
+	}
+
+	hash, err := adminPasswordHash()
+	if err != nil {
+		slog.Error("Error seeding admin user", "error", err)
+		return
+	}
+	err = database.InsertUserRow(context.Background(), types.NewUser{
+		Username: config.AdminUser,
+		Password: hash,
+		Role:     types.RoleAdmin,
+	})
+	if err != nil {
+		slog.Error("Error seeding admin user", "error", err)
+		return
+	}
+	slog.Info("Admin user created", "user", config.AdminUser)
+}
+
+func InitialiseUsers() {
+	upgradePlaintextPasswords()
+	seedAdminUser()
+}
+
+// HashPasswordCommand implements `gallery hash-password`, which reads the password from
+// stdin so it is never left in the shell history or the process list. When stdin is a
+// terminal, it prompts on stderr and the password is not echoed.
+func HashPasswordCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if len(args) > 0 {
+		return errors.New("the password is read from stdin and cannot be passed as an argument")
+	}
+
+	var password string
+	if file, ok := stdin.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		fmt.Fprint(stderr, "Password: ")
+		read, err := term.ReadPassword(int(file.Fd()))
+		fmt.Fprintln(stderr)
+		if err != nil {
+			return err
+		}
+		password = string(read)
+	} else {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return errors.New("no password given")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, hash)
+	return err
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// getProxyUser trusts the configured PROXY_AUTH_HEADER to name the user, but only
+// when the request comes directly from one of the PROXY_AUTH_CIDRS.
+func getProxyUser(r *http.Request) (types.User, bool) {
+	if !config.ProxyAuthEnabled() {
+		return types.User{}, false
+	}
+
+	username := strings.TrimSpace(r.Header.Get(config.ProxyAuthHeader))
+	if username == "" {
+		return types.User{}, false
+	}
+
+	remoteIP := net.RemoteIP(r)
+	if !net.InNetworks(remoteIP, config.ProxyAuthCIDRs) {
+		slog.WarnContext(r.Context(), "Ignoring proxy authentication header from untrusted address", "header", config.ProxyAuthHeader, "ip", remoteIP)
+		return types.User{}, false
+	}
+
+	user, err := database.GetUser(r.Context(), username)
+	if err == nil {
+		return user, !user.Disabled
+	}
+
+	if _, ok := types.RoleRanks[config.ProxyAuthDefaultRole]; !ok {
+		slog.WarnContext(r.Context(), "Proxy authenticated user has no account and PROXY_AUTH_DEFAULT_ROLE is not set", "user", username)
+		return types.User{}, false
+	}
+	password, err := HashPassword(generateToken())
+	if err != nil {
+		return types.User{}, false
+	}
+	err = database.InsertUserRow(r.Context(), types.NewUser{Username: username, Password: password, Role: config.ProxyAuthDefaultRole})
+	if err != nil {
+		return types.User{}, false
+	}
+	slog.InfoContext(r.Context(), "Created user from proxy authentication", "user", username, "role", config.ProxyAuthDefaultRole)
+
+	user, err = database.GetUser(r.Context(), username)
+	return user, err == nil
+}
+
+// RequestUser identifies the user behind a request to a public route, which
+// AuthMiddleware has not checked, from an API token, trusted proxy header or session cookie.
+func RequestUser(r *http.Request) (types.User, bool) {
+	if user, ok := GetUser(r); ok {
+		return user, true
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, user, ok := getBearerToken(r)
+		return user, ok
+	}
+	return getRequestUser(r)
+}
+
+// getRequestUser identifies the user behind a browser request, from a trusted proxy header or a session cookie.
+func getRequestUser(r *http.Request) (types.User, bool) {
+	if user, ok := getProxyUser(r); ok {
+		return user, true
+	}
+	return getSessionUser(r)
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"gallery/core/config"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var loginAttemptsByKey = make(map[string]*loginAttempts)
+var loginAttemptsMutex sync.Mutex
+
+// maxLoginAttemptKeys caps how many ips, usernames and passwords are tracked, so failures
+// from many addresses cannot grow the map without bound between prunes.
+const maxLoginAttemptKeys = 10000
+
+// loginAttemptsPruneInterval is how often records that no longer count are dropped.
+const loginAttemptsPruneInterval = time.Minute
+
+func loginAttemptKeys(ip string, username string) []string {
+	return []string{"ip:" + ip, "user:" + strings.ToLower(username)}
+}
+
+// lockoutFor doubles the lockout for every failure past the allowed attempts, up to the configured maximum.
+func lockoutFor(failures int) time.Duration {
+	exponent := failures - config.LoginMaxAttempts
+	if exponent < 0 {
+		return 0
+	}
+	lockout := float64(config.LoginLockoutDuration) * math.Pow(2, float64(exponent))
+	if lockout > float64(config.LoginMaxLockoutDuration) {
+		return config.LoginMaxLockoutDuration
+	}
+	return time.Duration(lockout)
+}
+
+// stale reports whether a record's last failure is older than the maximum lockout, so
+// failures spread out over a long time do not add up to a lockout.
+func (attempts *loginAttempts) stale(now time.Time) bool {
+	return now.Sub(attempts.lastFailure) > config.LoginMaxLockoutDuration && now.After(attempts.lockedUntil)
+}
+
+// forgetStaleAttempts drops stale records. It is called with the mutex held.
+func forgetStaleAttempts(now time.Time) {
+	for key, attempts := range loginAttemptsByKey {
+		if attempts.stale(now) {
+			delete(loginAttemptsByKey, key)
+		}
+	}
+}
+
+// nextAttemptEviction is when makeRoomForAttempt may next find a record to drop, after
+// finding the map full of locked records, so it does not scan the map for every new key.
+var nextAttemptEviction time.Time
+
+// makeRoomForAttempt reports whether a new record can be added, dropping every record that
+// is not locked once the map is full. Locked records are never dropped, so flooding the map
+// with failures cannot lift a lockout. It is called with the mutex held.
+func makeRoomForAttempt(now time.Time) bool {
+	if len(loginAttemptsByKey) < maxLoginAttemptKeys {
+		return true
+	}
+	if now.Before(nextAttemptEviction) {
+		return false
+	}
+	var nextUnlock time.Time
+	for key, attempts := range loginAttemptsByKey {
+		if !attempts.lockedUntil.After(now) {
+			delete(loginAttemptsByKey, key)
+		} else if nextUnlock.IsZero() || attempts.lockedUntil.Before(nextUnlock) {
+			nextUnlock = attempts.lockedUntil
+		}
+	}
+	if len(loginAttemptsByKey) < maxLoginAttemptKeys {
+		return true
+	}
+	nextAttemptEviction = nextUnlock
+	return false
+}
+
+func pruneLoginAttempts(ctx context.Context) {
+	ticker := time.NewTicker(loginAttemptsPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			loginAttemptsMutex.Lock()
+			forgetStaleAttempts(now)
+			loginAttemptsMutex.Unlock()
+		}
+	}
+}
+
+// InitialiseLoginAttempts prunes the failed login and password records in the background until ctx is cancelled.
+func InitialiseLoginAttempts(ctx context.Context) {
+	go pruneLoginAttempts(ctx)
+}
+
+// loginRetryAfter returns how long the ip and username must wait before trying to log in again.
+func loginRetryAfter(ip string, username string) time.Duration {
+	return retryAfter(loginAttemptKeys(ip, username))
+}
+
+func recordLoginFailure(ctx context.Context, ip string, username string) {
+	recordFailure(ctx, loginAttemptKeys(ip, username))
+}
+
+func recordLoginSuccess(ip string, username string) {
+	recordSuccess(loginAttemptKeys(ip, username))
+}
+
+// unlockAttemptKeys limits guesses at album and share link passwords. They are kept apart
+// from the login keys, so that a wrong album password does not lock the ip out of logging in.
+func unlockAttemptKeys(ip string, target string) []string {
+	return []string{"unlock-ip:" + ip, "unlock:" + target}
+}
+
+// unlockRetryAfter returns how long the ip must wait before trying target's password again.
+func unlockRetryAfter(ip string, target string) time.Duration {
+	return retryAfter(unlockAttemptKeys(ip, target))
+}
+
+func recordUnlockFailure(ctx context.Context, ip string, target string) {
+	recordFailure(ctx, unlockAttemptKeys(ip, target))
+}
+
+func recordUnlockSuccess(ip string, target string) {
+	recordSuccess(unlockAttemptKeys(ip, target))
+}
+
+func retryAfter(keys []string) time.Duration {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if attempts, ok := loginAttemptsByKey[key]; ok && attempts.lockedUntil.After(now) {
+			wait = max(wait, attempts.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+func recordFailure(ctx context.Context, keys []string) {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		attempts, ok := loginAttemptsByKey[key]
+		if !ok || attempts.stale(now) {
+			// with no room, the failure still counts against the request's other keys
+			if !ok && !makeRoomForAttempt(now) {
+				slog.WarnContext(ctx, "Too many failed login records, not recording failure", "key", key)
+				continue
+			}
+			attempts = &loginAttempts{}
+			loginAttemptsByKey[key] = attempts
+		}
+		attempts.failures++
+		attempts.lastFailure = now
+		if lockout := lockoutFor(attempts.failures); lockout > 0 {
+			attempts.lockedUntil = now.Add(lockout)
+			slog.WarnContext(ctx, "Login locked after repeated failures", "key", key, "lockout", lockout, "failures", attempts.failures)
+		}
+	}
+}
+
+func recordSuccess(keys []string) {
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+
+	for _, key := range keys {
+		delete(loginAttemptsByKey, key)
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"gallery/core/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setupLoginAttempts starts each test with no failures recorded, allowing 3 attempts
+// before a one minute lockout that doubles up to eight minutes.
+func setupLoginAttempts(t *testing.T) {
+	t.Helper()
+	config.LoginMaxAttempts = 3
+	config.LoginLockoutDuration = time.Minute
+	config.LoginMaxLockoutDuration = 8 * time.Minute
+	loginAttemptsByKey = make(map[string]*loginAttempts)
+	nextAttemptEviction = time.Time{}
+	t.Cleanup(func() {
+		loginAttemptsByKey = make(map[string]*loginAttempts)
+		nextAttemptEviction = time.Time{}
+	})
+}
+
+// roundUp rounds a wait up to the nearest second, as it shrinks while the test runs.
+func roundUp(wait time.Duration) time.Duration {
+	return (wait + time.Second - 1).Truncate(time.Second)
+}
+
+func TestLoginLockoutBacksOff(t *testing.T) {
+	setupLoginAttempts(t)
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 8 * time.Minute}
+	for i, wait := range want {
+		recordLoginFailure(t.Context(), "192.0.2.1", "admin")
+		if got := roundUp(loginRetryAfter("192.0.2.1", "admin")); got != wait {
+			t.Errorf("after %d failures, wait is %s, want %s", i+1, got, wait)
+		}
+	}
+
+	if wait := loginRetryAfter("192.0.2.2", "Admin"); wait == 0 {
+		t.Error("another ip can keep guessing the locked username")
+	}
+	if wait := loginRetryAfter("192.0.2.1", "editor"); wait == 0 {
+		t.Error("the locked ip can keep guessing another username")
+	}
+	if wait := loginRetryAfter("192.0.2.2", "editor"); wait != 0 {
+		t.Errorf("an unrelated ip and username wait %s", wait)
+	}
+	if wait := unlockRetryAfter("192.0.2.1", "album:holiday"); wait != 0 {
+		t.Errorf("failed logins lock the ip out of album passwords for %s", wait)
+	}
+
+	recordLoginSuccess("192.0.2.1", "admin")
+	if wait := loginRetryAfter("192.0.2.1", "admin"); wait != 0 {
+		t.Errorf("after logging in, wait is %s", wait)
+	}
+}
+
+func TestStaleFailuresAreForgotten(t *testing.T) {
+	setupLoginAttempts(t)
+	now := time.Now()
+	old := now.Add(-config.LoginMaxLockoutDuration - time.Minute)
+	loginAttemptsByKey["user:stale"] = &loginAttempts{failures: 2, lastFailure: old}
+	loginAttemptsByKey["user:recent"] = &loginAttempts{failures: 2, lastFailure: now}
+	loginAttemptsByKey["user:locked"] = &loginAttempts{failures: 9, lastFailure: old, lockedUntil: now.Add(time.Minute)}
+
+	forgetStaleAttempts(now)
+	for key, kept := range map[string]bool{"user:stale": false, "user:recent": true, "user:locked": true} {
+		if _, ok := loginAttemptsByKey[key]; ok != kept {
+			t.Errorf("kept %s: %t, want %t", key, ok, kept)
+		}
+	}
+
+	loginAttemptsByKey["user:stale"] = &loginAttempts{failures: 2, lastFailure: old}
+	recordFailure(t.Context(), []string{"user:stale"})
+	if failures := loginAttemptsByKey["user:stale"].failures; failures != 1 {
+		t.Errorf("a failure after a stale record counts as %d failures, want 1", failures)
+	}
+}
+
+func TestFullAttemptsKeepLockedRecords(t *testing.T) {
+	now := time.Now()
+	fill := func(lockedUntil time.Time) {
+		for i := len(loginAttemptsByKey); i < maxLoginAttemptKeys; i++ {
+			loginAttemptsByKey["user:flood-"+strconv.Itoa(i)] = &loginAttempts{failures: 3, lastFailure: now, lockedUntil: lockedUntil}
+		}
+	}
+
+	t.Run("unlocked records make room", func(t *testing.T) {
+		setupLoginAttempts(t)
+		loginAttemptsByKey["user:victim"] = &loginAttempts{failures: 9, lastFailure: now, lockedUntil: now.Add(time.Hour)}
+		fill(now.Add(-time.Second))
+
+		recordFailure(t.Context(), []string{"user:new"})
+		if _, ok := loginAttemptsByKey["user:new"]; !ok {
+			t.Error("did not record the new key")
+		}
+		if _, ok := loginAttemptsByKey["user:victim"]; !ok {
+			t.Error("dropped a locked record")
+		}
+		if len(loginAttemptsByKey) != 2 {
+			t.Errorf("kept %d records, want 2", len(loginAttemptsByKey))
+		}
+	})
+
+	t.Run("locked records are kept", func(t *testing.T) {
+		setupLoginAttempts(t)
+		loginAttemptsByKey["user:victim"] = &loginAttempts{failures: 9, lastFailure: now, lockedUntil: now.Add(time.Hour)}
+		fill(now.Add(time.Hour))
+		recordLoginFailure(t.Context(), "192.0.2.9", "new")
+
+		if _, ok := loginAttemptsByKey["user:new"]; ok {
+			t.Error("recorded a key with the map full of locked records")
+		}
+		if len(loginAttemptsByKey) != maxLoginAttemptKeys {
+			t.Errorf("kept %d records, want %d", len(loginAttemptsByKey), maxLoginAttemptKeys)
+		}
+		if wait := loginRetryAfter("192.0.2.1", "victim"); wait < 59*time.Minute {
+			t.Errorf("flooding the map lifted the victim's lockout, leaving %s", wait)
+		}
+		if !nextAttemptEviction.After(now) {
+			t.Error("a full map of locked records will be scanned again for the next key")
+		}
+	})
+}
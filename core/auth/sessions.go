@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const sessionCookieName = "appSession"
+const sessionSweepInterval = 10 * time.Minute
+const lastSeenResolution = time.Minute
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionExpired(session types.Session, now time.Time) bool {
+	return now.Sub(session.DateCreated) > config.SessionMaxAge || now.Sub(session.LastSeen) > config.SessionIdleTimeout
+}
+
+// createSession stores a new session for username and sets its cookie on the response.
+func createSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token := generateToken()
+	_, err := database.InsertSessionRow(r.Context(), hashToken(token), username, net.ClientIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: cookieSameSite(),
+		Path:     config.URLPath("/"),
+		MaxAge:   int(config.SessionMaxAge.Seconds()),
+	})
+	setCsrfCookie(w, token)
+	return nil
+}
+
+// getSession resolves the session cookie to a live session, expiring it if it has timed out.
+func getSession(r *http.Request) (types.Session, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return types.Session{}, false
+	}
+
+	session, err := database.GetSessionByTokenHash(r.Context(), hashToken(cookie.Value))
+	if err != nil {
+		return types.Session{}, false
+	}
+
+	now := time.Now().UTC()
+	if sessionExpired(session, now) {
+		_ = database.DeleteSessionRow(r.Context(), session.ID)
+		return types.Session{}, false
+	}
+	if now.Sub(session.LastSeen) > lastSeenResolution {
+		_ = database.UpdateSessionLastSeen(r.Context(), session.ID)
+	}
+	return session, true
+}
+
+// getSessionUser resolves the session cookie to an enabled user.
+func getSessionUser(r *http.Request) (types.User, bool) {
+	session, ok := getSession(r)
+	if !ok {
+		return types.User{}, false
+	}
+
+	user, err := database.GetUser(r.Context(), session.Username)
+	if err != nil || user.Disabled {
+		return types.User{}, false
+	}
+	return user, true
+}
+
+func deleteCurrentSession(r *http.Request) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return
+	}
+	session, err := database.GetSessionByTokenHash(r.Context(), hashToken(cookie.Value))
+	if err != nil {
+		return
+	}
+	_ = database.DeleteSessionRow(r.Context(), session.ID)
+}
+
+func sweepExpiredSessions(ctx context.Context) {
+	now := time.Now().UTC()
+	expired, err := database.DeleteExpiredSessions(ctx, now.Add(-config.SessionIdleTimeout), now.Add(-config.SessionMaxAge))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to sweep expired sessions", "error", err)
+		return
+	}
+	if expired > 0 {
+		slog.InfoContext(ctx, "Swept expired sessions", "count", expired)
+	}
+}
+
+func sweepSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		sweepExpiredSessions(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var wgSessions sync.WaitGroup
+
+// InitialiseSessions sweeps expired sessions in the background until ctx is cancelled.
+func InitialiseSessions(ctx context.Context) {
+	wgSessions.Add(1)
+	go func() {
+		defer wgSessions.Done()
+		sweepSessions(ctx)
+	}()
+}
+
+// WaitForSessions waits for the session sweeper to stop after its context is cancelled.
+func WaitForSessions() {
+	wgSessions.Wait()
+}
+
+func HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+	current, _ := getSession(r)
+
+	sessions, err := database.GetAllSessions(r.Context())
+	if err != nil {
+		net.Error(w, "Failed to retrieve sessions", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	visible := []types.Session{}
+	for _, session := range sessions {
+		if sessionExpired(session, now) {
+			continue
+		}
+		if user.Role != types.RoleAdmin && session.Username != user.Username {
+			continue
+		}
+		session.Current = session.ID == current.ID
+		visible = append(visible, session)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(visible); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+	id := r.PathValue("id")
+
+	session, err := database.GetSession(r.Context(), id)
+	if err != nil || (user.Role != types.RoleAdmin && session.Username != user.Username) {
+		net.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := database.DeleteSessionRow(r.Context(), id); err != nil {
+		net.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Session revoked", "session", id, "user", session.Username, "by", user.Username)
+	Audit(r, "session.delete", id, "", session, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Session revoked successfully"))
+}
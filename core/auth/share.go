@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const shareTokenPrefix = "shr_"
+const shareCookiePrefix = "share_"
+
+// shareGrantLifetime caps how long an opened share link stays open in a browser without counting another view.
+const shareGrantLifetime = 24 * time.Hour
+
+// getShareLink resolves a share token to a link that has not expired.
+func getShareLink(ctx context.Context, token string) (types.ShareLink, bool) {
+	if !strings.HasPrefix(token, shareTokenPrefix) {
+		return types.ShareLink{}, false
+	}
+	link, err := database.GetShareLinkByHash(ctx, hashToken(token))
+	if err != nil {
+		return types.ShareLink{}, false
+	}
+	if link.Expires != nil && time.Now().After(*link.Expires) {
+		return types.ShareLink{}, false
+	}
+	return link, true
+}
+
+// shareGrant is the cookie value proving a browser has opened a share link, and
+// entered its password if it has one. It is keyed by a secret that never leaves the server.
+func shareGrant(link types.ShareLink, token string) string {
+	mac := hmac.New(sha256.New, []byte(link.Secret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hasShareGrant(r *http.Request, link types.ShareLink, token string) bool {
+	cookie, err := r.Cookie(shareCookiePrefix + link.ID)
+	return err == nil && hmac.Equal([]byte(cookie.Value), []byte(shareGrant(link, token)))
+}
+
+func setShareGrant(w http.ResponseWriter, link types.ShareLink, token string) {
+	lifetime := shareGrantLifetime
+	if link.Expires != nil {
+		lifetime = min(lifetime, time.Until(*link.Expires))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookiePrefix + link.ID,
+		Value:    shareGrant(link, token),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: cookieSameSite(),
+		Path:     config.URLPath("/api"),
+		MaxAge:   int(lifetime.Seconds()),
+	})
+}
+
+// shareLinkSlugs lists the images a share link gives access to.
+func shareLinkSlugs(ctx context.Context, link types.ShareLink) ([]string, error) {
+	if link.ImageSlug != "" {
+		return []string{link.ImageSlug}, nil
+	}
+	slugs, err := database.GetAlbumLinks(ctx, link.AlbumSlug, true, false)
+	if slugs == nil {
+		slugs = []string{}
+	}
+	return slugs, err
+}
+
+// RequestShareLink returns the share link in the request's "share" query parameter,
+// if it is valid and has been opened by this browser.
+func RequestShareLink(r *http.Request) (types.ShareLink, bool) {
+	token := r.URL.Query().Get("share")
+	link, ok := getShareLink(r.Context(), token)
+	if !ok || !hasShareGrant(r, link, token) {
+		return types.ShareLink{}, false
+	}
+	return link, true
+}
+
+// ShareLinkAllows reports whether the share token in the request's "share" query
+// parameter has been opened by this browser and covers the image slug.
+func ShareLinkAllows(r *http.Request, slug string) bool {
+	link, ok := RequestShareLink(r)
+	if !ok {
+		return false
+	}
+	if link.ImageSlug != "" {
+		return link.ImageSlug == slug
+	}
+	albums, err := database.GetImageLinks(r.Context(), slug, true)
+	return err == nil && slices.Contains(albums, link.AlbumSlug)
+}
+
+// OpenShareLinkHandler checks a share link's password and view limit, then lets
+// the browser load the shared images by passing the token as ?share= on the image endpoints.
+func OpenShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	link, ok := getShareLink(r.Context(), token)
+	if !ok {
+		net.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return
+	}
+
+	if !hasShareGrant(r, link, token) {
+		if link.HasPassword {
+			type Unlock struct {
+				Password string `json:"password"`
+			}
+			var unlock Unlock
+			if err := json.NewDecoder(r.Body).Decode(&unlock); err != nil && !errors.Is(err, io.EOF) {
+				net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+				return
+			}
+
+			ip := net.ClientIP(r)
+			attemptKey := "share:" + link.ID
+			if wait := unlockRetryAfter(ip, attemptKey); wait > 0 {
+				writeRetryAfter(w, wait)
+				return
+			}
+			if !checkPassword(link.PasswordHash, unlock.Password) {
+				recordUnlockFailure(r.Context(), ip, attemptKey)
+				net.Error(w, "Password required", http.StatusUnauthorized)
+				return
+			}
+			recordUnlockSuccess(ip, attemptKey)
+		}
+
+		counted, err := database.UseShareLinkView(r.Context(), link.ID)
+		if err != nil {
+			net.Error(w, "Failed to open share link", http.StatusInternalServerError)
+			return
+		}
+		if !counted {
+			net.Error(w, "Share link has reached its view limit", http.StatusGone)
+			return
+		}
+		setShareGrant(w, link, token)
+	}
+
+	slugs, err := shareLinkSlugs(r.Context(), link)
+	if err != nil {
+		net.Error(w, "Failed to retrieve shared images", http.StatusInternalServerError)
+		return
+	}
+	content := types.SharedContent{AlbumSlug: link.AlbumSlug, ImageSlugs: slugs, Expires: link.Expires}
+	if link.AlbumSlug != "" {
+		if album, err := database.GetAlbum(r.Context(), link.AlbumSlug); err == nil {
+			content.AlbumName = album.Name
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(content); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandleGetShareLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := database.GetAllShareLinks(r.Context())
+	if err != nil {
+		net.Error(w, "Failed to retrieve share links", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(links); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandlePostShareLink(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+
+	var newLink types.NewShareLink
+	if err := json.NewDecoder(r.Body).Decode(&newLink); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	if (newLink.AlbumSlug == "") == (newLink.ImageSlug == "") {
+		net.Error(w, "Exactly one of albumSlug or imageSlug is required", http.StatusBadRequest)
+		return
+	}
+	if newLink.AlbumSlug != "" {
+		if _, err := database.GetAlbum(r.Context(), newLink.AlbumSlug); err != nil {
+			net.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+	} else if _, err := database.GetMetadataBySlug(r.Context(), newLink.ImageSlug); err != nil {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if newLink.Expires != nil && !newLink.Expires.After(time.Now()) {
+		net.Error(w, "expires must be in the future", http.StatusBadRequest)
+		return
+	}
+	if newLink.MaxViews < 0 {
+		net.Error(w, "maxViews must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash := ""
+	if newLink.Password != "" {
+		hash, err := HashPassword(newLink.Password)
+		if err != nil {
+			net.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		passwordHash = hash
+	}
+
+	token := shareTokenPrefix + strings.TrimRight(generateToken(), "=")
+	link, err := database.InsertShareLinkRow(r.Context(), hashToken(token), generateToken(), passwordHash, user.Username, newLink)
+	if err != nil {
+		net.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, "share.create", link.ID, link.AlbumSlug, nil, link)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(types.CreatedShareLink{ShareLink: link, Token: token}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode created share link", "error", err)
+	}
+}
+
+func HandleDeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	link, err := database.GetShareLink(r.Context(), id)
+	if err != nil {
+		net.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err := database.DeleteShareLinkRow(r.Context(), id); err != nil {
+		net.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, "share.delete", id, link.AlbumSlug, link, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Share link revoked successfully"))
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/json"
+	"gallery/core/database"
+	"gallery/core/logic"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const apiTokenPrefix = "gal_"
+const tokenContextKey contextKey = "apiToken"
+
+// getBearerToken resolves an Authorization: Bearer header to its API token and enabled owner.
+func getBearerToken(r *http.Request) (types.ApiToken, types.User, bool) {
+	header := r.Header.Get("Authorization")
+	value, found := strings.CutPrefix(header, "Bearer ")
+	if !found || !strings.HasPrefix(value, apiTokenPrefix) {
+		return types.ApiToken{}, types.User{}, false
+	}
+
+	token, err := database.GetApiTokenByHash(r.Context(), hashToken(value))
+	if err != nil {
+		return types.ApiToken{}, types.User{}, false
+	}
+
+	user, err := database.GetUser(r.Context(), token.Username)
+	if err != nil || user.Disabled {
+		return types.ApiToken{}, types.User{}, false
+	}
+
+	if token.LastUsed == nil || time.Since(*token.LastUsed) > lastSeenResolution {
+		_ = database.UpdateApiTokenLastUsed(r.Context(), token.ID)
+	}
+	return token, user, true
+}
+
+// GetApiToken returns the API token used to authenticate the request, if any.
+func GetApiToken(r *http.Request) (types.ApiToken, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(types.ApiToken)
+	return token, ok
+}
+
+// HasScope reports whether a token's scopes grant requiredScope. The admin scope
+// grants everything and every token may read.
+func HasScope(scopes []string, requiredScope string) bool {
+	if requiredScope == types.ScopeRead {
+		return true
+	}
+	return slices.Contains(scopes, requiredScope) || slices.Contains(scopes, types.ScopeAdmin)
+}
+
+func HandleGetApiTokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+
+	tokens, err := database.GetAllApiTokens(r.Context())
+	if err != nil {
+		net.Error(w, "Failed to retrieve tokens", http.StatusInternalServerError)
+		return
+	}
+
+	visible := []types.ApiToken{}
+	for _, token := range tokens {
+		if user.Role == types.RoleAdmin || token.Username == user.Username {
+			visible = append(visible, token)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(visible); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandlePostApiToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+
+	var newToken types.NewApiToken
+	if err := json.NewDecoder(r.Body).Decode(&newToken); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	newToken.Name = strings.TrimSpace(newToken.Name)
+	if newToken.Name == "" {
+		net.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if len(newToken.Scopes) == 0 {
+		net.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range newToken.Scopes {
+		requiredRole, ok := types.ScopeRoles[scope]
+		if !ok {
+			net.Error(w, "Scope must be one of read, upload, edit or admin", http.StatusBadRequest)
+			return
+		}
+		if !HasRole(user.Role, requiredRole) {
+			net.Error(w, "Your role does not allow the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+	}
+	newToken.Scopes = logic.StringArraySortUnique(newToken.Scopes)
+
+	value := apiTokenPrefix + generateToken()
+	token, err := database.InsertApiTokenRow(r.Context(), hashToken(value), user.Username, newToken)
+	if err != nil {
+		net.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	Audit(r, "token.create", token.ID, "", nil, token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(types.CreatedApiToken{ApiToken: token, Token: value}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode created token", "error", err)
+	}
+}
+
+func HandleDeleteApiToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+	id := r.PathValue("id")
+
+	token, err := database.GetApiToken(r.Context(), id)
+	if err != nil || (user.Role != types.RoleAdmin && token.Username != user.Username) {
+		net.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	if err := database.DeleteApiTokenRow(r.Context(), id); err != nil {
+		net.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API token revoked", "token", id, "user", token.Username, "by", user.Username)
+	Audit(r, "token.delete", id, "", token, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Token revoked successfully"))
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const totpIssuer = "Gallery"
+const totpPeriod = 30
+const totpDigits = 6
+
+// totpSkew is how many time steps either side of now are accepted, to allow for clock drift.
+const totpSkew = 1
+const recoveryCodeCount = 10
+const pendingLoginLifetime = 5 * time.Minute
+const pendingLoginMaxAttempts = 5
+
+type pendingLogin struct {
+	username string
+	expires  time.Time
+	attempts int
+}
+
+var pendingLogins = make(map[string]*pendingLogin)
+var pendingLoginsMutex sync.Mutex
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return base32NoPadding.EncodeToString(b)
+}
+
+// totpCode computes the RFC 6238 code for a base32 secret at a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// validateTotp returns the matching time step for code, or false if no step within the skew matches.
+func validateTotp(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpUri(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code.
+func verifySecondFactor(ctx context.Context, user types.User, code string) bool {
+	if step, ok := validateTotp(user.TotpSecret, code, time.Now()); ok {
+		accepted, err := database.UpdateUserTotpLastStep(ctx, user.Username, step)
+		return err == nil && accepted
+	}
+
+	recoveryCode := strings.ToLower(strings.TrimSpace(code))
+	used, err := database.UseRecoveryCode(ctx, user.Username, hashToken(recoveryCode))
+	if err == nil && used {
+		slog.InfoContext(ctx, "Recovery code used", "user", user.Username)
+		return true
+	}
+	return false
+}
+
+// beginPendingLogin holds a password-verified login until its second factor is checked.
+func beginPendingLogin(username string) string {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+
+	now := time.Now()
+	for token, pending := range pendingLogins {
+		if now.After(pending.expires) {
+			delete(pendingLogins, token)
+		}
+	}
+
+	token := generateToken()
+	pendingLogins[hashToken(token)] = &pendingLogin{username: username, expires: now.Add(pendingLoginLifetime)}
+	return token
+}
+
+// takePendingLoginAttempt returns the username for a pending login token, counting the attempt.
+func takePendingLoginAttempt(token string) (string, bool) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+
+	key := hashToken(token)
+	pending, ok := pendingLogins[key]
+	if !ok || time.Now().After(pending.expires) || pending.attempts >= pendingLoginMaxAttempts {
+		delete(pendingLogins, key)
+		return "", false
+	}
+	pending.attempts++
+	return pending.username, true
+}
+
+func endPendingLogin(token string) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	delete(pendingLogins, hashToken(token))
+}
+
+// LoginTotpHandler completes a login for a user with two-factor authentication enabled.
+func LoginTotpHandler(w http.ResponseWriter, r *http.Request) {
+	loginToken := r.FormValue("loginToken")
+	code := r.FormValue("code")
+	ip := net.ClientIP(r)
+
+	username, ok := takePendingLoginAttempt(loginToken)
+	if !ok {
+		net.Error(w, "Login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	if wait := loginRetryAfter(ip, username); wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	user, err := database.GetUser(r.Context(), username)
+	if err != nil || user.Disabled || !user.TotpEnabled || !verifySecondFactor(r.Context(), user, code) {
+		recordLoginFailure(r.Context(), ip, username)
+		slog.WarnContext(r.Context(), "Two-factor code rejected", "user", username)
+		net.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := createSession(w, r, user.Username); err != nil {
+		net.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	endPendingLogin(loginToken)
+	recordLoginSuccess(ip, username)
+	slog.InfoContext(r.Context(), "Login successful", "user", username, "ip", ip)
+	_, _ = w.Write([]byte("Login successful"))
+}
+
+func HandlePostTotpEnroll(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+	if user.TotpEnabled {
+		net.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret := generateTotpSecret()
+	if err := database.UpdateUserTotp(r.Context(), user.Username, secret, false, 0); err != nil {
+		net.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	type Enrollment struct {
+		Secret string `json:"secret"`
+		Uri    string `json:"otpauthUri"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Enrollment{Secret: secret, Uri: totpUri(user.Username, secret)}); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandlePostTotpConfirm(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+
+	type Confirmation struct {
+		Code string `json:"code"`
+	}
+	var confirmation Confirmation
+	if err := json.NewDecoder(r.Body).Decode(&confirmation); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if user.TotpEnabled || user.TotpSecret == "" {
+		net.Error(w, "No two-factor enrollment in progress", http.StatusConflict)
+		return
+	}
+
+	step, ok := validateTotp(user.TotpSecret, confirmation.Code, time.Now())
+	if !ok {
+		net.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	if err := database.ReplaceRecoveryCodes(r.Context(), user.Username, hashes); err != nil {
+		net.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := database.UpdateUserTotp(r.Context(), user.Username, user.TotpSecret, true, step); err != nil {
+		net.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Two-factor authentication enabled", "user", user.Username)
+	Audit(r, "totp.enable", user.Username, "", nil, nil)
+
+	type RecoveryCodes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes}); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandleDeleteTotp(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetUser(r)
+
+	type Confirmation struct {
+		Code string `json:"code"`
+	}
+	var confirmation Confirmation
+	if err := json.NewDecoder(r.Body).Decode(&confirmation); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if !user.TotpEnabled {
+		net.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	// codes are limited as they are when logging in, so a stolen session cannot guess its way to turning 2FA off
+	ip := net.ClientIP(r)
+	if wait := loginRetryAfter(ip, user.Username); wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+	if !verifySecondFactor(r.Context(), user, confirmation.Code) {
+		recordLoginFailure(r.Context(), ip, user.Username)
+		slog.WarnContext(r.Context(), "Two-factor code rejected", "user", user.Username)
+		net.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	recordLoginSuccess(ip, user.Username)
+
+	if err := database.UpdateUserTotp(r.Context(), user.Username, "", false, 0); err != nil {
+		net.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	_ = database.ReplaceRecoveryCodes(r.Context(), user.Username, nil)
+	slog.InfoContext(r.Context(), "Two-factor authentication disabled", "user", user.Username)
+	Audit(r, "totp.disable", user.Username, "", nil, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Two-factor authentication disabled"))
+}
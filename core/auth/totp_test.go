@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteTotpIsRateLimited(t *testing.T) {
+	config.DatabaseDirectory = t.TempDir()
+	if database.Initialise() == nil {
+		t.Fatal("failed to initialise database")
+	}
+	t.Cleanup(database.Close)
+	setupLoginAttempts(t)
+
+	secret := generateTotpSecret()
+	if err := database.InsertUserRow(t.Context(), types.NewUser{Username: "alice", Password: "hash", Role: types.RoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateUserTotp(t.Context(), "alice", secret, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	user, err := database.GetUser(t.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteTotp := func(code string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodDelete, "/api/totp", strings.NewReader(`{"code": "`+code+`"}`))
+		request = request.WithContext(context.WithValue(request.Context(), userContextKey, user))
+		recorder := httptest.NewRecorder()
+		HandleDeleteTotp(recorder, request)
+		return recorder
+	}
+
+	for range config.LoginMaxAttempts {
+		if recorder := deleteTotp("guess"); recorder.Code != http.StatusBadRequest {
+			t.Fatalf("wrong code returned %d: %s", recorder.Code, recorder.Body)
+		}
+	}
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := deleteTotp(code)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("code after %d wrong ones returned %d: %s", config.LoginMaxAttempts, recorder.Code, recorder.Body)
+	}
+	if user, _ := database.GetUser(t.Context(), "alice"); !user.TotpEnabled {
+		t.Error("disabled two-factor authentication while locked out")
+	}
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+func HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := database.GetAllUsers(r.Context())
+	if err != nil {
+		net.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandlePostUser(w http.ResponseWriter, r *http.Request) {
+	var newUser types.NewUser
+	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	newUser.Username = strings.TrimSpace(newUser.Username)
+	if newUser.Username == "" || newUser.Password == "" {
+		net.Error(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := types.RoleRanks[newUser.Role]; !ok {
+		net.Error(w, "Role must be one of admin, editor, viewer or uploader", http.StatusBadRequest)
+		return
+	}
+	if newUser.Role == types.RoleUploader {
+		if _, err := database.GetAlbum(r.Context(), newUser.UploadAlbum); err != nil {
+			net.Error(w, "Uploaders need an existing uploadAlbum", http.StatusBadRequest)
+			return
+		}
+	} else {
+		newUser.UploadAlbum = ""
+	}
+	if _, err := database.GetUser(r.Context(), newUser.Username); err == nil {
+		net.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+
+	hash, err := HashPassword(newUser.Password)
+	if err != nil {
+		net.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	newUser.Password = hash
+
+	if err := database.InsertUserRow(r.Context(), newUser); err != nil {
+		net.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, "user.create", newUser.Username, newUser.UploadAlbum, nil, map[string]string{"role": newUser.Role})
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte("User created successfully"))
+}
+
+func HandlePatchUserDisabled(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	type DisabledUpdate struct {
+		Disabled bool `json:"disabled"`
+	}
+	var update DisabledUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	user, err := database.GetUser(r.Context(), username)
+	if err != nil {
+		net.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if update.Disabled && isLastEnabledAdmin(r.Context(), user) {
+		net.Error(w, "Cannot disable the last admin", http.StatusConflict)
+		return
+	}
+
+	if err := database.UpdateUserDisabled(r.Context(), username, update.Disabled); err != nil {
+		net.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	if update.Disabled {
+		_ = database.DeleteSessionsForUser(r.Context(), username)
+	}
+	Audit(r, "user.update", username, "", map[string]bool{"disabled": user.Disabled}, map[string]bool{"disabled": update.Disabled})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("User updated successfully"))
+}
+
+func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	user, err := database.GetUser(r.Context(), username)
+	if err != nil {
+		net.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if isLastEnabledAdmin(r.Context(), user) {
+		net.Error(w, "Cannot delete the last admin", http.StatusConflict)
+		return
+	}
+
+	if err := database.DeleteUserRow(r.Context(), username); err != nil {
+		net.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	_ = database.DeleteSessionsForUser(r.Context(), username)
+	_ = database.DeleteApiTokensForUser(r.Context(), username)
+	_ = database.ReplaceRecoveryCodes(r.Context(), username, nil)
+	Audit(r, "user.delete", username, "", user, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("User deleted successfully"))
+}
+
+// HandleDeleteUserTotp lets an admin reset two-factor authentication for a user who has lost their device.
+func HandleDeleteUserTotp(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	if _, err := database.GetUser(r.Context(), username); err != nil {
+		net.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := database.UpdateUserTotp(r.Context(), username, "", false, 0); err != nil {
+		net.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	_ = database.ReplaceRecoveryCodes(r.Context(), username, nil)
+	slog.InfoContext(r.Context(), "Two-factor authentication reset", "user", username)
+	Audit(r, "user.totp.reset", username, "", nil, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Two-factor authentication reset"))
+}
+
+// HandlePutUserOidc links a user to an identity provider account, so that signing in with it
+// signs in as the user. The subject is logged when an unlinked account is refused, and the
+// issuer defaults to OIDC_ISSUER.
+func HandlePutUserOidc(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	type OidcLink struct {
+		Issuer  string `json:"issuer"`
+		Subject string `json:"subject"`
+	}
+	var link OidcLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if link.Subject == "" {
+		net.Error(w, "subject is required", http.StatusBadRequest)
+		return
+	}
+	if link.Issuer == "" {
+		link.Issuer = config.OidcIssuer
+	}
+
+	user, err := database.GetUser(r.Context(), username)
+	if err != nil {
+		net.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := database.UpdateUserOidcSubject(r.Context(), username, link.Issuer, link.Subject); err != nil {
+		if database.IsDuplicate(err) {
+			net.Error(w, "That identity is already linked to another user", http.StatusConflict)
+			return
+		}
+		net.Error(w, "Failed to link user", http.StatusInternalServerError)
+		return
+	}
+	_ = database.DeleteSessionsForUser(r.Context(), username)
+	Audit(r, "user.oidc.link", username, "", map[string]string{"issuer": user.OidcIssuer, "subject": user.OidcSubject}, link)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("User linked successfully"))
+}
+
+// HandleDeleteUserOidc unlinks a user from their identity provider account.
+func HandleDeleteUserOidc(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	user, err := database.GetUser(r.Context(), username)
+	if err != nil {
+		net.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := database.UpdateUserOidcSubject(r.Context(), username, "", ""); err != nil {
+		net.Error(w, "Failed to unlink user", http.StatusInternalServerError)
+		return
+	}
+	_ = database.DeleteSessionsForUser(r.Context(), username)
+	Audit(r, "user.oidc.unlink", username, "", map[string]string{"issuer": user.OidcIssuer, "subject": user.OidcSubject}, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("User unlinked successfully"))
+}
+
+func isLastEnabledAdmin(ctx context.Context, user types.User) bool {
+	if user.Role != types.RoleAdmin || user.Disabled {
+		return false
+	}
+	count, err := database.CountEnabledAdmins(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count admins", "error", err)
+		return true
+	}
+	return count <= 1
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const redacted = "********"
+
+// CheckCommand implements `gallery config check`, validating the configuration and
+// printing the effective settings with passwords and secrets redacted.
+func CheckCommand(stdout io.Writer) error {
+	if err := LoadEnv(); err != nil {
+		return err
+	}
+
+	settings := [][2]string{
+		{"CONFIG_FILE", ConfigFile},
+		{"ADMIN_USER", AdminUser},
+		{"ADMIN_PASSWORD", secret(AdminPassword)},
+		{"ADMIN_PASSWORD_HASH", secret(AdminPasswordHash)},
+		{"DATA_PATH", DatabaseDirectory},
+		{"IMAGE_PATH", ImageDirectory},
+		{"IMAGE_EXTENSIONS", strings.Join(ImageExtensions, ",")},
+		{"THUMBNAIL_MAX_PIXELS", strconv.Itoa(ThumbnailMaxPixels)},
+		{"OPTIMISED_MAX_PIXELS", strconv.Itoa(OptimisedMaxPixels)},
+		{"SESSION_IDLE_TIMEOUT", SessionIdleTimeout.String()},
+		{"SESSION_MAX_AGE", SessionMaxAge.String()},
+		{"TRUSTED_PROXIES", joinNetworks(TrustedProxies)},
+		{"LOGIN_MAX_ATTEMPTS", strconv.Itoa(LoginMaxAttempts)},
+		{"LOGIN_LOCKOUT_DURATION", LoginLockoutDuration.String()},
+		{"LOGIN_MAX_LOCKOUT_DURATION", LoginMaxLockoutDuration.String()},
+		{"OIDC_ISSUER", OidcIssuer},
+		{"OIDC_CLIENT_ID", OidcClientID},
+		{"OIDC_CLIENT_SECRET", secret(OidcClientSecret)},
+		{"OIDC_REDIRECT_URL", OidcRedirectURL},
+		{"OIDC_SCOPES", strings.Join(OidcScopes, ",")},
+		{"OIDC_USERNAME_CLAIM", OidcUsernameClaim},
+		{"OIDC_GROUPS_CLAIM", OidcGroupsClaim},
+		{"OIDC_ADMIN_GROUPS", strings.Join(OidcAdminGroups, ",")},
+		{"OIDC_EDITOR_GROUPS", strings.Join(OidcEditorGroups, ",")},
+		{"OIDC_VIEWER_GROUPS", strings.Join(OidcViewerGroups, ",")},
+		{"OIDC_DEFAULT_ROLE", OidcDefaultRole},
+		{"PROXY_AUTH_HEADER", ProxyAuthHeader},
+		{"PROXY_AUTH_CIDRS", joinNetworks(ProxyAuthCIDRs)},
+		{"PROXY_AUTH_DEFAULT_ROLE", ProxyAuthDefaultRole},
+		{"LISTEN_ADDRESS", ListenAddress},
+		{"BASE_PATH", BasePath},
+		{"TLS_CERT_FILE", TlsCertFile},
+		{"TLS_KEY_FILE", TlsKeyFile},
+		{"CORS_ALLOWED_ORIGINS", strings.Join(CorsAllowedOrigins, ",")},
+		{"LOG_LEVEL", strings.ToLower(LogLevel.String())},
+		{"LOG_FORMAT", LogFormat},
+	}
+	for _, setting := range settings {
+		if _, err := fmt.Fprintf(stdout, "%s=%s\n", setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func secret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+func joinNetworks(networks []*net.IPNet) string {
+	items := make([]string, 0, len(networks))
+	for _, network := range networks {
+		items = append(items, network.String())
+	}
+	return strings.Join(items, ",")
+}
@@ -1,11 +1,16 @@
 package config
 
 import (
-	"log"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,58 +25,290 @@ var ThumbnailMaxPixels int
 var OptimisedMaxPixels int
 var AdminUser string
 var AdminPassword string
+var AdminPasswordHash string
+var SessionIdleTimeout time.Duration
+var SessionMaxAge time.Duration
+var TrustedProxies []*net.IPNet
+var LoginMaxAttempts int
+var LoginLockoutDuration time.Duration
+var LoginMaxLockoutDuration time.Duration
+var OidcIssuer string
+var OidcClientID string
+var OidcClientSecret string
+var OidcRedirectURL string
+var OidcScopes []string
+var OidcUsernameClaim string
+var OidcGroupsClaim string
+var OidcAdminGroups []string
+var OidcEditorGroups []string
+var OidcViewerGroups []string
+var OidcDefaultRole string
+var ProxyAuthHeader string
+var ProxyAuthCIDRs []*net.IPNet
+var ProxyAuthDefaultRole string
+var CorsAllowedOrigins []string
+var ConfigFile string
+var ListenAddress string
+var BasePath string
+var TlsCertFile string
+var TlsKeyFile string
+var LogLevel slog.Level
+var LogFormat string
 
-func LoadEnv() {
+// LoadEnv reads the settings from environment variables, which override the optional
+// YAML or TOML file named by CONFIG_FILE, and returns every setting that is invalid.
+func LoadEnv() error {
 	err := godotenv.Load(".env")
 	if err != nil {
-		log.Printf("Error loading .env file, using environment variables")
+		slog.Info("Error loading .env file, using environment variables")
 	}
 
-	username := os.Getenv("ADMIN_USER")
-	if username == "" {
-		username = "admin"
+	ConfigFile = os.Getenv("CONFIG_FILE")
+	fileValues, err := readConfigFile(ConfigFile)
+	if err != nil {
+		return err
 	}
-	AdminUser = username
+	settings := newLoader(fileValues)
 
-	password := os.Getenv("ADMIN_PASSWORD")
-	if password == "" {
-		password = "admin"
-	}
-	AdminPassword = password
+	AdminUser = settings.string("ADMIN_USER", "admin")
+	AdminPassword = settings.string("ADMIN_PASSWORD", "admin")
+	AdminPasswordHash = settings.string("ADMIN_PASSWORD_HASH", "")
 
-	dataPath := os.Getenv("DATA_PATH")
-	if dataPath == "" {
-		dataPath = "./data"
-	}
-
-	ImagePath = os.Getenv("IMAGE_PATH")
-	if ImagePath == "" {
-		ImagePath = "./images"
-	}
+	dataPath := settings.string("DATA_PATH", "./data")
+	ImagePath = settings.string("IMAGE_PATH", "./images")
 
 	DatabaseDirectory, _ = filepath.Abs(dataPath)
 	ImageDirectory, _ = filepath.Abs(ImagePath)
 	ThumbnailDirectory, _ = filepath.Abs(filepath.Join(dataPath, "thumbnails"))
 	OptimisedDirectory, _ = filepath.Abs(filepath.Join(dataPath, "optimised"))
+	if err := checkWritableDir(DatabaseDirectory); err != nil {
+		settings.fail("DATA_PATH", "%s", err)
+	}
+	if err := checkReadableDir(ImageDirectory); err != nil {
+		settings.fail("IMAGE_PATH", "%s", err)
+	}
 
-	imageExtensions := os.Getenv("IMAGE_EXTENSIONS")
-	if imageExtensions == "" {
+	ImageExtensions = settings.list("IMAGE_EXTENSIONS")
+	if len(ImageExtensions) == 0 {
 		ImageExtensions = []string{".avif", ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".webp"}
-	} else {
-		ImageExtensions = strings.Split(imageExtensions, ",")
+	}
+	for _, extension := range ImageExtensions {
+		if len(extension) < 2 || !strings.HasPrefix(extension, ".") {
+			settings.fail("IMAGE_EXTENSIONS", "%q must start with a dot, such as .jpg", extension)
+		}
+	}
+
+	ThumbnailMaxPixels = settings.positiveInt("THUMBNAIL_MAX_PIXELS", 500)
+	OptimisedMaxPixels = settings.positiveInt("OPTIMISED_MAX_PIXELS", 1280)
+
+	SessionIdleTimeout = settings.duration("SESSION_IDLE_TIMEOUT", 72*time.Hour)
+	SessionMaxAge = settings.duration("SESSION_MAX_AGE", 7*24*time.Hour)
+
+	TrustedProxies = settings.networks("TRUSTED_PROXIES")
+
+	LoginMaxAttempts = settings.positiveInt("LOGIN_MAX_ATTEMPTS", 5)
+	LoginLockoutDuration = settings.duration("LOGIN_LOCKOUT_DURATION", time.Minute)
+	LoginMaxLockoutDuration = settings.duration("LOGIN_MAX_LOCKOUT_DURATION", max(time.Hour, LoginLockoutDuration))
+	if LoginMaxLockoutDuration < LoginLockoutDuration {
+		settings.fail("LOGIN_MAX_LOCKOUT_DURATION", "must not be shorter than LOGIN_LOCKOUT_DURATION (%s)", LoginLockoutDuration)
+	}
+
+	OidcIssuer = settings.string("OIDC_ISSUER", "")
+	OidcClientID = settings.string("OIDC_CLIENT_ID", "")
+	OidcClientSecret = settings.string("OIDC_CLIENT_SECRET", "")
+	OidcRedirectURL = settings.string("OIDC_REDIRECT_URL", "")
+	if !OidcEnabled() && (OidcIssuer != "" || OidcClientID != "" || OidcRedirectURL != "") {
+		settings.fail("OIDC_ISSUER", "OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_REDIRECT_URL must all be set to enable single sign-on")
+	}
+	if OidcRedirectURL != "" && !isAbsoluteURL(OidcRedirectURL) {
+		settings.fail("OIDC_REDIRECT_URL", "%q is not an absolute URL", OidcRedirectURL)
+	}
+
+	OidcScopes = settings.list("OIDC_SCOPES")
+	if len(OidcScopes) == 0 {
+		OidcScopes = []string{"openid", "profile", "email", "groups"}
+	}
+
+	OidcUsernameClaim = settings.string("OIDC_USERNAME_CLAIM", "preferred_username")
+	OidcGroupsClaim = settings.string("OIDC_GROUPS_CLAIM", "groups")
+
+	OidcAdminGroups = settings.list("OIDC_ADMIN_GROUPS")
+	OidcEditorGroups = settings.list("OIDC_EDITOR_GROUPS")
+	OidcViewerGroups = settings.list("OIDC_VIEWER_GROUPS")
+	OidcDefaultRole = settings.string("OIDC_DEFAULT_ROLE", "")
+	if !isDefaultRole(OidcDefaultRole) {
+		settings.fail("OIDC_DEFAULT_ROLE", "%q must be admin, editor, viewer or empty", OidcDefaultRole)
+	}
+
+	ProxyAuthHeader = settings.string("PROXY_AUTH_HEADER", "")
+	ProxyAuthCIDRs = settings.networks("PROXY_AUTH_CIDRS")
+	ProxyAuthDefaultRole = settings.string("PROXY_AUTH_DEFAULT_ROLE", "")
+	if ProxyAuthHeader != "" && len(ProxyAuthCIDRs) == 0 {
+		settings.fail("PROXY_AUTH_CIDRS", "must be set when PROXY_AUTH_HEADER is, so only the proxy can send the header")
+	}
+	if !isDefaultRole(ProxyAuthDefaultRole) {
+		settings.fail("PROXY_AUTH_DEFAULT_ROLE", "%q must be admin, editor, viewer or empty", ProxyAuthDefaultRole)
+	}
+
+	ListenAddress = settings.string("LISTEN_ADDRESS", ":8080")
+	if socket, ok := strings.CutPrefix(ListenAddress, "unix:"); ok {
+		if socket == "" {
+			settings.fail("LISTEN_ADDRESS", "unix: must be followed by a socket path")
+		} else if err := checkWritableDir(filepath.Dir(socket)); err != nil {
+			settings.fail("LISTEN_ADDRESS", "%s", err)
+		}
+	} else if _, _, err := net.SplitHostPort(ListenAddress); err != nil {
+		settings.fail("LISTEN_ADDRESS", "%q is not a host:port address or unix:/path/to/socket", ListenAddress)
+	}
+
+	BasePath = strings.TrimRight(settings.string("BASE_PATH", ""), "/")
+	if BasePath != "" && (!strings.HasPrefix(BasePath, "/") || strings.ContainsAny(BasePath, "?#") || path.Clean(BasePath) != BasePath) {
+		settings.fail("BASE_PATH", "%q must be a path such as /photos", BasePath)
+	}
+
+	TlsCertFile = settings.string("TLS_CERT_FILE", "")
+	TlsKeyFile = settings.string("TLS_KEY_FILE", "")
+	if (TlsCertFile == "") != (TlsKeyFile == "") {
+		settings.fail("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	} else if TlsEnabled() {
+		if _, err := tls.LoadX509KeyPair(TlsCertFile, TlsKeyFile); err != nil {
+			settings.fail("TLS_CERT_FILE", "failed to load certificate: %s", err)
+		}
+	}
+
+	CorsAllowedOrigins = []string{}
+	for _, origin := range settings.list("CORS_ALLOWED_ORIGINS") {
+		origin = strings.TrimRight(origin, "/")
+		if !isOrigin(origin) {
+			settings.fail("CORS_ALLOWED_ORIGINS", "%q is not an origin such as https://photos.example.com", origin)
+		}
+		CorsAllowedOrigins = append(CorsAllowedOrigins, origin)
+	}
+
+	if err := LogLevel.UnmarshalText([]byte(settings.string("LOG_LEVEL", "info"))); err != nil {
+		settings.fail("LOG_LEVEL", "must be debug, info, warn or error")
+	}
+	LogFormat = strings.ToLower(settings.string("LOG_FORMAT", "text"))
+	if LogFormat != "text" && LogFormat != "json" {
+		settings.fail("LOG_FORMAT", "%q must be text or json", LogFormat)
 	}
 
-	thumbnailMaxPixels, err := strconv.Atoi(os.Getenv("THUMBNAIL_MAX_PIXELS"))
-	if err == nil && thumbnailMaxPixels > 0 {
-		ThumbnailMaxPixels = thumbnailMaxPixels
-	} else {
-		ThumbnailMaxPixels = 500
+	return settings.err()
+}
+
+// TlsEnabled reports whether the server should serve HTTPS itself.
+func TlsEnabled() bool {
+	return TlsCertFile != "" && TlsKeyFile != ""
+}
+
+// URLPath prefixes an absolute path on this server with BASE_PATH.
+func URLPath(p string) string {
+	return BasePath + p
+}
+
+// ProxyAuthEnabled reports whether a reverse proxy header is trusted to identify users.
+func ProxyAuthEnabled() bool {
+	return ProxyAuthHeader != "" && len(ProxyAuthCIDRs) > 0
+}
+
+// CrossOriginEnabled reports whether browsers on other origins may call the API with credentials.
+func CrossOriginEnabled() bool {
+	return len(CorsAllowedOrigins) > 0
+}
+
+// OidcEnabled reports whether single sign-on has been configured.
+func OidcEnabled() bool {
+	return OidcIssuer != "" && OidcClientID != "" && OidcRedirectURL != ""
+}
+
+// splitList splits a comma separated value, dropping blank entries.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
+
+// parseCIDROrIP accepts either a CIDR range or a single IP address.
+func parseCIDROrIP(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: value}
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+func isDefaultRole(role string) bool {
+	return role == "" || role == "admin" || role == "editor" || role == "viewer"
+}
 
-	optimisedMaxPixels, err := strconv.Atoi(os.Getenv("OPTIMISED_MAX_PIXELS"))
-	if err == nil && optimisedMaxPixels > 0 {
-		OptimisedMaxPixels = optimisedMaxPixels
-	} else {
-		OptimisedMaxPixels = 1280
+func isAbsoluteURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && parsed.Scheme != "" && parsed.Host != ""
+}
+
+// isOrigin reports whether value is a scheme and host with no path, as browsers send in the Origin header.
+func isOrigin(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && parsed.Scheme != "" && parsed.Host != "" && parsed.Path == "" && parsed.RawQuery == ""
+}
+
+// checkWritableDir checks that the gallery can write to path, or create it if it does not exist yet.
+func checkWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return err
+		}
+		if err := checkWritableDir(parent); err != nil {
+			return fmt.Errorf("%s cannot be created, %w", path, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	file, err := os.CreateTemp(path, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", path)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkReadableDir checks that the gallery can read path. A path that does not exist yet
+// only has to be one the gallery can create, as the image directory is created on startup.
+func checkReadableDir(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return checkWritableDir(path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s cannot be read", path)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s cannot be read", path)
 	}
+	return dir.Close()
 }
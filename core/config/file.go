@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads the YAML or TOML file named by CONFIG_FILE. Keys are the
+// environment variable names, in any case and with dashes or underscores, and
+// lists are read the same way as comma separated environment variables.
+func readConfigFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+
+	raw := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &raw)
+	case ".toml":
+		err = toml.Unmarshal(contents, &raw)
+	default:
+		return nil, fmt.Errorf("CONFIG_FILE: %s is not a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: failed to parse %s: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		value, ok := fileValue(raw[key])
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: must be a value or a list of values", key))
+			continue
+		}
+		values[name] = value
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("CONFIG_FILE: %s", strings.Join(problems, "; "))
+	}
+	return values, nil
+}
+
+func fileValue(value any) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", true
+	case map[string]any:
+		return "", false
+	case []any:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			text, ok := fileValue(item)
+			if !ok {
+				return "", false
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), true
+	default:
+		return fmt.Sprint(value), true
+	}
+}
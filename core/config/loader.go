@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// loader reads settings from the environment, then the config file, and collects
+// every invalid value so they can all be reported at once.
+type loader struct {
+	file   map[string]string
+	used   map[string]bool
+	errors []error
+}
+
+func newLoader(file map[string]string) *loader {
+	return &loader{file: file, used: map[string]bool{}}
+}
+
+// lookup returns the value of a setting, preferring the environment over the config file.
+// A variable that is set but empty still overrides the file, resetting the setting to its default.
+func (l *loader) lookup(name string) string {
+	l.used[name] = true
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return l.file[name]
+}
+
+func (l *loader) fail(name string, format string, args ...any) {
+	l.errors = append(l.errors, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (l *loader) string(name string, fallback string) string {
+	if value := l.lookup(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (l *loader) positiveInt(name string, fallback int) int {
+	value := l.lookup(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		l.fail(name, "%q is not a positive whole number", value)
+		return fallback
+	}
+	return number
+}
+
+func (l *loader) duration(name string, fallback time.Duration) time.Duration {
+	value := l.lookup(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		l.fail(name, "%q is not a positive duration such as 30m or 72h", value)
+		return fallback
+	}
+	return duration
+}
+
+func (l *loader) list(name string) []string {
+	return splitList(l.lookup(name))
+}
+
+// networks reads a comma separated list of CIDR ranges or IP addresses.
+func (l *loader) networks(name string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, entry := range l.list(name) {
+		ipNet, err := parseCIDROrIP(entry)
+		if err != nil {
+			l.fail(name, "%q is not an IP address or CIDR range", entry)
+			continue
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks
+}
+
+// err reports every invalid setting, along with config file keys that are not settings at all.
+func (l *loader) err() error {
+	unknown := []string{}
+	for name := range l.file {
+		if !l.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		l.fail(name, "unknown setting in CONFIG_FILE")
+	}
+	return errors.Join(l.errors...)
+}
@@ -1,11 +1,34 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 )
 
+// notAlbumLocked is a condition leaving out images, given by their slug column, that are only in
+// password protected albums, unless one of those albums is in the JSON array of unlocked albums
+// passed as its parameter.
+const notAlbumLocked = `(NOT EXISTS (SELECT 1 FROM album_links JOIN albums ON albums.slug = album_links.albumSlug
+		WHERE album_links.imageSlug = %[1]s)
+	OR EXISTS (SELECT 1 FROM album_links JOIN albums ON albums.slug = album_links.albumSlug
+		WHERE album_links.imageSlug = %[1]s AND (albums.passwordHash = '' OR albums.slug IN (SELECT value FROM json_each(?)))))`
+
+// unlockedAlbumsParameter encodes the unlocked album slugs as the parameter of notAlbumLocked.
+func unlockedAlbumsParameter(unlockedAlbums []string) string {
+	if len(unlockedAlbums) == 0 {
+		return "[]"
+	}
+	list, err := json.Marshal(unlockedAlbums)
+	if err != nil {
+		return "[]"
+	}
+	return string(list)
+}
+
 func createAlbumLinksTable(db *sql.DB) {
 	query := `CREATE TABLE IF NOT EXISTS album_links (
     albumSlug TEXT,
@@ -21,27 +44,30 @@ func createAlbumLinksTable(db *sql.DB) {
 	checkError := db.QueryRow(checkQuery).Scan(&name)
 
 	if checkError == nil {
-		log.Println("album_links table already exists")
+		slog.Debug("album_links table already exists")
 	} else {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Printf("Error creating album_links table: %s", err)
+			slog.Error("Error creating album_links table", "error", err)
 		} else {
-			log.Println("album_links table created")
+			slog.Info("album_links table created")
 		}
 	}
 }
 
-func GetAlbumLinks(slug string) ([]string, error) {
-	var links []string
+// GetAlbumLinks lists the images in an album, leaving out private images unless includePrivate
+// is set, and uploads waiting for moderation unless includePending is.
+func GetAlbumLinks(ctx context.Context, slug string, includePrivate bool, includePending bool) ([]string, error) {
+	links := []string{}
 	query := `SELECT album_links.imageSlug
 		FROM album_links
 		JOIN metadata ON album_links.imageSlug = metadata.slug
-		WHERE album_links.albumSlug = ?
+		WHERE album_links.albumSlug = ? AND (? OR metadata.visibility != 'private')
+			AND (? OR ` + fmt.Sprintf(notPending, "metadata.slug") + `)
 		ORDER BY metadata.dateTaken DESC;`
-	rows, err := Database.Query(query, slug)
+	rows, err := Database.Query(query, slug, includePrivate, includePending)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 		return []string{}, err
 	}
 	defer rows.Close()
@@ -50,19 +76,23 @@ func GetAlbumLinks(slug string) ([]string, error) {
 		var imageSlug string
 		err = rows.Scan(&imageSlug)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 		links = append(links, imageSlug)
 	}
 	return links, nil
 }
 
-func GetImageLinks(slug string) ([]string, error) {
-	var links []string
-	query := `SELECT albumSlug FROM album_links where imageSlug = ?;`
-	rows, err := Database.Query(query, slug)
+// GetImageLinks lists the albums an image is in, leaving out private albums unless includePrivate is set.
+func GetImageLinks(ctx context.Context, slug string, includePrivate bool) ([]string, error) {
+	links := []string{}
+	query := `SELECT album_links.albumSlug
+		FROM album_links
+		JOIN albums ON album_links.albumSlug = albums.slug
+		WHERE album_links.imageSlug = ? AND (? OR albums.visibility != 'private');`
+	rows, err := Database.Query(query, slug, includePrivate)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 		return []string{}, err
 	}
 	defer rows.Close()
@@ -71,7 +101,7 @@ func GetImageLinks(slug string) ([]string, error) {
 		var albumSlug string
 		err = rows.Scan(&albumSlug)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 
 		links = append(links, albumSlug)
@@ -79,7 +109,34 @@ func GetImageLinks(slug string) ([]string, error) {
 	return links, nil
 }
 
-func InsertAlbumLinkRow(link types.Link) error {
+// GetAlbumsForImage returns every album an image is in, including private and password protected albums.
+func GetAlbumsForImage(ctx context.Context, slug string) ([]types.Album, error) {
+	albums := []types.Album{}
+	query := `SELECT albums.slug, albums.name, albums.dateCreated, albums.coverSlug, albums.visibility, albums.passwordHash
+		FROM album_links
+		JOIN albums ON album_links.albumSlug = albums.slug
+		WHERE album_links.imageSlug = ?;`
+	rows, err := Database.Query(query, slug)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return albums, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var album types.Album
+		err = rows.Scan(&album.Slug, &album.Name, &album.DateCreated, &album.CoverSlug, &album.Visibility, &album.PasswordHash)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return albums, err
+		}
+		album.Protected = album.PasswordHash != ""
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+func InsertAlbumLinkRow(ctx context.Context, link types.Link) error {
 	stmt, err := Database.Prepare(`INSERT INTO album_links (
 		albumSlug, imageSlug
 	) VALUES (?, ?);`)
@@ -92,15 +149,37 @@ func InsertAlbumLinkRow(link types.Link) error {
 		link.AlbumSlug, link.ImageSlug,
 	)
 	if err != nil {
-		log.Printf("error inserting album link row: %s", err)
+		slog.ErrorContext(ctx, "Error inserting album link row", "error", err)
 		return err
 	}
 
-	log.Printf("Album link row inserted successfully for %s %s", link.AlbumSlug, link.ImageSlug)
+	slog.InfoContext(ctx, "Album link row inserted", "album", link.AlbumSlug, "slug", link.ImageSlug)
 	return nil
 }
 
-func DeleteAlbumLinkRow(link types.Link) error {
+// InsertAlbumLinkRows adds several images to an album in one transaction, so that either
+// all of them are added or none are. On failure it also returns the image that could not be added.
+func InsertAlbumLinkRows(ctx context.Context, albumSlug string, imageSlugs []string) (string, error) {
+	tx, err := Database.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, imageSlug := range imageSlugs {
+		if _, err := tx.Exec(`INSERT INTO album_links (albumSlug, imageSlug) VALUES (?, ?);`, albumSlug, imageSlug); err != nil {
+			slog.ErrorContext(ctx, "Error inserting album link row", "album", albumSlug, "slug", imageSlug, "error", err)
+			return imageSlug, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Album link rows inserted", "album", albumSlug, "count", len(imageSlugs))
+	return "", nil
+}
+
+func DeleteAlbumLinkRow(ctx context.Context, link types.Link) error {
 	stmt, err := Database.Prepare(`DELETE FROM album_links where albumSlug = ? and imageSlug = ?;`)
 	if err != nil {
 		return err
@@ -109,15 +188,15 @@ func DeleteAlbumLinkRow(link types.Link) error {
 
 	_, err = stmt.Exec(link.AlbumSlug, link.ImageSlug)
 	if err != nil {
-		log.Printf("error deleting album link row: %s", err)
+		slog.ErrorContext(ctx, "Error deleting album link row", "error", err)
 		return err
 	}
 
-	log.Printf("Album link row deleted successfully for %s %s", link.AlbumSlug, link.ImageSlug)
+	slog.InfoContext(ctx, "Album link row deleted", "album", link.AlbumSlug, "slug", link.ImageSlug)
 	return nil
 }
 
-func DeleteAlbumLinksByImageSlug(slug string) error {
+func DeleteAlbumLinksByImageSlug(ctx context.Context, slug string) error {
 	stmt, err := Database.Prepare(`DELETE FROM album_links where imageSlug = ?;`)
 	if err != nil {
 		return err
@@ -126,11 +205,11 @@ func DeleteAlbumLinksByImageSlug(slug string) error {
 
 	_, err = stmt.Exec(slug)
 	if err != nil {
-		log.Printf("error deleting album link row: %s", err)
+		slog.ErrorContext(ctx, "Error deleting album link row", "error", err)
 		return err
 	}
 
-	log.Printf("Album link rows deleted successfully for %s", slug)
+	slog.InfoContext(ctx, "Album link rows deleted", "slug", slug)
 	return nil
 }
 
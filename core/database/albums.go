@@ -1,10 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"gallery/core/logic"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -13,7 +14,9 @@ func createAlbumsTable(db *sql.DB) {
 		slug TEXT PRIMARY KEY,
 		name TEXT,
 		dateCreated DATETIME,
-		coverSlug TEXT
+		coverSlug TEXT,
+		visibility TEXT NOT NULL DEFAULT 'public',
+		passwordHash TEXT NOT NULL DEFAULT ''
 	);`
 
 	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='albums'"
@@ -22,39 +25,48 @@ func createAlbumsTable(db *sql.DB) {
 	checkError := db.QueryRow(checkQuery).Scan(&name)
 
 	if checkError == nil {
-		log.Println("albums table already exists")
+		slog.Debug("albums table already exists")
 	} else {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Printf("Error creating albums table: %s", err)
+			slog.Error("Error creating albums table", "error", err)
 		} else {
-			log.Println("albums table created")
+			slog.Info("albums table created")
 		}
 	}
+
+	addColumnIfMissing(db, "albums", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	addColumnIfMissing(db, "albums", "passwordHash", "TEXT NOT NULL DEFAULT ''")
 }
 
-func GetAlbum(slug string) (types.Album, error) {
+func GetAlbum(ctx context.Context, slug string) (types.Album, error) {
 	var album types.Album
-	query := `SELECT slug, name, dateCreated, coverSlug FROM albums where slug = ?;`
+	query := `SELECT slug, name, dateCreated, coverSlug, visibility, passwordHash FROM albums where slug = ?;`
 	err := Database.QueryRow(query, slug).Scan(
 		&album.Slug,
 		&album.Name,
 		&album.DateCreated,
 		&album.CoverSlug,
+		&album.Visibility,
+		&album.PasswordHash,
 	)
 	if err != nil {
-		return types.Album{}, err
+		return types.Album{}, lookupFailed(ctx, err)
 	}
+	album.Protected = album.PasswordHash != ""
 	return album, nil
 }
 
-func GetAllAlbums() []types.Album {
+// GetAllAlbums lists albums, leaving out unlisted and private albums unless includeHidden is set.
+func GetAllAlbums(ctx context.Context, includeHidden bool) []types.Album {
 	var albums []types.Album
 
-	query := `SELECT slug, name, dateCreated, coverSlug FROM albums ORDER BY datecreated DESC;`
-	rows, err := Database.Query(query)
+	query := `SELECT slug, name, dateCreated, coverSlug, visibility, passwordHash != '' FROM albums
+		WHERE ? OR visibility = 'public'
+		ORDER BY datecreated DESC;`
+	rows, err := Database.Query(query, includeHidden)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 		return []types.Album{}
 	}
 	defer rows.Close()
@@ -64,9 +76,11 @@ func GetAllAlbums() []types.Album {
 		var name string
 		var dateCreated string
 		var coverSlug string
-		err = rows.Scan(&slug, &name, &dateCreated, &coverSlug)
+		var visibility string
+		var protected bool
+		err = rows.Scan(&slug, &name, &dateCreated, &coverSlug, &visibility, &protected)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 
 		rowResult := types.Album{
@@ -74,6 +88,8 @@ func GetAllAlbums() []types.Album {
 			Name:        name,
 			DateCreated: dateCreated,
 			CoverSlug:   coverSlug,
+			Visibility:  visibility,
+			Protected:   protected,
 		}
 
 		albums = append(albums, rowResult)
@@ -81,28 +97,29 @@ func GetAllAlbums() []types.Album {
 	return albums
 }
 
-func InsertAlbumRow(album types.Album) error {
+func InsertAlbumRow(ctx context.Context, album types.Album) (string, error) {
 	stmt, err := Database.Prepare(`INSERT INTO albums (
-		slug, name, dateCreated, coverSlug
-	) VALUES (?, ?, ?, ?);`)
+		slug, name, dateCreated, coverSlug, visibility
+	) VALUES (?, ?, ?, ?, ?);`)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer stmt.Close()
 
+	slug := logic.GenerateSlug()
 	_, err = stmt.Exec(
-		logic.GenerateSlug(), album.Name, time.Now(), album.CoverSlug,
+		slug, album.Name, time.Now(), album.CoverSlug, logic.TernaryString(album.Visibility == "", types.VisibilityPublic, album.Visibility),
 	)
 	if err != nil {
-		log.Printf("error inserting album row: %s", err)
-		return err
+		slog.ErrorContext(ctx, "Error inserting album row", "error", err)
+		return "", err
 	}
 
-	log.Printf("Album row inserted successfully for %s", album.Name)
-	return nil
+	slog.InfoContext(ctx, "Album row inserted", "name", album.Name)
+	return slug, nil
 }
 
-func DeleteAlbumRow(albumSlug string) error {
+func DeleteAlbumRow(ctx context.Context, albumSlug string) error {
 	stmt, err := Database.Prepare(`DELETE FROM albums where slug = ?;`)
 	if err != nil {
 		return err
@@ -111,15 +128,15 @@ func DeleteAlbumRow(albumSlug string) error {
 
 	_, err = stmt.Exec(albumSlug)
 	if err != nil {
-		log.Printf("error deleting album row: %s", err)
+		slog.ErrorContext(ctx, "Error deleting album row", "error", err)
 		return err
 	}
 
-	log.Printf("Album row deleted successfully for albumSlug %s", albumSlug)
+	slog.InfoContext(ctx, "Album row deleted", "album", albumSlug)
 	return nil
 }
 
-func UpdateAlbumCover(albumSlug string, coverSlug string) error {
+func UpdateAlbumCover(ctx context.Context, albumSlug string, coverSlug string) error {
 	stmt, err := Database.Prepare(`UPDATE albums set coverSlug = ? where slug = ?;`)
 	if err != nil {
 		return err
@@ -128,15 +145,15 @@ func UpdateAlbumCover(albumSlug string, coverSlug string) error {
 
 	_, err = stmt.Exec(coverSlug, albumSlug)
 	if err != nil {
-		log.Printf("error updating cover for album row: %s", err)
+		slog.ErrorContext(ctx, "Error updating cover for album row", "error", err)
 		return err
 	}
 
-	log.Printf("Cover updated to %s successfully for albumSlug %s", coverSlug, albumSlug)
+	slog.InfoContext(ctx, "Album cover updated", "album", albumSlug, "cover", coverSlug)
 	return nil
 }
 
-func UpdateAlbumName(albumSlug string, albumName string) error {
+func UpdateAlbumName(ctx context.Context, albumSlug string, albumName string) error {
 	stmt, err := Database.Prepare(`UPDATE albums set name = ? where slug = ?;`)
 	if err != nil {
 		return err
@@ -145,11 +162,46 @@ func UpdateAlbumName(albumSlug string, albumName string) error {
 
 	_, err = stmt.Exec(albumName, albumSlug)
 	if err != nil {
-		log.Printf("error updating name for album row: %s", err)
+		slog.ErrorContext(ctx, "Error updating name for album row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Album name updated", "album", albumSlug, "name", albumName)
+	return nil
+}
+
+func UpdateAlbumVisibility(ctx context.Context, albumSlug string, visibility string) error {
+	stmt, err := Database.Prepare(`UPDATE albums set visibility = ? where slug = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(visibility, albumSlug)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating visibility for album row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Album visibility updated", "album", albumSlug, "visibility", visibility)
+	return nil
+}
+
+// UpdateAlbumPassword sets the hashed password for an album, or removes it when passwordHash is empty.
+func UpdateAlbumPassword(ctx context.Context, albumSlug string, passwordHash string) error {
+	stmt, err := Database.Prepare(`UPDATE albums set passwordHash = ? where slug = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(passwordHash, albumSlug)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating password for album row", "error", err)
 		return err
 	}
 
-	log.Printf("Album Name updated to %s successfully for albumSlug %s", albumName, albumSlug)
+	slog.InfoContext(ctx, "Album password "+logic.TernaryString(passwordHash == "", "removed", "updated"), "album", albumSlug)
 	return nil
 }
 
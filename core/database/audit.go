@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/types"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+func createAuditLogTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		dateCreated DATETIME,
+		actor TEXT,
+		action TEXT,
+		target TEXT,
+		albumSlug TEXT,
+		beforeValue TEXT,
+		afterValue TEXT,
+		ipAddress TEXT
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_dateCreated ON audit_log (dateCreated);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='audit_log'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("audit_log table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating audit_log table", "error", err)
+		} else {
+			slog.Info("audit_log table created")
+		}
+	}
+}
+
+func InsertAuditLogRow(ctx context.Context, entry types.AuditEntry) error {
+	stmt, err := Database.Prepare(`INSERT INTO audit_log (
+		dateCreated, actor, action, target, albumSlug, beforeValue, afterValue, ipAddress
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		time.Now().UTC(), entry.Actor, entry.Action, entry.Target, entry.AlbumSlug,
+		nullableJson(entry.Before), nullableJson(entry.After), entry.IPAddress,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting audit log row", "error", err)
+		return err
+	}
+	return nil
+}
+
+func nullableJson(value []byte) sql.NullString {
+	return sql.NullString{String: string(value), Valid: len(value) > 0}
+}
+
+// GetAuditLog returns one page of audit entries matching filter, newest first, along with the total number of matches.
+func GetAuditLog(ctx context.Context, filter types.AuditFilter) ([]types.AuditEntry, int, error) {
+	entries := []types.AuditEntry{}
+
+	conditions := []string{}
+	params := []any{}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		params = append(params, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		params = append(params, filter.Action)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "target = ?")
+		params = append(params, filter.Target)
+	}
+	if filter.AlbumSlug != "" {
+		conditions = append(conditions, "albumSlug = ?")
+		params = append(params, filter.AlbumSlug)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "dateCreated >= ?")
+		params = append(params, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "dateCreated < ?")
+		params = append(params, filter.Until.UTC())
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := Database.QueryRow("SELECT COUNT(*) FROM audit_log"+where, params...).Scan(&total); err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return entries, 0, err
+	}
+
+	query := `SELECT id, dateCreated, actor, action, target, albumSlug, beforeValue, afterValue, ipAddress
+		FROM audit_log` + where + ` ORDER BY id DESC LIMIT ? OFFSET ?;`
+	rows, err := Database.Query(query, append(params, filter.Limit, filter.Offset)...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return entries, total, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry types.AuditEntry
+		var before sql.NullString
+		var after sql.NullString
+		err := rows.Scan(
+			&entry.ID,
+			&entry.DateCreated,
+			&entry.Actor,
+			&entry.Action,
+			&entry.Target,
+			&entry.AlbumSlug,
+			&before,
+			&after,
+			&entry.IPAddress,
+		)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return entries, total, err
+		}
+		if before.Valid {
+			entry.Before = []byte(before.String)
+		}
+		if after.Valid {
+			entry.After = []byte(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+func InitialiseAuditLog(db *sql.DB) {
+	createAuditLogTable(db)
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"gallery/core/types"
+	"log/slog"
+	"strings"
+)
+
+// GetImageDetails loads the metadata, dimensions, tags and albums of several images with
+// three queries, however many slugs are asked for. The images are returned in the order of
+// slugs, leaving out slugs that do not exist and repeats. Albums is left for the caller to
+// fill from InAlbums, as which albums may be shown depends on who is asking.
+func GetImageDetails(ctx context.Context, slugs []string) ([]types.ImageDetails, error) {
+	if len(slugs) == 0 {
+		return []types.ImageDetails{}, nil
+	}
+	found := map[string]*types.ImageDetails{}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(slugs)), ", ")
+	args := make([]any, len(slugs))
+	for i, slug := range slugs {
+		args[i] = slug
+	}
+
+	rows, err := Database.Query(`SELECT metadata.slug, metadata.filePath, metadata.fileName, metadata.title, metadata.dateTaken,
+			metadata.dateUploaded, metadata.cameraMake, metadata.cameraModel, metadata.lensMake, metadata.lensModel,
+			metadata.fStop, metadata.exposureTime, metadata.flashStatus, metadata.focalLength, metadata.iso,
+			metadata.exposureMode, metadata.whiteBalance, metadata.whiteBalanceMode, metadata.visibility,
+			COALESCE(dimensions.width, 0), COALESCE(dimensions.height, 0), COALESCE(dimensions.orientation, ''),
+			COALESCE(dimensions.panoramic, 0), COALESCE(dimensions.placeholder, ''),
+			NOT `+fmt.Sprintf(notPending, "metadata.slug")+`
+		FROM metadata
+		LEFT JOIN dimensions ON dimensions.imageSlug = metadata.slug
+		WHERE metadata.slug IN (`+placeholders+`);`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return nil, err
+	}
+	for rows.Next() {
+		image := &types.ImageDetails{Tags: []string{}, Albums: []string{}, InAlbums: []types.Album{}}
+		err = rows.Scan(
+			&image.Slug, &image.FilePath, &image.FileName, &image.Title, &image.DateTaken,
+			&image.DateUploaded, &image.CameraMake, &image.CameraModel, &image.LensMake, &image.LensModel,
+			&image.FStop, &image.ExposureTime, &image.FlashStatus, &image.FocalLength, &image.ISO,
+			&image.ExposureMode, &image.WhiteBalance, &image.WhiteBalanceMode, &image.Visibility,
+			&image.Width, &image.Height, &image.Orientation,
+			&image.Panoramic, &image.Placeholder,
+			&image.Pending,
+		)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			rows.Close()
+			return nil, err
+		}
+		found[image.Slug] = image
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = Database.Query(`SELECT imageSlug, tag FROM tags WHERE imageSlug IN (`+placeholders+`);`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return nil, err
+	}
+	for rows.Next() {
+		var slug, tag string
+		if err := rows.Scan(&slug, &tag); err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			rows.Close()
+			return nil, err
+		}
+		if image, ok := found[slug]; ok {
+			image.Tags = append(image.Tags, tag)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = Database.Query(`SELECT album_links.imageSlug, albums.slug, albums.name, albums.dateCreated, albums.coverSlug,
+			albums.visibility, albums.passwordHash
+		FROM album_links
+		JOIN albums ON album_links.albumSlug = albums.slug
+		WHERE album_links.imageSlug IN (`+placeholders+`);`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return nil, err
+	}
+	for rows.Next() {
+		var slug string
+		var album types.Album
+		err := rows.Scan(&slug, &album.Slug, &album.Name, &album.DateCreated, &album.CoverSlug, &album.Visibility, &album.PasswordHash)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			rows.Close()
+			return nil, err
+		}
+		album.Protected = album.PasswordHash != ""
+		if image, ok := found[slug]; ok {
+			image.InAlbums = append(image.InAlbums, album)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	images := []types.ImageDetails{}
+	for _, slug := range slugs {
+		image, ok := found[slug]
+		if !ok {
+			continue
+		}
+		albumNames := []string{}
+		for _, album := range image.InAlbums {
+			albumNames = append(albumNames, album.Name)
+		}
+		image.Tags = imageTags(image.Tags, image.Title, albumNames, image.Orientation, image.Panoramic)
+		images = append(images, *image)
+		delete(found, slug)
+	}
+	return images, nil
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"gallery/core/config"
+	"gallery/core/types"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selectCount returns how many SELECT statements the instrumented driver has recorded.
+func selectCount(t *testing.T) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "gallery_sqlite_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "statement" && label.GetValue() == "select" {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func setupBatch(t *testing.T, count int) []string {
+	t.Helper()
+	config.DatabaseDirectory = t.TempDir()
+	if Initialise() == nil {
+		t.Fatal("failed to initialise database")
+	}
+	t.Cleanup(Close)
+	createDimensionsTable()
+	createTagsTable()
+
+	albumSlug, err := InsertAlbumRow(t.Context(), types.Album{Name: "Holiday", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	visibilities := []string{types.VisibilityPublic, types.VisibilityUnlisted, types.VisibilityPrivate}
+	slugs := []string{}
+	for i := range count {
+		slug := "image-" + strconv.Itoa(i)
+		_, err := Database.Exec(`INSERT INTO metadata (slug, filePath, fileName, title, dateTaken, dateUploaded,
+				cameraMake, cameraModel, lensMake, lensModel, fStop, exposureTime, flashStatus, focalLength, iso,
+				exposureMode, whiteBalance, whiteBalanceMode, visibility)
+			VALUES (?, '', ?, ?, '2024-06-30 12:00:00', '2024-06-30 12:00:00', '', '', '', '', '', '', '', '', '', '', '', '', ?);`,
+			slug, slug+".jpg", slug, visibilities[i%len(visibilities)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := InsertTagsRow(t.Context(), types.Tag{Tag: "beach", ImageSlug: slug}); err != nil {
+			t.Fatal(err)
+		}
+		if err := InsertAlbumLinkRow(t.Context(), types.Link{AlbumSlug: albumSlug, ImageSlug: slug}); err != nil {
+			t.Fatal(err)
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs
+}
+
+func TestGetImageDetailsQueryCount(t *testing.T) {
+	for _, count := range []int{1, 10, 100} {
+		t.Run(strconv.Itoa(count)+" slugs", func(t *testing.T) {
+			slugs := setupBatch(t, count)
+			requested := append(slices.Clone(slugs), "missing")
+
+			before := selectCount(t)
+			images, err := GetImageDetails(t.Context(), requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queries := selectCount(t) - before; queries != 3 {
+				t.Errorf("ran %d queries, want 3", queries)
+			}
+
+			if len(images) != count {
+				t.Fatalf("returned %d images, want %d", len(images), count)
+			}
+			for i, image := range images {
+				if image.Slug != slugs[i] {
+					t.Errorf("image %d is %s, want %s", i, image.Slug, slugs[i])
+				}
+				if !slices.Contains(image.Tags, "beach") || len(image.InAlbums) != 1 {
+					t.Errorf("%s has tags %v and albums %v", image.Slug, image.Tags, image.InAlbums)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterPublicSlugs(t *testing.T) {
+	slugs := setupBatch(t, 6)
+	requested := []string{"missing"}
+	for _, slug := range slices.Backward(slugs) {
+		requested = append(requested, slug)
+	}
+
+	public, err := FilterPublicSlugs(t.Context(), requested, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// setupBatch makes every third image public, starting with the first
+	want := []string{"image-3", "image-0"}
+	if !slices.Equal(public, want) {
+		t.Errorf("returned %v, want %v", public, want)
+	}
+}
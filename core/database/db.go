@@ -1,62 +1,130 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"gallery/core/config"
 	"gallery/core/logic"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 var Database *sql.DB
 
+// Close checkpoints the WAL into the main database file and closes the database, so
+// nothing is left to replay from sqlite.db-wal on the next boot.
+func Close() {
+	if Database == nil {
+		return
+	}
+	if _, err := Database.Exec("pragma wal_checkpoint(TRUNCATE);"); err != nil {
+		slog.Error("Error checkpointing WAL", "error", err)
+	} else {
+		slog.Info("Database WAL checkpointed")
+	}
+	if err := Database.Close(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	} else {
+		slog.Info("Database closed")
+	}
+}
+
 func Initialise() *sql.DB {
 	logic.CreateDir(config.DatabaseDirectory)
 
 	dbPath := filepath.Join(config.DatabaseDirectory, "sqlite.db")
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		log.Println("Creating database file")
+		slog.Info("Creating database file")
 
 		file, err := os.Create(dbPath)
 		if err != nil {
-			log.Printf("Error creating database file: %s", err)
+			slog.Error("Error creating database file", "error", err)
 			return nil
 		} else {
-			log.Println("Database file created")
+			slog.Info("Database file created")
 		}
 		file.Close()
 	} else {
-		log.Println("Database already exists")
+		slog.Debug("Database already exists")
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open(driverName, dbPath)
 
 	if err != nil {
-		log.Printf("Error opening database file: %s", err)
+		slog.Error("Error opening database file", "error", err)
 		return nil
 	} else {
-		log.Println("Database file opened")
+		slog.Debug("Database file opened")
 	}
 
 	Database = db
 
 	_, err = db.Exec("pragma journal_mode = wal;")
 	if err != nil {
-		log.Printf("Error entering WAL mode: %s", err)
+		slog.Error("Error entering WAL mode", "error", err)
 	} else {
-		log.Println("Database is in WAL mode")
+		slog.Debug("Database is in WAL mode")
 	}
 
 	createMetadataTable(db)
 	InitialiseAlbums(db)
 	InitialiseLinks(db)
+	InitialiseUsers(db)
+	InitialiseSessions(db)
+	InitialiseApiTokens(db)
+	InitialiseAuditLog(db)
+	InitialiseShareLinks(db)
+	InitialiseModerationQueue(db)
 	return db
 }
 
+// IsDuplicate reports whether err is a primary key or unique constraint failure, from
+// inserting a row that already exists.
+func IsDuplicate(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// lookupFailed logs err with the request ID carried by ctx, unless no row was found, which
+// callers expect and report themselves. It returns err, so lookups can end with it.
+func lookupFailed(ctx context.Context, err error) error {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+	}
+	return err
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of the gallery.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) {
+	var count int
+	checkQuery := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	err := db.QueryRow(checkQuery, table, column).Scan(&count)
+	if err != nil {
+		slog.Error("Error checking column", "table", table, "column", column, "error", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	if err != nil {
+		slog.Error("Error adding column", "table", table, "column", column, "error", err)
+	} else {
+		slog.Info("Column added", "table", table, "column", column)
+	}
+}
+
 func createMetadataTable(db *sql.DB) {
 	query := `CREATE TABLE IF NOT EXISTS metadata (
 		slug TEXT PRIMARY KEY,
@@ -76,7 +144,8 @@ func createMetadataTable(db *sql.DB) {
 		iso TEXT,
 		exposureMode TEXT,
 		whiteBalance TEXT,
-		WhiteBalanceMode TEXT
+		WhiteBalanceMode TEXT,
+		visibility TEXT NOT NULL DEFAULT 'public'
 	);`
 
 	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='metadata'"
@@ -84,15 +153,24 @@ func createMetadataTable(db *sql.DB) {
 	checkError := db.QueryRow(checkQuery).Scan(&name)
 
 	if checkError == nil {
-		log.Println("metadata table already exists")
+		slog.Debug("metadata table already exists")
 	} else {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Printf("Error creating metadata table: %s", err)
+			slog.Error("Error creating metadata table", "error", err)
 		} else {
-			log.Println("metadata table created")
+			slog.Info("metadata table created")
 		}
 	}
+
+	addColumnIfMissing(db, "metadata", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+
+	// The listings sort on dateTaken then slug, so with this index SQLite can walk the
+	// images in order and stop at the page limit instead of sorting the whole table.
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS metadata_dateTaken_slug ON metadata (dateTaken, slug);`)
+	if err != nil {
+		slog.Error("Error creating metadata index", "error", err)
+	}
 }
 
 func GetExistingMetadataFilePaths() []types.MetadataFile {
@@ -101,7 +179,7 @@ func GetExistingMetadataFilePaths() []types.MetadataFile {
 	query := "SELECT slug, filePath, fileName FROM metadata"
 	rows, err := Database.Query(query)
 	if err != nil {
-		log.Printf("Failed to fetch rows from metadata table: %s", err)
+		slog.Error("Failed to fetch rows from metadata table", "error", err)
 	}
 
 	defer rows.Close()
@@ -112,7 +190,7 @@ func GetExistingMetadataFilePaths() []types.MetadataFile {
 		var fileName string
 		err = rows.Scan(&slug, &filePath, &fileName)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Failed to scan row", "error", err)
 		}
 
 		rowResult := types.MetadataFile{
@@ -127,30 +205,35 @@ func GetExistingMetadataFilePaths() []types.MetadataFile {
 	return foundMetadataFiles
 }
 
-func DeleteImageBySlug(slug string) (string, error) {
-	metadata, err := GetMetadataBySlug(slug)
+func DeleteImageBySlug(ctx context.Context, slug string) (string, error) {
+	metadata, err := GetMetadataBySlug(ctx, slug)
 	if err != nil {
 		return "", err
 	}
 
 	filename := metadata.FileName
 
-	err = DeleteMetadataBySlug(slug)
+	err = DeleteMetadataBySlug(ctx, slug)
+	if err != nil {
+		return filename, err
+	}
+
+	err = DeleteAlbumLinksByImageSlug(ctx, slug)
 	if err != nil {
 		return filename, err
 	}
 
-	err = DeleteAlbumLinksByImageSlug(slug)
+	err = DeleteDimensionsRowForSlug(ctx, slug)
 	if err != nil {
 		return filename, err
 	}
 
-	err = DeleteDimensionsRowForSlug(slug)
+	err = DeleteTagsByImageSlug(ctx, slug)
 	if err != nil {
 		return filename, err
 	}
 
-	err = DeleteTagsByImageSlug(slug)
+	err = DeleteModerationRow(ctx, slug)
 	if err != nil {
 		return filename, err
 	}
@@ -1,24 +1,47 @@
 package database
 
 import (
+	"context"
+	"gallery/core/config"
 	"gallery/core/types"
-	"log"
+	"image"
+	"log/slog"
+	"os"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"sync"
 
+	"github.com/buckket/go-blurhash"
 	"github.com/disintegration/imaging"
 )
 
-func InitialiseDimensions() {
+// placeholderWidth is the width images are shrunk to before being hashed; BlurHash only
+// keeps a handful of colour components, so more pixels would only make encoding slower.
+const placeholderWidth = 32
+
+// wgDimensions tracks the background population started by InitialiseDimensions.
+var wgDimensions sync.WaitGroup
+
+func InitialiseDimensions(ctx context.Context) {
 	createDimensionsTable()
-	go populateDimensions()
+	wgDimensions.Add(1)
+	go func() {
+		defer wgDimensions.Done()
+		populateDimensions(ctx)
+		populatePlaceholders(ctx)
+	}()
+}
+
+// WaitForDimensions waits for background dimension population to stop after its context is cancelled.
+func WaitForDimensions() {
+	wgDimensions.Wait()
 }
 
-func GetSourceDimensionsForSlug(slug string) (types.DimensionsRow, error) {
-	metadata, err := GetMetadataBySlug(slug)
+func GetSourceDimensionsForSlug(ctx context.Context, slug string) (types.DimensionsRow, error) {
+	metadata, err := GetMetadataBySlug(ctx, slug)
 	if err != nil {
-		log.Printf("Error getting metadata: %s", err)
+		slog.ErrorContext(ctx, "Error getting metadata", "slug", slug, "error", err)
 		return types.DimensionsRow{}, err
 	}
 
@@ -26,7 +49,7 @@ func GetSourceDimensionsForSlug(slug string) (types.DimensionsRow, error) {
 
 	source, err := imaging.Open(imagePath)
 	if err != nil {
-		log.Printf("Failed to open image: %v", err)
+		slog.ErrorContext(ctx, "Failed to open image", "file", imagePath, "error", err)
 	}
 
 	defer func() {
@@ -56,11 +79,24 @@ func GetSourceDimensionsForSlug(slug string) (types.DimensionsRow, error) {
 		Height:      height,
 		Orientation: orientation,
 		Panoramic:   panoramic,
+		Placeholder: getPlaceholder(ctx, source),
 	}
 
 	return dimensions, nil
 }
 
+// getPlaceholder returns a BlurHash of source, which clients can decode into a blurred
+// preview to show while the thumbnail loads. An empty string means no placeholder.
+func getPlaceholder(ctx context.Context, source image.Image) string {
+	small := imaging.Resize(source, placeholderWidth, 0, imaging.Box)
+	hash, err := blurhash.Encode(4, 3, small)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode placeholder", "error", err)
+		return ""
+	}
+	return hash
+}
+
 func createDimensionsTable() {
 	query := `CREATE TABLE IF NOT EXISTS dimensions (
 		imageSlug TEXT,
@@ -68,6 +104,7 @@ func createDimensionsTable() {
 		height INTEGER,
 		orientation TEXT,
 		panoramic TEXT,
+		placeholder TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY (imageSlug) REFERENCES metadata(slug),
 		PRIMARY KEY (imageSlug)
 	);`
@@ -78,15 +115,22 @@ func createDimensionsTable() {
 	checkError := Database.QueryRow(checkQuery).Scan(&name)
 
 	if checkError == nil {
-		log.Println("dimensions table already exists")
+		slog.Debug("dimensions table already exists")
 	} else {
 		_, err := Database.Exec(query)
 		if err != nil {
-			log.Printf("Error creating dimensions table: %s", err)
+			slog.Error("Error creating dimensions table", "error", err)
 		} else {
-			log.Println("dimensions table created")
+			slog.Info("dimensions table created")
 		}
 	}
+
+	addColumnIfMissing(Database, "dimensions", "placeholder", "TEXT NOT NULL DEFAULT ''")
+
+	_, err := Database.Exec(`CREATE INDEX IF NOT EXISTS dimensions_orientation ON dimensions (orientation);`)
+	if err != nil {
+		slog.Error("Error creating dimensions index", "error", err)
+	}
 }
 
 func GetDimensionedSlugs() ([]string, error) {
@@ -94,7 +138,7 @@ func GetDimensionedSlugs() ([]string, error) {
 	query := `SELECT DISTINCT imageSlug FROM dimensions;`
 	rows, err := Database.Query(query)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 		return []string{}, err
 	}
 	defer rows.Close()
@@ -103,7 +147,7 @@ func GetDimensionedSlugs() ([]string, error) {
 		var imageSlug string
 		err = rows.Scan(&imageSlug)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Failed to scan row", "error", err)
 		}
 
 		slugs = append(slugs, imageSlug)
@@ -111,30 +155,30 @@ func GetDimensionedSlugs() ([]string, error) {
 	return slugs, nil
 }
 
-func CreateDimsensionsOnUpload(slug string) {
-	dimensions, err := GetSourceDimensionsForSlug(slug)
+func CreateDimsensionsOnUpload(ctx context.Context, slug string) {
+	dimensions, err := GetSourceDimensionsForSlug(ctx, slug)
 	if err != nil {
-		log.Printf("%v", err)
+		slog.ErrorContext(ctx, "Error getting dimensions", "slug", slug, "error", err)
 		return
 	}
-	err = InsertDimensionsRow(dimensions)
+	err = InsertDimensionsRow(ctx, dimensions)
 	if err != nil {
-		log.Printf("Error inserting dimensions: %v", err)
+		slog.ErrorContext(ctx, "Error inserting dimensions", "slug", slug, "error", err)
 	}
 }
 
-func populateDimensions() {
+func populateDimensions(ctx context.Context) {
 	slugs, err := GetAllSlugs()
 
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 		return
 	}
 
 	existingSlugs, err := GetDimensionedSlugs()
 
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 		return
 	}
 
@@ -146,53 +190,105 @@ func populateDimensions() {
 	}
 
 	for _, slug := range slugsToInsert {
-		dimensions, err := GetSourceDimensionsForSlug(slug)
+		if ctx.Err() != nil {
+			slog.Info("Stopped populating dimensions", "reason", ctx.Err())
+			return
+		}
+		dimensions, err := GetSourceDimensionsForSlug(ctx, slug)
 		if err != nil {
-			log.Printf("%v", err)
+			slog.Error("Error getting dimensions", "slug", slug, "error", err)
 			return
 		}
-		err = InsertDimensionsRow(dimensions)
+		err = InsertDimensionsRow(ctx, dimensions)
 		if err != nil {
-			log.Printf("Error inserting dimensions: %v", err)
+			slog.Error("Error inserting dimensions", "slug", slug, "error", err)
 		}
 	}
 }
 
-func InsertDimensionsRow(dimensions types.DimensionsRow) error {
-	log.Printf("adding dimensions for %s", dimensions.ImageSlug)
-	stmt, err := Database.Prepare(`INSERT INTO dimensions (imageSlug, width, height, orientation, panoramic) VALUES (?, ?, ?, ?, ?);`)
+// populatePlaceholders hashes the images that were given dimensions before placeholders
+// existed. The thumbnail is hashed when there is one, as it is much quicker to decode.
+func populatePlaceholders(ctx context.Context) {
+	rows, err := Database.Query(`SELECT imageSlug FROM dimensions WHERE placeholder = '';`)
+	if err != nil {
+		slog.Error("Query failed", "error", err)
+		return
+	}
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			slog.Error("Failed to scan row", "error", err)
+			continue
+		}
+		slugs = append(slugs, slug)
+	}
+	rows.Close()
+
+	for _, slug := range slugs {
+		if ctx.Err() != nil {
+			slog.Info("Stopped populating placeholders", "reason", ctx.Err())
+			return
+		}
+
+		imagePath := filepath.Join(config.ThumbnailDirectory, slug+".jpeg")
+		if _, err := os.Stat(imagePath); err != nil {
+			metadata, err := GetMetadataBySlug(ctx, slug)
+			if err != nil {
+				slog.Error("Error getting metadata", "slug", slug, "error", err)
+				continue
+			}
+			imagePath = filepath.Join(metadata.FilePath, metadata.FileName)
+		}
+		source, err := imaging.Open(imagePath)
+		if err != nil {
+			slog.Error("Failed to open image", "file", imagePath, "error", err)
+			continue
+		}
+
+		_, err = Database.Exec(`UPDATE dimensions SET placeholder = ? WHERE imageSlug = ?;`, getPlaceholder(ctx, source), slug)
+		if err != nil {
+			slog.Error("Error updating placeholder", "slug", slug, "error", err)
+		}
+	}
+}
+
+func InsertDimensionsRow(ctx context.Context, dimensions types.DimensionsRow) error {
+	slog.DebugContext(ctx, "Adding dimensions", "slug", dimensions.ImageSlug)
+	stmt, err := Database.Prepare(`INSERT INTO dimensions (imageSlug, width, height, orientation, panoramic, placeholder) VALUES (?, ?, ?, ?, ?, ?);`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(dimensions.ImageSlug, dimensions.Width, dimensions.Height, dimensions.Orientation, dimensions.Panoramic)
+	_, err = stmt.Exec(dimensions.ImageSlug, dimensions.Width, dimensions.Height, dimensions.Orientation, dimensions.Panoramic, dimensions.Placeholder)
 	if err != nil {
-		log.Printf("error inserting tag row: %s", err)
+		slog.ErrorContext(ctx, "Error inserting dimensions row", "error", err)
 		return err
 	}
 
-	log.Printf("Dimensions row inserted successfully for %s", dimensions.ImageSlug)
+	slog.DebugContext(ctx, "Dimensions row inserted", "slug", dimensions.ImageSlug)
 	return nil
 }
 
-func GetDimensionForSlug(slug string) (types.DimensionsRow, error) {
+func GetDimensionForSlug(ctx context.Context, slug string) (types.DimensionsRow, error) {
 	var dimension types.DimensionsRow
-	query := `SELECT imageSlug, width, height, orientation, panoramic FROM dimensions where imageSlug = ?;`
+	query := `SELECT imageSlug, width, height, orientation, panoramic, placeholder FROM dimensions where imageSlug = ?;`
 	err := Database.QueryRow(query, slug).Scan(
 		&dimension.ImageSlug,
 		&dimension.Width,
 		&dimension.Height,
 		&dimension.Orientation,
 		&dimension.Panoramic,
+		&dimension.Placeholder,
 	)
 	if err != nil {
-		return types.DimensionsRow{}, err
+		return types.DimensionsRow{}, lookupFailed(ctx, err)
 	}
 	return dimension, nil
 }
 
-func DeleteDimensionsRowForSlug(slug string) error {
+func DeleteDimensionsRowForSlug(ctx context.Context, slug string) error {
 	stmt, err := Database.Prepare(`delete from dimensions where ImageSlug = ?;`)
 	if err != nil {
 		return err
@@ -201,10 +297,10 @@ func DeleteDimensionsRowForSlug(slug string) error {
 
 	_, err = stmt.Exec(slug)
 	if err != nil {
-		log.Printf("error deleting dimensions row for %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error deleting dimensions row", "slug", slug, "error", err)
 		return err
 	}
 
-	log.Printf("Dimensions row deleted successfully for %s", slug)
+	slog.InfoContext(ctx, "Dimensions row deleted", "slug", slug)
 	return nil
 }
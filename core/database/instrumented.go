@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"gallery/core/metrics"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// driverName is the SQLite driver wrapped to record query timings.
+const driverName = "sqlite-instrumented"
+
+func init() {
+	sql.Register(driverName, instrumentedDriver{&sqlite.Driver{}})
+}
+
+// sqliteConn is the set of optional driver interfaces the SQLite connection implements,
+// which the wrapper has to pass on so database/sql keeps using them.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type sqliteStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+type instrumentedDriver struct {
+	driver driver.Driver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(sqliteConn); ok {
+		return instrumentedConn{c}, nil
+	}
+	return conn, nil
+}
+
+type instrumentedConn struct {
+	sqliteConn
+}
+
+func (c instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.sqliteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := stmt.(sqliteStmt); ok {
+		return instrumentedStmt{s, query}, nil
+	}
+	return stmt, nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	started := time.Now()
+	result, err := c.sqliteConn.ExecContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		metrics.ObserveQuery(query, started)
+	}
+	return result, err
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	started := time.Now()
+	rows, err := c.sqliteConn.QueryContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		metrics.ObserveQuery(query, started)
+	}
+	return rows, err
+}
+
+type instrumentedStmt struct {
+	sqliteStmt
+	query string
+}
+
+func (s instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer metrics.ObserveQuery(s.query, time.Now())
+	return s.sqliteStmt.ExecContext(ctx, args)
+}
+
+func (s instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer metrics.ObserveQuery(s.query, time.Now())
+	return s.sqliteStmt.QueryContext(ctx, args)
+}
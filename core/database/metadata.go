@@ -1,16 +1,20 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gallery/core/config"
 	"gallery/core/exif"
 	"gallery/core/logic"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
@@ -23,11 +27,11 @@ func deleteMetadataRowByFile(filePath string, fileName string) error {
 
 	_, err := Database.Exec(deleteStatement, filePath, fileName)
 	if err != nil {
-		log.Printf("Error deleting metadata for %s: %s", fullFilePath, err)
+		slog.Error("Error deleting metadata", "file", fullFilePath, "error", err)
 		return err
 	}
 
-	log.Printf("Metadata row deleted successfully for %s", fullFilePath)
+	slog.Info("Metadata row deleted", "file", fullFilePath)
 	return nil
 }
 
@@ -64,17 +68,22 @@ func deleteExtraneousMetadata() {
 		fileName := file.FileName
 		err := deleteMetadataRowByFile(filePath, fileName)
 		if err != nil {
-			log.Printf("Error deleting metadata for %s: %s", fileName, err)
+			slog.Error("Error deleting metadata", "file", fileName, "error", err)
 		}
 	}
 }
 
-func InitialiseMetadata() {
-	populateMetadata()
+// InitialiseMetadata adds images found in the image directory and removes rows for images
+// that are gone. It returns early, leaving the rest for the next start, if ctx is cancelled.
+func InitialiseMetadata(ctx context.Context) {
+	populateMetadata(ctx)
+	if ctx.Err() != nil {
+		return
+	}
 	deleteExtraneousMetadata()
 }
 
-func insertMetadataRow(imageMetadata types.ImageMetadata) error {
+func insertMetadataRow(ctx context.Context, imageMetadata types.ImageMetadata, visibility string) error {
 
 	parsedDateTaken, err := logic.FormatTimeToString(imageMetadata.DateTaken.String())
 	if err != nil {
@@ -84,8 +93,8 @@ func insertMetadataRow(imageMetadata types.ImageMetadata) error {
 	stmt, err := Database.Prepare(`INSERT INTO metadata (
 		slug, filePath, fileName, title, dateTaken, dateUploaded,
 		cameraMake, cameraModel, lensMake, lensModel, fStop, exposureTime,
-		flashStatus, focalLength, iso, exposureMode, whiteBalance, WhiteBalanceMode
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
+		flashStatus, focalLength, iso, exposureMode, whiteBalance, WhiteBalanceMode, visibility
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	if err != nil {
 		return err
 	}
@@ -98,42 +107,46 @@ func insertMetadataRow(imageMetadata types.ImageMetadata) error {
 		imageMetadata.CameraMake, imageMetadata.CameraModel, imageMetadata.LensMake,
 		imageMetadata.LensModel, imageMetadata.FStop, imageMetadata.ExposureTime,
 		imageMetadata.FlashStatus, imageMetadata.FocalLength, imageMetadata.ISO,
-		imageMetadata.ExposureMode, imageMetadata.WhiteBalance, imageMetadata.WhiteBalanceMode,
+		imageMetadata.ExposureMode, imageMetadata.WhiteBalance, imageMetadata.WhiteBalanceMode, visibility,
 	)
 	if err != nil {
-		log.Printf("error inserting metadata row: %s", err)
+		slog.ErrorContext(ctx, "Error inserting metadata row", "error", err)
 		return err
 	}
 
-	log.Printf("Metadata row inserted successfully for %s", imageMetadata.FileName)
+	slog.DebugContext(ctx, "Metadata row inserted", "file", imageMetadata.FileName)
 	return nil
 }
 
-func populateMetadata() {
+func populateMetadata(ctx context.Context) {
 	foundFiles, _ := logic.GetDirContents(config.ImagePath)
 	for _, file := range foundFiles {
+		if ctx.Err() != nil {
+			slog.Info("Stopped populating metadata", "reason", ctx.Err())
+			return
+		}
 		checkQuery := `SELECT COUNT(*) FROM metadata WHERE filePath = ? AND fileName = ?;`
 		filePath := filepath.Dir(file)
 		fileName := filepath.Base(file)
 		var count int
 		err := Database.QueryRow(checkQuery, filePath, fileName).Scan(&count)
 		if err != nil {
-			log.Printf("error checking existing row for %s: %v", fileName, err)
+			slog.Error("Error checking existing row", "file", fileName, "error", err)
 		} else if count > 0 {
-			log.Printf("Metadata row already exists, skipping insert: %s\n", fileName)
+			slog.Debug("Metadata row already exists, skipping insert", "file", fileName)
 		} else {
 			imageMetadata := exif.GetSourceMetadataForImagePath(file)
-			err = insertMetadataRow(imageMetadata)
+			err = insertMetadataRow(ctx, imageMetadata, types.VisibilityPublic)
 			if err != nil {
-				log.Printf("Error inserting metadata for %s: %v", fileName, err)
+				slog.Error("Error inserting metadata", "file", fileName, "error", err)
 			}
 		}
 	}
 }
 
-func GetMetadataBySlug(slug string) (types.ImageMetadataWithDimensions, error) {
+func GetMetadataBySlug(ctx context.Context, slug string) (types.ImageMetadataWithDimensions, error) {
 	var row types.ImageMetadataWithDimensions
-	query := `SELECT slug, filePath, fileName, title, dateTaken, dateUploaded, cameraMake, cameraModel, lensMake, lensModel, fStop, exposureTime, flashStatus, focalLength, iso, exposureMode, whiteBalance, whiteBalanceMode FROM metadata WHERE slug = ?;`
+	query := `SELECT slug, filePath, fileName, title, dateTaken, dateUploaded, cameraMake, cameraModel, lensMake, lensModel, fStop, exposureTime, flashStatus, focalLength, iso, exposureMode, whiteBalance, whiteBalanceMode, visibility FROM metadata WHERE slug = ?;`
 
 	err := Database.QueryRow(query, slug).Scan(
 		&row.Slug,
@@ -154,12 +167,13 @@ func GetMetadataBySlug(slug string) (types.ImageMetadataWithDimensions, error) {
 		&row.ExposureMode,
 		&row.WhiteBalance,
 		&row.WhiteBalanceMode,
+		&row.Visibility,
 	)
 	if err != nil {
-		return types.ImageMetadataWithDimensions{}, err
+		return types.ImageMetadataWithDimensions{}, lookupFailed(ctx, err)
 	}
 
-	dimensions, err := GetDimensionForSlug(slug)
+	dimensions, err := GetDimensionForSlug(ctx, slug)
 	if err == nil {
 		row.Width = dimensions.Width
 		row.Height = dimensions.Height
@@ -170,7 +184,7 @@ func GetMetadataBySlug(slug string) (types.ImageMetadataWithDimensions, error) {
 	return row, nil
 }
 
-func CheckMetadataByFileNameExists(filename string) bool {
+func CheckMetadataByFileNameExists(ctx context.Context, filename string) bool {
 	query := `SELECT slug FROM metadata WHERE fileName = ?;`
 	var slug string
 
@@ -179,72 +193,111 @@ func CheckMetadataByFileNameExists(filename string) bool {
 		if err == sql.ErrNoRows {
 			return false
 		}
-		log.Println("Database error:", err)
+		slog.ErrorContext(ctx, "Database error", "error", err)
 		return false
 	}
 	return true
 }
 
-func GetSlugsWithDimensions() ([]types.SlugWithDimensions, error) {
-	var slugsWithDimensions []types.SlugWithDimensions
-	slugs, err := GetSlugsOrderedByDateTaken()
-	if err != nil {
-		log.Printf("Failed to get slugs: %v", err)
-		return []types.SlugWithDimensions{}, err
+// slugQueryConditions builds the WHERE clause shared by QuerySlugs and CountSlugs, leaving out the cursor.
+func slugQueryConditions(query types.SlugQuery) (string, []any) {
+	conditions := []string{
+		"(? OR metadata.visibility = 'public')",
+		"(? OR " + fmt.Sprintf(notPending, "metadata.slug") + ")",
+		"(? OR " + fmt.Sprintf(notAlbumLocked, "metadata.slug") + ")",
 	}
+	args := []any{query.IncludeHidden, query.IncludePending, query.IncludeHidden, unlockedAlbumsParameter(query.UnlockedAlbums)}
 
-	for _, slug := range slugs {
-		dimension, err := GetDimensionForSlug(slug)
-		if err != nil {
-			log.Printf("Failed to get dimensions: %v", err)
-		} else {
-			slugWithDimensions := types.SlugWithDimensions{
-				Slug:   slug,
-				Width:  dimension.Width,
-				Height: dimension.Height,
-			}
-			slugsWithDimensions = append(slugsWithDimensions, slugWithDimensions)
-		}
+	if query.From != "" {
+		conditions = append(conditions, "metadata.dateTaken >= ?")
+		args = append(args, query.From)
 	}
-
-	return slugsWithDimensions, nil
+	if query.To != "" {
+		conditions = append(conditions, "metadata.dateTaken < date(?, '+1 day')")
+		args = append(args, query.To)
+	}
+	if query.Camera != "" {
+		conditions = append(conditions, "(metadata.cameraModel = ? COLLATE NOCASE OR metadata.cameraMake || ' ' || metadata.cameraModel = ? COLLATE NOCASE)")
+		args = append(args, query.Camera, query.Camera)
+	}
+	if query.Lens != "" {
+		conditions = append(conditions, "metadata.lensModel = ? COLLATE NOCASE")
+		args = append(args, query.Lens)
+	}
+	if query.Orientation != "" {
+		conditions = append(conditions, "dimensions.orientation = ?")
+		args = append(args, query.Orientation)
+	}
+	if query.AlbumSlug != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM album_links WHERE album_links.imageSlug = metadata.slug AND album_links.albumSlug = ?)")
+		args = append(args, query.AlbumSlug)
+	}
+	return strings.Join(conditions, " AND "), args
 }
 
-func GetSlugsOrderedByDateTaken() ([]string, error) {
-	var slugs []string = []string{}
+// QuerySlugs lists the images matching query, newest first with the slug breaking ties, so
+// the listing can be continued from a cursor without skipping or repeating images. Each
+// image is passed to yield as it is read, and an error from yield stops the query.
+func QuerySlugs(ctx context.Context, query types.SlugQuery, yield func(types.ListedSlug) error) error {
+	where, args := slugQueryConditions(query)
+	if query.After != nil {
+		where += " AND (metadata.dateTaken < ? OR (metadata.dateTaken = ? AND metadata.slug < ?))"
+		args = append(args, query.After.DateTaken, query.After.DateTaken, query.After.Slug)
+	}
+	statement := `SELECT metadata.slug, metadata.title, metadata.dateTaken, CAST(metadata.dateTaken AS TEXT),
+			COALESCE(dimensions.width, 0), COALESCE(dimensions.height, 0), COALESCE(dimensions.placeholder, '')
+		FROM metadata
+		LEFT JOIN dimensions ON dimensions.imageSlug = metadata.slug
+		WHERE ` + where + `
+		ORDER BY metadata.dateTaken DESC, metadata.slug DESC`
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
 
-	query := `SELECT slug FROM metadata order by dateTaken desc`
-	rows, err := Database.Query(query)
+	rows, err := Database.Query(statement, args...)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
-		return slugs, err
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var slug string
-		if err := rows.Scan(&slug); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			return nil, err
+		var slug types.ListedSlug
+		err := rows.Scan(&slug.Slug, &slug.Title, &slug.DateTaken, &slug.Cursor.DateTaken, &slug.Width, &slug.Height, &slug.Placeholder)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return err
+		}
+		slug.Cursor.Slug = slug.Slug
+		if err := yield(slug); err != nil {
+			return err
 		}
-		slugs = append(slugs, slug)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
-		return slugs, err
 	}
+	return rows.Err()
+}
 
-	return slugs, nil
+// CountSlugs returns how many images match query across all pages.
+func CountSlugs(ctx context.Context, query types.SlugQuery) (int, error) {
+	where, args := slugQueryConditions(query)
+	var count int
+	err := Database.QueryRow(`SELECT COUNT(*) FROM metadata
+		LEFT JOIN dimensions ON dimensions.imageSlug = metadata.slug
+		WHERE `+where+`;`, args...).Scan(&count)
+	return count, lookupFailed(ctx, err)
 }
 
-func GetSlugsOrderedRandom() ([]string, error) {
+// GetSlugsOrderedRandom lists images in a random order, leaving out unlisted and private
+// images, and images only in password protected albums that are not in unlockedAlbums, unless
+// includeHidden is set, and uploads waiting for moderation unless includePending is.
+func GetSlugsOrderedRandom(ctx context.Context, includeHidden bool, includePending bool, unlockedAlbums []string) ([]string, error) {
 	var slugs []string = []string{}
 
-	query := `SELECT slug FROM metadata ORDER BY RANDOM() DESC;`
-	rows, err := Database.Query(query)
+	query := `SELECT slug FROM metadata WHERE (? OR visibility = 'public') AND (? OR ` + fmt.Sprintf(notPending, "metadata.slug") + `)
+		AND (? OR ` + fmt.Sprintf(notAlbumLocked, "metadata.slug") + `) ORDER BY RANDOM() DESC;`
+	rows, err := Database.Query(query, includeHidden, includePending, includeHidden, unlockedAlbumsParameter(unlockedAlbums))
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -252,66 +305,158 @@ func GetSlugsOrderedRandom() ([]string, error) {
 	for rows.Next() {
 		var slug string
 		if err := rows.Scan(&slug); err != nil {
-			log.Printf("Failed to scan row: %v", err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 			return nil, err
 		}
 		slugs = append(slugs, slug)
 	}
 
 	if err := rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
+		slog.ErrorContext(ctx, "Rows iteration error", "error", err)
 		return slugs, err
 	}
 
 	return slugs, nil
 }
 
-func GetOriginalImageBlobBySlug(slug string) ([]byte, error) {
-	metadata, _ := GetMetadataBySlug(slug)
+func GetOriginalImageBlobBySlug(ctx context.Context, slug string) ([]byte, error) {
+	metadata, _ := GetMetadataBySlug(ctx, slug)
 	filePath, _ := filepath.Abs(filepath.Join(metadata.FilePath, metadata.FileName))
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Printf("Original file does not exist: %s:  %s", filePath, err)
+		slog.ErrorContext(ctx, "Original file does not exist", "file", filePath, "error", err)
 		return nil, err
 	}
 	blob, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Error reading original image for slug %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error reading original image", "slug", slug, "error", err)
 		return nil, err
 	}
 	return blob, nil
 }
 
-func UpdateMetadataBySlug(slug string, updates map[string]interface{}) error {
-	query := "UPDATE metadata SET "
+// EditableMetadataFields are the metadata columns that can be changed through the API. The
+// file path and name are not among them, as they decide which file is served as the original.
+var EditableMetadataFields = []string{
+	"title", "dateTaken", "cameraMake", "cameraModel", "lensMake", "lensModel", "fStop", "exposureTime",
+	"flashStatus", "focalLength", "iso", "exposureMode", "whiteBalance", "whiteBalanceMode", "visibility",
+}
+
+// UnknownFieldError is returned when an update names a field that is not in EditableMetadataFields.
+type UnknownFieldError struct {
+	Field string
+}
+
+func (err *UnknownFieldError) Error() string {
+	return fmt.Sprintf("%q is not an editable metadata field", err.Field)
+}
+
+// UpdateMetadataBySlug sets the given metadata fields of an image. Every field must be one of
+// EditableMetadataFields; the column names in the query come from that list, never from updates.
+func UpdateMetadataBySlug(ctx context.Context, slug string, updates map[string]interface{}) error {
+	columns := []string{}
 	params := []interface{}{}
-	i := 1
-	for field, value := range updates {
-		query += fmt.Sprintf("%s = ?", field)
-		if i < len(updates) {
-			query += ", "
+	for _, column := range EditableMetadataFields {
+		if value, ok := updates[column]; ok {
+			columns = append(columns, column+" = ?")
+			params = append(params, value)
 		}
-		params = append(params, value)
-		i++
 	}
-	query += " WHERE slug = ?"
+	if len(columns) != len(updates) {
+		for field := range updates {
+			if !slices.Contains(EditableMetadataFields, field) {
+				return &UnknownFieldError{Field: field}
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	query := "UPDATE metadata SET " + strings.Join(columns, ", ") + " WHERE slug = ?"
 	params = append(params, slug)
 
-	stmt, err := Database.Prepare(query)
+	_, err := Database.Exec(query, params...)
+	if err == nil {
+		slog.InfoContext(ctx, "Metadata updated", "slug", slug, "updates", updates)
+	}
+	return err
+}
+
+// GetImageVisibility returns the visibility of an image, or an error if it does not exist.
+func GetImageVisibility(ctx context.Context, slug string) (string, error) {
+	var visibility string
+	err := Database.QueryRow(`SELECT visibility FROM metadata WHERE slug = ?;`, slug).Scan(&visibility)
+	return visibility, lookupFailed(ctx, err)
+}
+
+// FilterPublicSlugs keeps only the slugs of public images that are not only in password
+// protected albums missing from unlockedAlbums, preserving their order.
+func FilterPublicSlugs(ctx context.Context, slugs []string, unlockedAlbums []string) ([]string, error) {
+	if len(slugs) == 0 {
+		return []string{}, nil
+	}
+	public := map[string]bool{}
+	// the slugs are passed as one JSON array, as there can be more of them than SQLite allows parameters
+	list, err := json.Marshal(slugs)
 	if err != nil {
-		return err
+		return []string{}, err
 	}
-	defer stmt.Close()
+	rows, err := Database.Query(`SELECT slug FROM metadata
+		WHERE slug IN (SELECT value FROM json_each(?)) AND visibility = 'public'
+			AND `+fmt.Sprintf(notAlbumLocked, "metadata.slug")+`;`, string(list), unlockedAlbumsParameter(unlockedAlbums))
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return []string{}, err
+	}
+	defer rows.Close()
 
-	_, err = stmt.Exec(params...)
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return []string{}, err
+		}
+		public[slug] = true
+	}
 
-	if err == nil {
-		log.Printf("Metadata updated for %s, %s", slug, updates)
+	filtered := []string{}
+	for _, slug := range slugs {
+		if public[slug] {
+			filtered = append(filtered, slug)
+		}
 	}
-	return err
+	return filtered, rows.Err()
+}
+
+// filterPendingSlugs leaves out the images that are waiting for moderation, keeping the order.
+func filterPendingSlugs(ctx context.Context, slugs []string) ([]string, error) {
+	pending := map[string]bool{}
+	rows, err := Database.Query(`SELECT slug FROM moderation_queue;`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return []string{}, err
+		}
+		pending[slug] = true
+	}
+
+	filtered := []string{}
+	for _, slug := range slugs {
+		if !pending[slug] {
+			filtered = append(filtered, slug)
+		}
+	}
+	return filtered, rows.Err()
 }
 
-func DeleteMetadataBySlug(slug string) error {
+func DeleteMetadataBySlug(ctx context.Context, slug string) error {
 	query := "DELETE from metadata WHERE slug = ?"
 
 	stmt, err := Database.Prepare(query)
@@ -323,12 +468,12 @@ func DeleteMetadataBySlug(slug string) error {
 	_, err = stmt.Exec(slug)
 
 	if err == nil {
-		log.Printf("Metadata deleted for %s", slug)
+		slog.InfoContext(ctx, "Metadata deleted", "slug", slug)
 	}
 	return err
 }
 
-func PopulateMetadataForUpload(fileName string) (string, error) {
+func PopulateMetadataForUpload(ctx context.Context, fileName string, visibility string) (string, error) {
 	filePath := filepath.Join(config.ImageDirectory, fileName)
 
 	checkQuery := `SELECT COUNT(*) FROM metadata WHERE filePath = ? AND fileName = ?;`
@@ -336,19 +481,19 @@ func PopulateMetadataForUpload(fileName string) (string, error) {
 	var count int
 	err := Database.QueryRow(checkQuery, filePath, fileName).Scan(&count)
 	if err != nil {
-		log.Printf("error checking existing row for %s: %v", fileName, err)
+		slog.ErrorContext(ctx, "Error checking existing row", "file", fileName, "error", err)
 		return "", err
 	} else if count > 0 {
-		log.Printf("Metadata row already exists, skipping insert: %s\n", fileName)
+		slog.DebugContext(ctx, "Metadata row already exists, skipping insert", "file", fileName)
 		return "", errors.New("metadata already exists")
 	} else {
 		imageMetadata := exif.GetSourceMetadataForImagePath(filePath)
-		err = insertMetadataRow(imageMetadata)
+		err = insertMetadataRow(ctx, imageMetadata, visibility)
 		if err != nil {
-			log.Printf("Error inserting metadata for %s: %v", fileName, err)
-		} else {
-			log.Printf("Metadata inserted for %s: %v", fileName, imageMetadata)
+			slog.ErrorContext(ctx, "Error inserting metadata", "file", fileName, "error", err)
+			return "", err
 		}
+		slog.InfoContext(ctx, "Metadata inserted", "file", fileName, "slug", imageMetadata.Slug)
 		return imageMetadata.Slug, nil
 	}
 }
@@ -359,7 +504,7 @@ func GetAllSlugs() ([]string, error) {
 	query := `SELECT slug FROM metadata;`
 	rows, err := Database.Query(query)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 		return slugs, err
 	}
 	defer rows.Close()
@@ -367,14 +512,14 @@ func GetAllSlugs() ([]string, error) {
 	for rows.Next() {
 		var slug string
 		if err := rows.Scan(&slug); err != nil {
-			log.Printf("Failed to scan row: %v", err)
+			slog.Error("Failed to scan row", "error", err)
 			return nil, err
 		}
 		slugs = append(slugs, slug)
 	}
 
 	if err := rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
+		slog.Error("Rows iteration error", "error", err)
 		return slugs, err
 	}
 
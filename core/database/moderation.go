@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/types"
+	"log/slog"
+	"time"
+)
+
+func createModerationQueueTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS moderation_queue (
+		slug TEXT PRIMARY KEY,
+		albumSlug TEXT,
+		uploadedBy TEXT,
+		dateCreated DATETIME
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='moderation_queue'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("moderation_queue table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating moderation_queue table", "error", err)
+		} else {
+			slog.Info("moderation_queue table created")
+		}
+	}
+}
+
+// notPending is a condition leaving out images, given by their slug column, that are waiting for moderation.
+const notPending = "NOT EXISTS (SELECT 1 FROM moderation_queue WHERE moderation_queue.slug = %s)"
+
+// IsPendingUpload reports whether an image is waiting for moderation.
+func IsPendingUpload(ctx context.Context, slug string) (bool, error) {
+	var pending bool
+	err := Database.QueryRow(`SELECT EXISTS (SELECT 1 FROM moderation_queue WHERE slug = ?);`, slug).Scan(&pending)
+	return pending, lookupFailed(ctx, err)
+}
+
+func InsertModerationRow(ctx context.Context, slug string, albumSlug string, uploadedBy string) error {
+	stmt, err := Database.Prepare(`INSERT INTO moderation_queue (
+		slug, albumSlug, uploadedBy, dateCreated
+	) VALUES (?, ?, ?, ?);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(slug, albumSlug, uploadedBy, time.Now().UTC())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting moderation row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Upload queued for moderation", "slug", slug, "user", uploadedBy)
+	return nil
+}
+
+func GetPendingUpload(ctx context.Context, slug string) (types.PendingUpload, error) {
+	var upload types.PendingUpload
+	query := `SELECT moderation_queue.slug, COALESCE(metadata.fileName, ''), moderation_queue.albumSlug,
+		moderation_queue.uploadedBy, moderation_queue.dateCreated
+		FROM moderation_queue
+		LEFT JOIN metadata ON metadata.slug = moderation_queue.slug
+		WHERE moderation_queue.slug = ?;`
+	err := Database.QueryRow(query, slug).Scan(
+		&upload.Slug,
+		&upload.FileName,
+		&upload.AlbumSlug,
+		&upload.UploadedBy,
+		&upload.DateCreated,
+	)
+	if err != nil {
+		return types.PendingUpload{}, lookupFailed(ctx, err)
+	}
+	return upload, nil
+}
+
+// GetPendingUploads returns the moderation queue, oldest upload first.
+func GetPendingUploads(ctx context.Context) ([]types.PendingUpload, error) {
+	uploads := []types.PendingUpload{}
+
+	query := `SELECT moderation_queue.slug, COALESCE(metadata.fileName, ''), moderation_queue.albumSlug,
+		moderation_queue.uploadedBy, moderation_queue.dateCreated
+		FROM moderation_queue
+		LEFT JOIN metadata ON metadata.slug = moderation_queue.slug
+		ORDER BY moderation_queue.dateCreated ASC;`
+	rows, err := Database.Query(query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return uploads, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var upload types.PendingUpload
+		err = rows.Scan(&upload.Slug, &upload.FileName, &upload.AlbumSlug, &upload.UploadedBy, &upload.DateCreated)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return uploads, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func DeleteModerationRow(ctx context.Context, slug string) error {
+	stmt, err := Database.Prepare(`DELETE FROM moderation_queue WHERE slug = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(slug)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting moderation row", "error", err)
+		return err
+	}
+	return nil
+}
+
+func InitialiseModerationQueue(db *sql.DB) {
+	createModerationQueueTable(db)
+}
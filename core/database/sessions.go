@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/logic"
+	"gallery/core/types"
+	"log/slog"
+	"time"
+)
+
+func createSessionsTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		tokenHash TEXT UNIQUE,
+		username TEXT,
+		dateCreated DATETIME,
+		lastSeen DATETIME,
+		ipAddress TEXT,
+		userAgent TEXT,
+		FOREIGN KEY (username) REFERENCES users(username)
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='sessions'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("sessions table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating sessions table", "error", err)
+		} else {
+			slog.Info("sessions table created")
+		}
+	}
+}
+
+func InsertSessionRow(ctx context.Context, tokenHash string, username string, ipAddress string, userAgent string) (string, error) {
+	stmt, err := Database.Prepare(`INSERT INTO sessions (
+		id, tokenHash, username, dateCreated, lastSeen, ipAddress, userAgent
+	) VALUES (?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	id := logic.GenerateSlug()
+	now := time.Now().UTC()
+	_, err = stmt.Exec(id, tokenHash, username, now, now, ipAddress, userAgent)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting session row", "error", err)
+		return "", err
+	}
+
+	slog.InfoContext(ctx, "Session created", "session", id, "user", username)
+	return id, nil
+}
+
+func GetSessionByTokenHash(ctx context.Context, tokenHash string) (types.Session, error) {
+	var session types.Session
+	query := `SELECT id, username, dateCreated, lastSeen, ipAddress, userAgent FROM sessions WHERE tokenHash = ?;`
+	err := Database.QueryRow(query, tokenHash).Scan(
+		&session.ID,
+		&session.Username,
+		&session.DateCreated,
+		&session.LastSeen,
+		&session.IPAddress,
+		&session.UserAgent,
+	)
+	if err != nil {
+		return types.Session{}, lookupFailed(ctx, err)
+	}
+	return session, nil
+}
+
+func GetSession(ctx context.Context, id string) (types.Session, error) {
+	var session types.Session
+	query := `SELECT id, username, dateCreated, lastSeen, ipAddress, userAgent FROM sessions WHERE id = ?;`
+	err := Database.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.Username,
+		&session.DateCreated,
+		&session.LastSeen,
+		&session.IPAddress,
+		&session.UserAgent,
+	)
+	if err != nil {
+		return types.Session{}, lookupFailed(ctx, err)
+	}
+	return session, nil
+}
+
+func GetAllSessions(ctx context.Context) ([]types.Session, error) {
+	sessions := []types.Session{}
+
+	query := `SELECT id, username, dateCreated, lastSeen, ipAddress, userAgent FROM sessions ORDER BY lastSeen DESC;`
+	rows, err := Database.Query(query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return sessions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session types.Session
+		err = rows.Scan(&session.ID, &session.Username, &session.DateCreated, &session.LastSeen, &session.IPAddress, &session.UserAgent)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func UpdateSessionLastSeen(ctx context.Context, id string) error {
+	_, err := Database.Exec(`UPDATE sessions SET lastSeen = ? WHERE id = ?;`, time.Now().UTC(), id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating lastSeen for session", "session", id, "error", err)
+	}
+	return err
+}
+
+func DeleteSessionRow(ctx context.Context, id string) error {
+	stmt, err := Database.Prepare(`DELETE FROM sessions WHERE id = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting session row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Session deleted", "session", id)
+	return nil
+}
+
+// DeleteExpiredSessions deletes the sessions last seen before idleBefore or created before
+// createdBefore, returning how many were deleted.
+func DeleteExpiredSessions(ctx context.Context, idleBefore time.Time, createdBefore time.Time) (int64, error) {
+	result, err := Database.Exec(`DELETE FROM sessions WHERE lastSeen < ? OR dateCreated < ?;`, idleBefore.UTC(), createdBefore.UTC())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting expired sessions", "error", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func DeleteSessionsForUser(ctx context.Context, username string) error {
+	stmt, err := Database.Prepare(`DELETE FROM sessions WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting sessions", "user", username, "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Sessions deleted", "user", username)
+	return nil
+}
+
+func InitialiseSessions(db *sql.DB) {
+	createSessionsTable(db)
+}
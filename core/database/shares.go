@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/logic"
+	"gallery/core/types"
+	"log/slog"
+	"time"
+)
+
+func createShareLinksTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		tokenHash TEXT UNIQUE,
+		secret TEXT,
+		albumSlug TEXT,
+		imageSlug TEXT,
+		passwordHash TEXT,
+		expires DATETIME,
+		maxViews INTEGER,
+		views INTEGER DEFAULT 0,
+		createdBy TEXT,
+		dateCreated DATETIME
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='share_links'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("share_links table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating share_links table", "error", err)
+		} else {
+			slog.Info("share_links table created")
+		}
+	}
+}
+
+const shareLinkColumns = `id, secret, albumSlug, imageSlug, passwordHash, expires, maxViews, views, createdBy, dateCreated`
+
+func scanShareLink(row apiTokenScanner) (types.ShareLink, error) {
+	var link types.ShareLink
+	var expires sql.NullTime
+	err := row.Scan(
+		&link.ID,
+		&link.Secret,
+		&link.AlbumSlug,
+		&link.ImageSlug,
+		&link.PasswordHash,
+		&expires,
+		&link.MaxViews,
+		&link.Views,
+		&link.CreatedBy,
+		&link.DateCreated,
+	)
+	if err != nil {
+		return types.ShareLink{}, err
+	}
+	if expires.Valid {
+		link.Expires = &expires.Time
+	}
+	link.HasPassword = link.PasswordHash != ""
+	return link, nil
+}
+
+func InsertShareLinkRow(ctx context.Context, tokenHash string, secret string, passwordHash string, createdBy string, newLink types.NewShareLink) (types.ShareLink, error) {
+	stmt, err := Database.Prepare(`INSERT INTO share_links (
+		id, tokenHash, secret, albumSlug, imageSlug, passwordHash, expires, maxViews, views, createdBy, dateCreated
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?);`)
+	if err != nil {
+		return types.ShareLink{}, err
+	}
+	defer stmt.Close()
+
+	link := types.ShareLink{
+		ID:           logic.GenerateSlug(),
+		Secret:       secret,
+		AlbumSlug:    newLink.AlbumSlug,
+		ImageSlug:    newLink.ImageSlug,
+		PasswordHash: passwordHash,
+		HasPassword:  passwordHash != "",
+		MaxViews:     newLink.MaxViews,
+		CreatedBy:    createdBy,
+		DateCreated:  time.Now().UTC(),
+	}
+	var expires sql.NullTime
+	if newLink.Expires != nil {
+		utc := newLink.Expires.UTC()
+		link.Expires = &utc
+		expires = sql.NullTime{Time: utc, Valid: true}
+	}
+
+	_, err = stmt.Exec(
+		link.ID, tokenHash, link.Secret, link.AlbumSlug, link.ImageSlug, link.PasswordHash,
+		expires, link.MaxViews, link.CreatedBy, link.DateCreated,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting share link row", "error", err)
+		return types.ShareLink{}, err
+	}
+
+	slog.InfoContext(ctx, "Share link created", "share", link.ID, "user", createdBy)
+	return link, nil
+}
+
+func GetShareLinkByHash(ctx context.Context, tokenHash string) (types.ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE tokenHash = ?;`
+	link, err := scanShareLink(Database.QueryRow(query, tokenHash))
+	return link, lookupFailed(ctx, err)
+}
+
+func GetShareLink(ctx context.Context, id string) (types.ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE id = ?;`
+	link, err := scanShareLink(Database.QueryRow(query, id))
+	return link, lookupFailed(ctx, err)
+}
+
+func GetAllShareLinks(ctx context.Context) ([]types.ShareLink, error) {
+	links := []types.ShareLink{}
+
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links ORDER BY dateCreated DESC;`
+	rows, err := Database.Query(query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return links, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// UseShareLinkView counts a view of a share link, returning false if its view limit has already been reached.
+func UseShareLinkView(ctx context.Context, id string) (bool, error) {
+	result, err := Database.Exec(`UPDATE share_links SET views = views + 1 WHERE id = ? AND (maxViews = 0 OR views < maxViews);`, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error counting view for share link", "share", id, "error", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func DeleteShareLinkRow(ctx context.Context, id string) error {
+	stmt, err := Database.Prepare(`DELETE FROM share_links WHERE id = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting share link row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Share link deleted", "share", id)
+	return nil
+}
+
+func InitialiseShareLinks(db *sql.DB) {
+	createShareLinksTable(db)
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Ping checks that the database can still be reached.
+func Ping(ctx context.Context) error {
+	return Database.PingContext(ctx)
+}
+
+// CountImagesByVisibility returns the number of images for each visibility, along with the total.
+func CountImagesByVisibility(ctx context.Context) (map[string]int, error) {
+	counts := map[string]int{"total": 0}
+
+	rows, err := Database.Query(`SELECT visibility, COUNT(*) FROM metadata GROUP BY visibility;`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var visibility string
+		var count int
+		if err := rows.Scan(&visibility, &count); err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return counts, err
+		}
+		counts[visibility] = count
+		counts["total"] += count
+	}
+	return counts, rows.Err()
+}
+
+func CountPendingUploads(ctx context.Context) (int, error) {
+	var count int
+	err := Database.QueryRow(`SELECT COUNT(*) FROM moderation_queue;`).Scan(&count)
+	return count, lookupFailed(ctx, err)
+}
+
+// CountMissingDimensions returns the number of images that have no dimensions row yet.
+func CountMissingDimensions(ctx context.Context) (int, error) {
+	var count int
+	err := Database.QueryRow(`SELECT COUNT(*) FROM metadata
+		WHERE NOT EXISTS (SELECT 1 FROM dimensions WHERE dimensions.imageSlug = metadata.slug);`).Scan(&count)
+	return count, lookupFailed(ctx, err)
+}
@@ -1,10 +1,11 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"gallery/core/logic"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 	"math"
 	"regexp"
 	"slices"
@@ -31,23 +32,28 @@ func createTagsTable() {
 	checkError := Database.QueryRow(checkQuery).Scan(&name)
 
 	if checkError == nil {
-		log.Println("tags table already exists")
+		slog.Debug("tags table already exists")
 	} else {
 		_, err := Database.Exec(query)
 		if err != nil {
-			log.Printf("Error creating tags table: %s", err)
+			slog.Error("Error creating tags table", "error", err)
 		} else {
-			log.Println("tags table created")
+			slog.Info("tags table created")
 		}
 	}
 }
 
-func GetAllTags() ([]string, error) {
+// GetAllTags lists tags, album words and title words, leaving out those only found on
+// unlisted or private images and albums unless includeHidden is set, and on uploads waiting
+// for moderation unless includePending is.
+func GetAllTags(ctx context.Context, includeHidden bool, includePending bool) ([]string, error) {
 	var tags []string
-	query := `SELECT DISTINCT tag FROM tags;`
-	rows, err := Database.Query(query)
+	query := `SELECT DISTINCT tags.tag FROM tags
+		JOIN metadata ON tags.imageSlug = metadata.slug
+		WHERE (? OR metadata.visibility = 'public') AND (? OR ` + fmt.Sprintf(notPending, "metadata.slug") + `);`
+	rows, err := Database.Query(query, includeHidden, includePending)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 
@@ -55,7 +61,7 @@ func GetAllTags() ([]string, error) {
 		var tag string
 		err = rows.Scan(&tag)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 
 		tags = append(tags, strings.ToLower(tag))
@@ -64,10 +70,10 @@ func GetAllTags() ([]string, error) {
 	dimensionTags := []string{"landscape", "portrait", "square", "panoramic"}
 	tags = append(tags, dimensionTags...)
 
-	titles := getAllTitleTags()
+	titles := getAllTitleTags(ctx, includeHidden, includePending)
 	tags = append(tags, titles...)
 
-	albums := getAllAlbumTags()
+	albums := getAllAlbumTags(ctx, includeHidden)
 	tags = append(tags, albums...)
 
 	tags = logic.StringArraySortUnique(tags)
@@ -75,17 +81,17 @@ func GetAllTags() ([]string, error) {
 	return tags, nil
 }
 
-func getAllTitleTags() []string {
-	checkQuery := `SELECT DISTINCT title FROM metadata;`
+func getAllTitleTags(ctx context.Context, includeHidden bool, includePending bool) []string {
+	checkQuery := `SELECT DISTINCT title FROM metadata WHERE (? OR visibility = 'public') AND (? OR ` + fmt.Sprintf(notPending, "metadata.slug") + `);`
 	var titles []string
-	rows, _ := Database.Query(checkQuery)
+	rows, _ := Database.Query(checkQuery, includeHidden, includePending)
 	defer rows.Close()
 
 	for rows.Next() {
 		var title string
 		err := rows.Scan(&title)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		} else {
 			titleRegexp := regexp.MustCompile(`[ \-_]+`) // Matches [" ", "-", "_"]
 			titleArray := titleRegexp.Split(title, -1)
@@ -100,17 +106,17 @@ func getAllTitleTags() []string {
 	return titles
 }
 
-func getAllAlbumTags() []string {
-	checkQuery := `SELECT DISTINCT name FROM albums;`
+func getAllAlbumTags(ctx context.Context, includeHidden bool) []string {
+	checkQuery := `SELECT DISTINCT name FROM albums WHERE ? OR visibility = 'public';`
 	var names []string
-	rows, _ := Database.Query(checkQuery)
+	rows, _ := Database.Query(checkQuery, includeHidden)
 	defer rows.Close()
 
 	for rows.Next() {
 		var name string
 		err := rows.Scan(&name)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		} else {
 			nameRegexp := regexp.MustCompile(`[ \-_]+`) // Matches [" ", "-", "_"]
 			nameArray := nameRegexp.Split(name, -1)
@@ -125,14 +131,14 @@ func getAllAlbumTags() []string {
 	return names
 }
 
-func GetTagsForSlug(slug string) ([]string, error) {
+func GetTagsForSlug(ctx context.Context, slug string) ([]string, error) {
 	var tags []string
 
 	// image tags|metadata
 	query := `SELECT tag FROM tags where imageSlug = ?;`
 	rows, err := Database.Query(query, slug)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 
@@ -140,7 +146,7 @@ func GetTagsForSlug(slug string) ([]string, error) {
 		var tag string
 		err = rows.Scan(&tag)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 		tags = append(tags, tag)
 	}
@@ -150,11 +156,7 @@ func GetTagsForSlug(slug string) ([]string, error) {
 	var title string
 	err = Database.QueryRow(checkQuery, slug).Scan(&title)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
-	} else {
-		titleRegexp := regexp.MustCompile(`[ \-_]+`) // Matches [" ", "-", "_"]
-		titleArray := titleRegexp.Split(title, -1)
-		tags = append(tags, titleArray...)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 
 	// albums
@@ -162,42 +164,51 @@ func GetTagsForSlug(slug string) ([]string, error) {
 	var albumTitles []string
 	rows, err = Database.Query(query, slug)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var albumTitle string
 		err = rows.Scan(&albumTitle)
 		if err != nil {
-			log.Printf("Row scan failed: %v", err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
-		albumTitle = strings.ToLower(albumTitle)
-		albumTitleSplit := strings.Split(albumTitle, " ")
-
-		albumTitles = append(albumTitles, albumTitleSplit...)
+		albumTitles = append(albumTitles, albumTitle)
 	}
-	tags = append(tags, albumTitles...)
 
 	// dimensions
 	query = "select orientation, panoramic from dimensions where imageSlug = ?"
 	rows, err = Database.Query(query, slug)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
+	var orientation string
+	var panoramic bool
 	for rows.Next() {
-		var orientation string
-		var panoramic bool
 		err = rows.Scan(&orientation, &panoramic)
 		if err != nil {
-			log.Printf("Row scan failed: %v", err)
-		}
-		tags = append(tags, orientation)
-		if panoramic {
-			tags = append(tags, "panoramic")
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 	}
 
+	return imageTags(tags, title, albumTitles, orientation, panoramic), nil
+}
+
+var titleSeparators = regexp.MustCompile(`[ \-_]+`) // Matches [" ", "-", "_"]
+
+// imageTags combines an image's stored tags with the words of its title and album names
+// and its orientation, which are what the image can be searched by.
+func imageTags(tags []string, title string, albumNames []string, orientation string, panoramic bool) []string {
+	tags = append(tags, titleSeparators.Split(title, -1)...)
+	for _, name := range albumNames {
+		tags = append(tags, strings.Split(strings.ToLower(name), " ")...)
+	}
+	tags = append(tags, orientation)
+	if panoramic {
+		tags = append(tags, "panoramic")
+	}
+
 	foundTags := []string{}
 	for _, tag := range tags {
 		tag = strings.TrimSpace(tag)
@@ -206,19 +217,21 @@ func GetTagsForSlug(slug string) ([]string, error) {
 		}
 	}
 
-	foundTags = logic.StringArraySortUnique(foundTags)
-
-	return foundTags, nil
+	return logic.StringArraySortUnique(foundTags)
 }
 
-func GetSlugsForTag(tag string) ([]string, error) {
+// GetSlugsForTag finds images by tag, title, album name or orientation, leaving out
+// unlisted and private images, and images only in password protected albums that are not
+// in unlockedAlbums, unless includeHidden is set, and uploads waiting for moderation unless
+// includePending is.
+func GetSlugsForTag(ctx context.Context, tag string, includeHidden bool, includePending bool, unlockedAlbums []string) ([]string, error) {
 	var slugs []string
 
 	// tags|metadata
 	query := `SELECT imageSlug FROM tags where tag = ?;`
 	rows, err := Database.Query(query, tag)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 
@@ -226,7 +239,7 @@ func GetSlugsForTag(tag string) ([]string, error) {
 		var slug string
 		err = rows.Scan(&slug)
 		if err != nil {
-			log.Printf("Query failed: %v", err)
+			slog.ErrorContext(ctx, "Query failed", "error", err)
 		}
 		slugs = append(slugs, slug)
 	}
@@ -236,33 +249,33 @@ func GetSlugsForTag(tag string) ([]string, error) {
 	likePattern := fmt.Sprintf("%%%s%%", tag) // Add % wildcards around tag
 	rows, err = Database.Query(likeQuery, likePattern)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var slug string
 		err = rows.Scan(&slug)
 		if err != nil {
-			log.Printf("Row scan failed: %v", err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 		slugs = append(slugs, slug)
 	}
 
 	// albums
-	likeQuery = `SELECT slug FROM albums where lower(name) like lower(?);`
+	likeQuery = `SELECT slug FROM albums where lower(name) like lower(?) AND (? OR visibility = 'public');`
 	likePattern = fmt.Sprintf("%%%s%%", tag) // Add % wildcards around tag
-	rows, err = Database.Query(likeQuery, likePattern)
+	rows, err = Database.Query(likeQuery, likePattern, includeHidden)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var albumSlug string
 		err = rows.Scan(&albumSlug)
 		if err != nil {
-			log.Printf("Row scan failed: %v", err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
-		albumSlugs, _ := GetAlbumLinks(albumSlug)
+		albumSlugs, _ := GetAlbumLinks(ctx, albumSlug, true, includePending)
 		slugs = append(slugs, albumSlugs...)
 	}
 
@@ -270,7 +283,7 @@ func GetSlugsForTag(tag string) ([]string, error) {
 	query = `SELECT imageSlug FROM dimensions where orientation = ?;`
 	rows, err = Database.Query(query, tag)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.ErrorContext(ctx, "Query failed", "error", err)
 	}
 	defer rows.Close()
 
@@ -278,7 +291,7 @@ func GetSlugsForTag(tag string) ([]string, error) {
 		var slug string
 		err = rows.Scan(&slug)
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 		}
 		slugs = append(slugs, slug)
 	}
@@ -288,7 +301,7 @@ func GetSlugsForTag(tag string) ([]string, error) {
 		query = `SELECT imageSlug FROM dimensions where panoramic = 1;`
 		rows, err = Database.Query(query)
 		if err != nil {
-			log.Printf("Query failed: %v", err)
+			slog.ErrorContext(ctx, "Query failed", "error", err)
 		}
 		defer rows.Close()
 
@@ -296,17 +309,26 @@ func GetSlugsForTag(tag string) ([]string, error) {
 			var slug string
 			err = rows.Scan(&slug)
 			if err != nil {
-				log.Println(err)
+				slog.ErrorContext(ctx, "Failed to scan row", "error", err)
 			}
 			slugs = append(slugs, slug)
 		}
 	}
 
 	slugs = logic.StringArraySortUnique(slugs)
+	if !includeHidden {
+		var err error
+		if slugs, err = FilterPublicSlugs(ctx, slugs, unlockedAlbums); err != nil {
+			return slugs, err
+		}
+	}
+	if !includePending {
+		return filterPendingSlugs(ctx, slugs)
+	}
 	return slugs, nil
 }
 
-func InsertTagsRow(tag types.Tag) error {
+func InsertTagsRow(ctx context.Context, tag types.Tag) error {
 	stmt, err := Database.Prepare(`INSERT INTO tags (tag, imageSlug) VALUES (?, ?);`)
 	if err != nil {
 		return err
@@ -315,15 +337,37 @@ func InsertTagsRow(tag types.Tag) error {
 
 	_, err = stmt.Exec(strings.ToLower(tag.Tag), tag.ImageSlug)
 	if err != nil {
-		log.Printf("error inserting tag row: %s", err)
+		slog.ErrorContext(ctx, "Error inserting tag row", "error", err)
 		return err
 	}
 
-	log.Printf("Tag row inserted successfully for %s %s", tag.Tag, tag.ImageSlug)
+	slog.DebugContext(ctx, "Tag row inserted", "tag", tag.Tag, "slug", tag.ImageSlug)
 	return nil
 }
 
-func DeleteTagsRow(tag types.Tag) error {
+// InsertTagRows tags several images in one transaction, so that either all of them are
+// tagged or none are. On failure it also returns the image that could not be tagged.
+func InsertTagRows(ctx context.Context, tag string, imageSlugs []string) (string, error) {
+	tx, err := Database.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, imageSlug := range imageSlugs {
+		if _, err := tx.Exec(`INSERT INTO tags (tag, imageSlug) VALUES (?, ?);`, strings.ToLower(tag), imageSlug); err != nil {
+			slog.ErrorContext(ctx, "Error inserting tag row", "tag", tag, "slug", imageSlug, "error", err)
+			return imageSlug, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	slog.DebugContext(ctx, "Tag rows inserted", "tag", tag, "count", len(imageSlugs))
+	return "", nil
+}
+
+func DeleteTagsRow(ctx context.Context, tag types.Tag) error {
 	stmt, err := Database.Prepare(`DELETE FROM tags WHERE tag = ? AND imageSlug = ?;`)
 	if err != nil {
 		return err
@@ -332,16 +376,16 @@ func DeleteTagsRow(tag types.Tag) error {
 
 	_, err = stmt.Exec(tag.Tag, tag.ImageSlug)
 	if err != nil {
-		log.Printf("error deleting tag row: %s", err)
+		slog.ErrorContext(ctx, "Error deleting tag row", "error", err)
 		return err
 	}
 
-	log.Printf("Tag row deleted successfully for %s %s", tag.Tag, tag.ImageSlug)
+	slog.InfoContext(ctx, "Tag row deleted", "tag", tag.Tag, "slug", tag.ImageSlug)
 	return nil
 }
 
-func CreateTagsOnUpload(tags types.TagsUpload) error {
-	log.Printf("adding tags for %s", tags.ImageSlug)
+func CreateTagsOnUpload(ctx context.Context, tags types.TagsUpload) error {
+	slog.DebugContext(ctx, "Adding tags", "slug", tags.ImageSlug)
 	checkQuery := `SELECT cameraMake, cameraModel, lensMake, lensModel, fStop, flashStatus, focalLength, iso, exposureMode FROM metadata where slug = ?;`
 	var cameraMake string
 	var cameraModel string
@@ -358,7 +402,7 @@ func CreateTagsOnUpload(tags types.TagsUpload) error {
 	)
 
 	if err != nil {
-		log.Printf("Error creating initial tags: %s", err)
+		slog.ErrorContext(ctx, "Error creating initial tags", "error", err)
 		return err
 	}
 
@@ -399,9 +443,9 @@ func CreateTagsOnUpload(tags types.TagsUpload) error {
 				Tag:       strings.ToLower(tag),
 				ImageSlug: tags.ImageSlug,
 			}
-			err = InsertTagsRow(newTag)
+			err = InsertTagsRow(ctx, newTag)
 			if err != nil {
-				log.Printf("Error inserting tag row: %s", err)
+				slog.ErrorContext(ctx, "Error inserting tag row", "error", err)
 			}
 		}
 	}
@@ -412,7 +456,7 @@ func populateTags() {
 	slugs, err := GetAllSlugs()
 
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 		return
 	}
 
@@ -430,9 +474,9 @@ func populateTags() {
 			Tags:      []string{},
 			ImageSlug: slug,
 		}
-		err = CreateTagsOnUpload(newTag)
+		err = CreateTagsOnUpload(context.Background(), newTag)
 		if err != nil {
-			log.Printf("Error creating tags on upload: %s", err)
+			slog.Error("Error creating tags on upload", "error", err)
 		}
 	}
 }
@@ -442,7 +486,7 @@ func GetTaggedSlugs() []string {
 	query := `SELECT DISTINCT imageSlug FROM tags;`
 	rows, err := Database.Query(query)
 	if err != nil {
-		log.Printf("Query failed: %v", err)
+		slog.Error("Query failed", "error", err)
 	}
 	defer rows.Close()
 
@@ -450,7 +494,7 @@ func GetTaggedSlugs() []string {
 		var imageSlug string
 		err = rows.Scan(&imageSlug)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Failed to scan row", "error", err)
 		}
 
 		slugs = append(slugs, imageSlug)
@@ -491,7 +535,7 @@ func getFStopOrFocalLength(value string, kind string) string {
 	return ""
 }
 
-func DeleteTagsByImageSlug(slug string) error {
+func DeleteTagsByImageSlug(ctx context.Context, slug string) error {
 	stmt, err := Database.Prepare(`DELETE FROM tags where imageSlug = ?;`)
 	if err != nil {
 		return err
@@ -500,10 +544,10 @@ func DeleteTagsByImageSlug(slug string) error {
 
 	_, err = stmt.Exec(slug)
 	if err != nil {
-		log.Printf("error deleting tags for %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error deleting tags", "slug", slug, "error", err)
 		return err
 	}
 
-	log.Printf("tags deleted successfully for %s", slug)
+	slog.InfoContext(ctx, "Tags deleted", "slug", slug)
 	return nil
 }
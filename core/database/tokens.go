@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/logic"
+	"gallery/core/types"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+func createApiTokensTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		username TEXT,
+		tokenHash TEXT UNIQUE,
+		scopes TEXT,
+		dateCreated DATETIME,
+		lastUsed DATETIME,
+		FOREIGN KEY (username) REFERENCES users(username)
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='api_tokens'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("api_tokens table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating api_tokens table", "error", err)
+		} else {
+			slog.Info("api_tokens table created")
+		}
+	}
+}
+
+type apiTokenScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanApiToken(row apiTokenScanner) (types.ApiToken, error) {
+	var token types.ApiToken
+	var scopes string
+	var lastUsed sql.NullTime
+	err := row.Scan(&token.ID, &token.Name, &token.Username, &scopes, &token.DateCreated, &lastUsed)
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		token.LastUsed = &lastUsed.Time
+	}
+	return token, nil
+}
+
+func InsertApiTokenRow(ctx context.Context, tokenHash string, username string, newToken types.NewApiToken) (types.ApiToken, error) {
+	stmt, err := Database.Prepare(`INSERT INTO api_tokens (
+		id, name, username, tokenHash, scopes, dateCreated
+	) VALUES (?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return types.ApiToken{}, err
+	}
+	defer stmt.Close()
+
+	token := types.ApiToken{
+		ID:          logic.GenerateSlug(),
+		Name:        newToken.Name,
+		Username:    username,
+		Scopes:      newToken.Scopes,
+		DateCreated: time.Now().UTC(),
+	}
+	_, err = stmt.Exec(token.ID, token.Name, token.Username, tokenHash, strings.Join(token.Scopes, ","), token.DateCreated)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting api token row", "error", err)
+		return types.ApiToken{}, err
+	}
+
+	slog.InfoContext(ctx, "API token created", "token", token.ID, "user", username)
+	return token, nil
+}
+
+func GetApiTokenByHash(ctx context.Context, tokenHash string) (types.ApiToken, error) {
+	query := `SELECT id, name, username, scopes, dateCreated, lastUsed FROM api_tokens WHERE tokenHash = ?;`
+	token, err := scanApiToken(Database.QueryRow(query, tokenHash))
+	return token, lookupFailed(ctx, err)
+}
+
+func GetApiToken(ctx context.Context, id string) (types.ApiToken, error) {
+	query := `SELECT id, name, username, scopes, dateCreated, lastUsed FROM api_tokens WHERE id = ?;`
+	token, err := scanApiToken(Database.QueryRow(query, id))
+	return token, lookupFailed(ctx, err)
+}
+
+func GetAllApiTokens(ctx context.Context) ([]types.ApiToken, error) {
+	tokens := []types.ApiToken{}
+
+	query := `SELECT id, name, username, scopes, dateCreated, lastUsed FROM api_tokens ORDER BY dateCreated DESC;`
+	rows, err := Database.Query(query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		token, err := scanApiToken(rows)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func UpdateApiTokenLastUsed(ctx context.Context, id string) error {
+	_, err := Database.Exec(`UPDATE api_tokens SET lastUsed = ? WHERE id = ?;`, time.Now().UTC(), id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating lastUsed for API token", "token", id, "error", err)
+	}
+	return err
+}
+
+func DeleteApiTokenRow(ctx context.Context, id string) error {
+	stmt, err := Database.Prepare(`DELETE FROM api_tokens WHERE id = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting api token row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "API token deleted", "token", id)
+	return nil
+}
+
+func DeleteApiTokensForUser(ctx context.Context, username string) error {
+	_, err := Database.Exec(`DELETE FROM api_tokens WHERE username = ?;`, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting API tokens", "user", username, "error", err)
+	}
+	return err
+}
+
+func InitialiseApiTokens(db *sql.DB) {
+	createApiTokensTable(db)
+}
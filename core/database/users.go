@@ -0,0 +1,320 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"gallery/core/types"
+	"log/slog"
+	"time"
+)
+
+func createUsersTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS users (
+		username TEXT PRIMARY KEY,
+		password TEXT,
+		role TEXT,
+		disabled BOOLEAN DEFAULT 0,
+		dateCreated DATETIME,
+		totpSecret TEXT DEFAULT '',
+		totpEnabled BOOLEAN DEFAULT 0,
+		totpLastStep INTEGER DEFAULT 0,
+		uploadAlbum TEXT DEFAULT '',
+		oidcIssuer TEXT DEFAULT '',
+		oidcSubject TEXT DEFAULT ''
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='users'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("users table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating users table", "error", err)
+		} else {
+			slog.Info("users table created")
+		}
+	}
+
+	addColumnIfMissing(db, "users", "totpSecret", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "totpEnabled", "BOOLEAN DEFAULT 0")
+	addColumnIfMissing(db, "users", "totpLastStep", "INTEGER DEFAULT 0")
+	addColumnIfMissing(db, "users", "uploadAlbum", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "oidcIssuer", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "oidcSubject", "TEXT DEFAULT ''")
+
+	// an identity provider account can only be linked to one local account
+	_, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS users_oidc ON users (oidcIssuer, oidcSubject) WHERE oidcSubject != '';`)
+	if err != nil {
+		slog.Error("Error creating users_oidc index", "error", err)
+	}
+}
+
+func createRecoveryCodesTable(db *sql.DB) {
+	query := `CREATE TABLE IF NOT EXISTS recovery_codes (
+		username TEXT,
+		codeHash TEXT,
+		FOREIGN KEY (username) REFERENCES users(username),
+		PRIMARY KEY (username, codeHash)
+	);`
+
+	checkQuery := "SELECT name FROM sqlite_master WHERE type='table' AND name='recovery_codes'"
+
+	var name string
+	checkError := db.QueryRow(checkQuery).Scan(&name)
+
+	if checkError == nil {
+		slog.Debug("recovery_codes table already exists")
+	} else {
+		_, err := db.Exec(query)
+		if err != nil {
+			slog.Error("Error creating recovery_codes table", "error", err)
+		} else {
+			slog.Info("recovery_codes table created")
+		}
+	}
+}
+
+const userColumns = `username, password, role, disabled, dateCreated, totpSecret, totpEnabled, totpLastStep, uploadAlbum, oidcIssuer, oidcSubject`
+
+func scanUser(row *sql.Row) (types.User, error) {
+	var user types.User
+	err := row.Scan(
+		&user.Username,
+		&user.Password,
+		&user.Role,
+		&user.Disabled,
+		&user.DateCreated,
+		&user.TotpSecret,
+		&user.TotpEnabled,
+		&user.TotpLastStep,
+		&user.UploadAlbum,
+		&user.OidcIssuer,
+		&user.OidcSubject,
+	)
+	if err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+func GetUser(ctx context.Context, username string) (types.User, error) {
+	user, err := scanUser(Database.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?;`, username))
+	return user, lookupFailed(ctx, err)
+}
+
+// GetUserByOidcSubject returns the user linked to an identity provider account, identified
+// by the provider's issuer URL and the account's subject.
+func GetUserByOidcSubject(ctx context.Context, issuer string, subject string) (types.User, error) {
+	if subject == "" {
+		return types.User{}, sql.ErrNoRows
+	}
+	user, err := scanUser(Database.QueryRow(`SELECT `+userColumns+` FROM users WHERE oidcIssuer = ? AND oidcSubject = ?;`, issuer, subject))
+	return user, lookupFailed(ctx, err)
+}
+
+func GetAllUsers(ctx context.Context) ([]types.User, error) {
+	users := []types.User{}
+
+	query := `SELECT username, role, disabled, dateCreated, totpEnabled, uploadAlbum, oidcIssuer, oidcSubject FROM users ORDER BY dateCreated ASC;`
+	rows, err := Database.Query(query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Query failed", "error", err)
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user types.User
+		err = rows.Scan(&user.Username, &user.Role, &user.Disabled, &user.DateCreated, &user.TotpEnabled, &user.UploadAlbum, &user.OidcIssuer, &user.OidcSubject)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to scan row", "error", err)
+			return users, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func CountEnabledAdmins(ctx context.Context) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM users WHERE role = ? AND disabled = 0;`
+	err := Database.QueryRow(query, types.RoleAdmin).Scan(&count)
+	return count, lookupFailed(ctx, err)
+}
+
+func InsertUserRow(ctx context.Context, user types.NewUser) error {
+	stmt, err := Database.Prepare(`INSERT INTO users (
+		username, password, role, disabled, dateCreated, uploadAlbum, oidcIssuer, oidcSubject
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(user.Username, user.Password, user.Role, false, time.Now(), user.UploadAlbum, user.OidcIssuer, user.OidcSubject)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "User row inserted", "user", user.Username)
+	return nil
+}
+
+func UpdateUserDisabled(ctx context.Context, username string, disabled bool) error {
+	stmt, err := Database.Prepare(`UPDATE users SET disabled = ? WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(disabled, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating disabled for user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "User disabled updated", "user", username, "disabled", disabled)
+	return nil
+}
+
+func UpdateUserRole(ctx context.Context, username string, role string) error {
+	stmt, err := Database.Prepare(`UPDATE users SET role = ? WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(role, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating role for user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "User role updated", "user", username, "role", role)
+	return nil
+}
+
+// UpdateUserOidcSubject links a user to an identity provider account, or unlinks them when
+// subject is empty.
+func UpdateUserOidcSubject(ctx context.Context, username string, issuer string, subject string) error {
+	if subject == "" {
+		issuer = ""
+	}
+	_, err := Database.Exec(`UPDATE users SET oidcIssuer = ?, oidcSubject = ? WHERE username = ?;`, issuer, subject, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating single sign-on link for user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "User single sign-on link updated", "user", username, "linked", subject != "")
+	return nil
+}
+
+func UpdateUserPassword(ctx context.Context, username string, passwordHash string) error {
+	stmt, err := Database.Prepare(`UPDATE users SET password = ? WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(passwordHash, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating password for user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "Password updated", "user", username)
+	return nil
+}
+
+// UpdateUserTotp stores a user's TOTP secret, whether it is enabled and the last time step accepted.
+func UpdateUserTotp(ctx context.Context, username string, secret string, enabled bool, lastStep int64) error {
+	stmt, err := Database.Prepare(`UPDATE users SET totpSecret = ?, totpEnabled = ?, totpLastStep = ? WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(secret, enabled, lastStep, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating totp for user row", "error", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateUserTotpLastStep records the last accepted time step only if it is newer,
+// so the same code cannot be replayed by concurrent requests.
+func UpdateUserTotpLastStep(ctx context.Context, username string, step int64) (bool, error) {
+	result, err := Database.Exec(`UPDATE users SET totpLastStep = ? WHERE username = ? AND totpLastStep < ?;`, step, username, step)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating totp step for user row", "error", err)
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func ReplaceRecoveryCodes(ctx context.Context, username string, codeHashes []string) error {
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE username = ?;`, username); err != nil {
+		slog.ErrorContext(ctx, "Error deleting recovery codes", "user", username, "error", err)
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		if _, err = tx.Exec(`INSERT INTO recovery_codes (username, codeHash) VALUES (?, ?);`, username, codeHash); err != nil {
+			slog.ErrorContext(ctx, "Error inserting recovery code", "user", username, "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode deletes a matching recovery code, reporting whether one existed.
+func UseRecoveryCode(ctx context.Context, username string, codeHash string) (bool, error) {
+	result, err := Database.Exec(`DELETE FROM recovery_codes WHERE username = ? AND codeHash = ?;`, username, codeHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error using recovery code", "error", err)
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func CountRecoveryCodes(ctx context.Context, username string) (int, error) {
+	var count int
+	err := Database.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE username = ?;`, username).Scan(&count)
+	return count, lookupFailed(ctx, err)
+}
+
+func DeleteUserRow(ctx context.Context, username string) error {
+	stmt, err := Database.Prepare(`DELETE FROM users WHERE username = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting user row", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "User row deleted", "user", username)
+	return nil
+}
+
+func InitialiseUsers(db *sql.DB) {
+	createUsersTable(db)
+	createRecoveryCodesTable(db)
+}
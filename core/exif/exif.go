@@ -3,7 +3,7 @@ package exif
 import (
 	"gallery/core/logic"
 	"gallery/core/types"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,7 +17,7 @@ import (
 func GetSourceMetadataForImagePath(imagePath string) types.ImageMetadata {
 	f, err := os.Open(imagePath)
 	if err != nil {
-		log.Printf("Error opening file %s: %s", imagePath, err)
+		slog.Error("Error opening file", "file", imagePath, "error", err)
 	}
 	defer f.Close()
 
@@ -26,11 +26,12 @@ func GetSourceMetadataForImagePath(imagePath string) types.ImageMetadata {
 	filePath := filepath.Dir(imagePath)
 	fileName := filepath.Base(imagePath)
 	fileTitle := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	dateUploaded := time.Now()
+	// whole seconds, so the date parses again when the metadata row is inserted
+	dateUploaded := time.Now().Truncate(time.Second)
 
 	exifData, err := exif.Decode(f)
 	if err != nil {
-		log.Printf("Error decoding exif data for %s: %s", imagePath, err)
+		slog.Warn("Error decoding exif data", "file", imagePath, "error", err)
 		return defaultImageMetadata(filePath, fileName, fileTitle, dateUploaded)
 	}
 
@@ -140,12 +141,12 @@ func getExifDate(exifData *exif.Exif) (time.Time, error) {
 	if err != nil {
 		tag := getExifTag(exifData, exif.DateTime)
 		if tag == nil {
-			log.Printf("no valid DateTime tag found")
+			slog.Debug("No valid DateTime tag found")
 			return time.Time{}, err
 		}
 		dateTaken, err = time.Parse(time.RFC1123, tag.String())
 		if err != nil {
-			log.Printf("failed to parse DateTime: %v", err)
+			slog.Debug("Failed to parse DateTime", "error", err)
 			return time.Time{}, err
 		}
 	}
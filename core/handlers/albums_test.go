@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"gallery/core/auth"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createProtectedAlbum creates an album with password holding the images in slugs, returning its slug.
+func createProtectedAlbum(t *testing.T, password string, slugs ...string) string {
+	t.Helper()
+	albumSlug, err := database.InsertAlbumRow(t.Context(), types.Album{Name: "Holiday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAlbumPassword(t, albumSlug, password)
+	for _, slug := range slugs {
+		if err := database.InsertAlbumLinkRow(t.Context(), types.Link{AlbumSlug: albumSlug, ImageSlug: slug}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return albumSlug
+}
+
+func setAlbumPassword(t *testing.T, albumSlug string, password string) {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateAlbumPassword(t.Context(), albumSlug, hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unlockAlbum sends password to the album's unlock endpoint from remoteAddr.
+func unlockAlbum(albumSlug string, password string, remoteAddr string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/api/albums/"+albumSlug+"/unlock", strings.NewReader(`{"password": "`+password+`"}`))
+	request.SetPathValue("albumSlug", albumSlug)
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	auth.UnlockAlbumHandler(recorder, request)
+	return recorder
+}
+
+// unlockCookie returns the cookie a browser is given when it unlocks an album.
+func unlockCookie(t *testing.T, recorder *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range recorder.Result().Cookies() {
+		if strings.HasPrefix(cookie.Name, "album_") {
+			return cookie
+		}
+	}
+	t.Fatalf("unlocking album returned %d without a cookie: %s", recorder.Code, recorder.Body)
+	return nil
+}
+
+// getMetadata loads an image's metadata from a browser holding cookie, if it is not nil.
+func getMetadata(slug string, cookie *http.Cookie) int {
+	request := httptest.NewRequest(http.MethodGet, "/api/metadata/"+slug, nil)
+	request.SetPathValue("slug", slug)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	HandleGetMetadataBySlug(recorder, request)
+	return recorder.Code
+}
+
+func TestAlbumPasswordLocksImages(t *testing.T) {
+	setupDatabase(t)
+	insertImage(t, "locked", "2024-06-30 12:00:00", types.VisibilityPublic)
+	insertImage(t, "unlisted", "2024-06-29 12:00:00", types.VisibilityUnlisted)
+	insertImage(t, "also-elsewhere", "2024-06-28 12:00:00", types.VisibilityPublic)
+	insertImage(t, "loose", "2024-06-27 12:00:00", types.VisibilityPublic)
+	albumSlug := createProtectedAlbum(t, "hunter2", "locked", "unlisted", "also-elsewhere")
+	openAlbum, err := database.InsertAlbumRow(t.Context(), types.Album{Name: "Trip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InsertAlbumLinkRow(t.Context(), types.Link{AlbumSlug: openAlbum, ImageSlug: "also-elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if page := getSlugPage(t, "limit=10", nil); !slices.Equal(page.Items, []string{"also-elsewhere", "loose"}) {
+		t.Errorf("listed %v while locked", page.Items)
+	}
+	for slug, status := range map[string]int{"locked": http.StatusNotFound, "unlisted": http.StatusNotFound, "also-elsewhere": http.StatusOK} {
+		if got := getMetadata(slug, nil); got != status {
+			t.Errorf("%s returned %d while locked, want %d", slug, got, status)
+		}
+	}
+
+	unlock := unlockCookie(t, unlockAlbum(albumSlug, "hunter2", "198.51.100.21:1234"))
+	if page := getSlugPage(t, "limit=10", unlock); !slices.Equal(page.Items, []string{"locked", "also-elsewhere", "loose"}) {
+		t.Errorf("listed %v once unlocked", page.Items)
+	}
+	for _, slug := range []string{"locked", "unlisted"} {
+		if status := getMetadata(slug, unlock); status != http.StatusOK {
+			t.Errorf("%s returned %d once unlocked", slug, status)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/thumbnail/locked", nil)
+	request.AddCookie(unlock)
+	if allowed, cached := imageAccess(request, "locked"); !allowed || cached {
+		t.Errorf("unlocked image is allowed: %t, cached by CDNs: %t", allowed, cached)
+	}
+	if _, cached := imageAccess(httptest.NewRequest(http.MethodGet, "/api/thumbnail/also-elsewhere", nil), "also-elsewhere"); !cached {
+		t.Error("image in an album without a password is not cached by CDNs")
+	}
+
+	viewer := loginAs(t, types.RoleViewer)
+	if status := getMetadata("locked", viewer); status != http.StatusOK {
+		t.Errorf("logged in viewer got %d", status)
+	}
+	request = httptest.NewRequest(http.MethodGet, "/api/thumbnail/locked", nil)
+	request.AddCookie(viewer)
+	if _, cached := imageAccess(request, "locked"); cached {
+		t.Error("image in a protected album is cached by CDNs when a viewer loads it")
+	}
+}
+
+func TestAlbumUnlockCookie(t *testing.T) {
+	setupDatabase(t)
+	insertImage(t, "locked", "2024-06-30 12:00:00", types.VisibilityPublic)
+	albumSlug := createProtectedAlbum(t, "hunter2", "locked")
+	otherAlbum := createProtectedAlbum(t, "swordfish")
+
+	if recorder := unlockAlbum(albumSlug, "guess", "198.51.100.22:1234"); recorder.Code != http.StatusUnauthorized || len(recorder.Result().Cookies()) != 0 {
+		t.Errorf("wrong password returned %d with cookies %v", recorder.Code, recorder.Result().Cookies())
+	}
+	unlock := unlockCookie(t, unlockAlbum(albumSlug, "hunter2", "198.51.100.22:1234"))
+	if !unlock.HttpOnly || !unlock.Secure {
+		t.Errorf("unlock cookie is HttpOnly: %t, Secure: %t", unlock.HttpOnly, unlock.Secure)
+	}
+
+	tampered := *unlock
+	tampered.Value = strings.Repeat("0", len(unlock.Value))
+	// the other album's cookie, sent under this album's cookie name
+	swapped := *unlockCookie(t, unlockAlbum(otherAlbum, "swordfish", "198.51.100.22:1234"))
+	swapped.Name = unlock.Name
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "unlock cookie", cookie: unlock, status: http.StatusOK},
+		{name: "tampered cookie", cookie: &tampered, status: http.StatusNotFound},
+		{name: "another album's cookie", cookie: &swapped, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := getMetadata("locked", test.cookie); status != test.status {
+				t.Errorf("returned %d, want %d", status, test.status)
+			}
+		})
+	}
+
+	// the cookie is keyed by the password hash, so changing the password locks the album again
+	setAlbumPassword(t, albumSlug, "correct horse")
+	if status := getMetadata("locked", unlock); status != http.StatusNotFound {
+		t.Errorf("cookie from before the password changed returned %d", status)
+	}
+}
+
+func TestAlbumUnlockIsRateLimited(t *testing.T) {
+	setupDatabase(t)
+	albumSlug := createProtectedAlbum(t, "hunter2")
+	config.LoginMaxAttempts = 2
+	config.LoginLockoutDuration = time.Minute
+	config.LoginMaxLockoutDuration = time.Minute
+	t.Cleanup(func() {
+		config.LoginMaxAttempts = 0
+		config.LoginLockoutDuration = 0
+		config.LoginMaxLockoutDuration = 0
+	})
+
+	// guessed from an address of its own, so the lockout does not reach other tests
+	for range config.LoginMaxAttempts {
+		if recorder := unlockAlbum(albumSlug, "guess", "198.51.100.23:1234"); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password returned %d: %s", recorder.Code, recorder.Body)
+		}
+	}
+	recorder := unlockAlbum(albumSlug, "hunter2", "198.51.100.23:1234")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("the right password after %d wrong ones returned %d", config.LoginMaxAttempts, recorder.Code)
+	}
+	if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("set cookies %v while locked out", cookies)
+	}
+}
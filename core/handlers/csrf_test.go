@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"gallery/core/auth"
+	"gallery/core/config"
+	"gallery/core/types"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// csrfToken returns the CSRF token the gallery hands out for a session cookie.
+func csrfToken(t *testing.T, cookie *http.Cookie) string {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/api/check-session", nil)
+	request.AddCookie(cookie)
+	recorder := httptest.NewRecorder()
+	auth.CheckSessionHandler(recorder, request)
+	token := recorder.Header().Get("X-CSRF-Token")
+	if token == "" {
+		t.Fatalf("check-session returned %d without a CSRF token", recorder.Code)
+	}
+	return token
+}
+
+// serveChange sends a request through AuthMiddleware for an editor's change.
+func serveChange(request *http.Request) int {
+	handler := auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestCsrfOnSessions(t *testing.T) {
+	setupDatabase(t)
+	cookie := loginAs(t, types.RoleEditor)
+	token := csrfToken(t, cookie)
+	// another user's session, whose token must not be accepted for this one
+	otherToken := csrfToken(t, loginAs(t, types.RoleViewer))
+	_, bearer := createToken(t, types.RoleEditor, types.ScopeEdit)
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		status int
+	}{
+		{name: "missing token", method: http.MethodDelete, status: http.StatusForbidden},
+		{name: "wrong token", method: http.MethodDelete, header: otherToken, status: http.StatusForbidden},
+		{name: "token", method: http.MethodDelete, header: token, status: http.StatusNoContent},
+		{name: "safe method without a token", method: http.MethodGet, status: http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, "/api/albums/holiday", nil)
+			request.AddCookie(cookie)
+			if test.header != "" {
+				request.Header.Set("X-CSRF-Token", test.header)
+			}
+			if status := serveChange(request); status != test.status {
+				t.Errorf("returned %d, want %d", status, test.status)
+			}
+		})
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodDelete, "/api/albums/holiday", nil)
+		request.Header.Set("Authorization", "Bearer "+bearer)
+		if status := serveChange(request); status != http.StatusNoContent {
+			t.Errorf("returned %d, want %d", status, http.StatusNoContent)
+		}
+	})
+}
+
+func TestCsrfOnProxyAuthentication(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	config.ProxyAuthHeader = "X-Remote-User"
+	_, proxy, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ProxyAuthCIDRs = []*net.IPNet{proxy}
+	config.CorsAllowedOrigins = []string{"https://app.example.com"}
+	t.Cleanup(func() {
+		config.ProxyAuthHeader = ""
+		config.ProxyAuthCIDRs = nil
+		config.CorsAllowedOrigins = nil
+	})
+
+	tests := []struct {
+		name    string
+		origin  string
+		referer string
+		status  int
+	}{
+		{name: "same origin", origin: "http://example.com", status: http.StatusNoContent},
+		{name: "allowed origin", origin: "https://app.example.com", status: http.StatusNoContent},
+		{name: "other origin", origin: "https://evil.example.com", status: http.StatusForbidden},
+		{name: "same origin referer", referer: "http://example.com/albums/holiday", status: http.StatusNoContent},
+		{name: "other origin referer", referer: "https://evil.example.com/page", status: http.StatusForbidden},
+		{name: "neither", status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodDelete, "/api/albums/holiday", nil)
+			request.Header.Set("X-Remote-User", types.RoleEditor)
+			if test.origin != "" {
+				request.Header.Set("Origin", test.origin)
+			}
+			if test.referer != "" {
+				request.Header.Set("Referer", test.referer)
+			}
+			if status := serveChange(request); status != test.status {
+				t.Errorf("returned %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestLogoutNeedsCsrfToken(t *testing.T) {
+	setupDatabase(t)
+	cookie := loginAs(t, types.RoleViewer)
+	loggedIn := func() bool {
+		request := httptest.NewRequest(http.MethodGet, "/api/check-session", nil)
+		request.AddCookie(cookie)
+		recorder := httptest.NewRecorder()
+		auth.CheckSessionHandler(recorder, request)
+		return recorder.Code == http.StatusOK
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	request.AddCookie(cookie)
+	recorder := httptest.NewRecorder()
+	auth.LogoutHandler(recorder, request)
+	if recorder.Code != http.StatusForbidden || !loggedIn() {
+		t.Fatalf("logout without a CSRF token returned %d", recorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	request.AddCookie(cookie)
+	request.Header.Set("X-CSRF-Token", csrfToken(t, cookie))
+	recorder = httptest.NewRecorder()
+	auth.LogoutHandler(recorder, request)
+	if loggedIn() {
+		t.Errorf("logout with a CSRF token returned %d and kept the session", recorder.Code)
+	}
+}
@@ -1,84 +1,182 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"gallery/core/auth"
+	"gallery/core/config"
 	"gallery/core/database"
 	"gallery/core/image"
 	"gallery/core/net"
 	"gallery/core/optimised"
 	"gallery/core/thumbnails"
 	"gallery/core/types"
-	"log"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// HandleDeleteImageBySlug deletes an image's metadata and its files.
 func HandleDeleteImageBySlug(w http.ResponseWriter, r *http.Request) {
-	slug := r.PathValue("slug")
-	log.Printf("deleting slug %s", slug)
-	w.Header().Set("Content-Type", "application/json")
+	deleteImage(w, r, r.PathValue("slug"))
+}
 
-	err := optimised.DeleteOptimisedBySlug(slug)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+// deleteImage deletes an image's metadata and its files, writing an error and returning false
+// if it could not. Only failing to delete the metadata fails the request; a file that cannot
+// be deleted is logged and left behind.
+func deleteImage(w http.ResponseWriter, r *http.Request, slug string) bool {
+	metadata, err := database.GetMetadataBySlug(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return false
 	}
-
-	err = thumbnails.DeleteThumbnailBySlug(slug)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
+		return false
 	}
+	slog.InfoContext(r.Context(), "Deleting image", "slug", slug)
 
-	filename, err := database.DeleteImageBySlug(slug)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if err := optimised.DeleteOptimisedBySlug(r.Context(), slug); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting optimised image", "slug", slug, "error", err)
 	}
-
-	err = image.DeleteOriginalImage(filename)
+	if err := thumbnails.DeleteThumbnailBySlug(r.Context(), slug); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting thumbnail", "slug", slug, "error", err)
+	}
+	filename, err := database.DeleteImageBySlug(r.Context(), slug)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
+		return false
+	}
+	auth.Audit(r, "image.delete", slug, "", metadata, nil)
+	if err := image.DeleteOriginalImage(r.Context(), filename); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting original", "slug", slug, "error", err)
 	}
+	return true
 }
 
+// HandleGetSlugs lists image slugs newest first. Without limit or cursor it returns every
+// matching slug as an array, otherwise a page with the next cursor and the total.
 func HandleGetSlugs(w http.ResponseWriter, r *http.Request) {
-	slugs, _ := database.GetSlugsOrderedByDateTaken()
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(slugs); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-	}
+	writeSlugListing(w, r, func(slug types.ListedSlug) string {
+		return slug.Slug
+	})
 }
 
+// HandleGetSlugsWithDimensions is HandleGetSlugs with the width and height of each image.
 func HandleGetSlugsWithDimensions(w http.ResponseWriter, r *http.Request) {
-	slugs, _ := database.GetSlugsWithDimensions()
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(slugs); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-	}
+	writeSlugListing(w, r, func(slug types.ListedSlug) types.SlugWithDimensions {
+		return types.SlugWithDimensions{Slug: slug.Slug, Width: slug.Width, Height: slug.Height}
+	})
+}
+
+// HandleGetImages is HandleGetSlugs with what the gallery grid needs to lay out and label
+// each image: its dimensions, title, date taken and a BlurHash placeholder.
+func HandleGetImages(w http.ResponseWriter, r *http.Request) {
+	writeSlugListing(w, r, func(slug types.ListedSlug) types.ListedImage {
+		return slug.ListedImage
+	})
 }
 
 func HandleGetRandomSlugs(w http.ResponseWriter, r *http.Request) {
-	slugs, _ := database.GetSlugsOrderedRandom()
+	slugs, err := database.GetSlugsOrderedRandom(r.Context(), canSeeHidden(r), canSeePending(r), auth.UnlockedAlbums(r))
+	if err != nil {
+		net.InternalError(w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(slugs); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetMetadataBySlug(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("slug")
-	metadata, _ := database.GetMetadataBySlug(slug)
+	if isHiddenImage(r, slug) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	metadata, err := database.GetMetadataBySlug(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		net.InternalError(w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(metadata); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
+	}
+}
+
+// HandlePostMetadataBatch returns the metadata, dimensions, tags and albums of many images
+// at once, in the order they were asked for. Images that do not exist or that the request
+// cannot see are left out.
+func HandlePostMetadataBatch(w http.ResponseWriter, r *http.Request) {
+	type Batch struct {
+		Slugs []string `json:"slugs"`
+	}
+	var batch Batch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Slugs) > maxSlugPageSize {
+		net.Error(w, "At most "+strconv.Itoa(maxSlugPageSize)+" slugs can be requested at once", http.StatusBadRequest)
+		return
+	}
+
+	images, err := database.GetImageDetails(r.Context(), batch.Slugs)
+	if err != nil {
+		net.InternalError(w)
+		return
+	}
+
+	var share *types.ShareLink
+	if r.URL.Query().Has("share") {
+		if link, ok := auth.RequestShareLink(r); ok {
+			share = &link
+		}
+	}
+	includeHidden := canSeeHidden(r)
+	visible := []types.ImageDetails{}
+	for _, image := range images {
+		if !imageDetailsAccess(r, image, share) {
+			continue
+		}
+		for _, album := range image.InAlbums {
+			if includeHidden || album.Visibility != types.VisibilityPrivate {
+				image.Albums = append(image.Albums, album.Slug)
+			}
+		}
+		visible = append(visible, image)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(visible); err != nil {
+		net.InternalError(w)
 	}
 }
 
 func HandleGetThumbnailBySlug(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("slug")
-	thumbnail, err := thumbnails.GetThumbnailBySlug(slug)
+	allowed, public := imageAccess(r, slug)
+	if !allowed {
+		net.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	thumbnail, err := thumbnails.GetThumbnailBySlug(r.Context(), slug)
 	if err != nil {
-		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		net.Error(w, "Thumbnail not found", http.StatusNotFound)
 		return
 	}
-	net.EnableCdnCaching(w)
+	setImageCaching(w, public)
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(thumbnail)
@@ -86,32 +184,40 @@ func HandleGetThumbnailBySlug(w http.ResponseWriter, r *http.Request) {
 
 func HandleGetAlbum(w http.ResponseWriter, r *http.Request) {
 	albumSlug := r.PathValue("albumSlug")
-	album, err := database.GetAlbum(albumSlug)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	album, ok := getAlbum(w, r, albumSlug)
+	if !ok {
+		return
+	}
+	if !checkAlbumAccess(w, r, album) {
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(album); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetAllAlbums(w http.ResponseWriter, r *http.Request) {
-	albums := database.GetAllAlbums()
+	albums := database.GetAllAlbums(r.Context(), canSeeHidden(r))
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(albums); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetOptimisedBySlug(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("slug")
-	optimised, err := optimised.GetOptimisedBySlug(slug)
+	allowed, public := imageAccess(r, slug)
+	if !allowed {
+		net.Error(w, "Optimised not found", http.StatusNotFound)
+		return
+	}
+	optimised, err := optimised.GetOptimisedBySlug(r.Context(), slug)
 	if err != nil {
-		http.Error(w, "Optimised not found", http.StatusNotFound)
+		net.Error(w, "Optimised not found", http.StatusNotFound)
 		return
 	}
-	net.EnableCdnCaching(w)
+	setImageCaching(w, public)
 	w.Header().Set("Content-Type", "image/jpeg")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(optimised)
@@ -119,15 +225,27 @@ func HandleGetOptimisedBySlug(w http.ResponseWriter, r *http.Request) {
 
 func HandleGetOriginalImageBlobBySlug(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("slug")
-	imageBlob, err := database.GetOriginalImageBlobBySlug(slug)
+	allowed, public := imageAccess(r, slug)
+	if !allowed {
+		net.Error(w, "Original image not found", http.StatusNotFound)
+		return
+	}
+	imageBlob, err := database.GetOriginalImageBlobBySlug(r.Context(), slug)
 
 	if err != nil {
-		http.Error(w, "Original image not found", http.StatusNotFound)
+		net.Error(w, "Original image not found", http.StatusNotFound)
 		return
 	}
+	// originals are only ever served as images, so a file that is not one, such as HTML
+	// placed in the image directory, is downloaded rather than rendered on this origin
 	mimeType := http.DetectContentType(imageBlob)
-	net.EnableCdnCaching(w)
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	setImageCaching(w, public)
 	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(imageBlob)
 }
@@ -137,28 +255,58 @@ func HandlePatchMetadataBySlug(w http.ResponseWriter, r *http.Request) {
 
 	var updates map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if err := database.UpdateMetadataBySlug(slug, updates); err != nil {
-		log.Printf("Failed to update metadata: %s", err)
-		http.Error(w, "Failed to update metadata", http.StatusInternalServerError)
+	if !imageExists(w, r, slug) {
+		return
+	}
+	if value, ok := updates["visibility"]; ok && !isVisibility(value) {
+		net.Error(w, "visibility must be one of public, unlisted or private", http.StatusBadRequest)
+		return
+	}
+	if !updateMetadata(w, r, slug, updates) {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Metadata updated successfully"))
 }
 
+// updateMetadata applies updates, keyed by column name, to an image's metadata and records
+// the change in the audit log, writing an error and returning false if it could not.
+func updateMetadata(w http.ResponseWriter, r *http.Request, slug string, updates map[string]interface{}) bool {
+	before := getMetadataValues(r.Context(), slug, updates)
+	err := database.UpdateMetadataBySlug(r.Context(), slug, updates)
+	var unknownField *database.UnknownFieldError
+	if errors.As(err, &unknownField) {
+		net.ErrorWithDetails(w, unknownField.Error(), http.StatusBadRequest, map[string]string{"field": unknownField.Field})
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update metadata", "slug", slug, "error", err)
+		net.Error(w, "Failed to update metadata", http.StatusInternalServerError)
+		return false
+	}
+	auth.Audit(r, "metadata.update", slug, "", before, updates)
+	return true
+}
+
 func HandlePostAlbumRow(w http.ResponseWriter, r *http.Request) {
 	var updates types.Album
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if err := database.InsertAlbumRow(updates); err != nil {
-		http.Error(w, "Failed to post album", http.StatusInternalServerError)
+	if updates.Visibility != "" && !isVisibility(updates.Visibility) {
+		net.Error(w, "Visibility must be one of public, unlisted or private", http.StatusBadRequest)
 		return
 	}
+	albumSlug, err := database.InsertAlbumRow(r.Context(), updates)
+	if err != nil {
+		net.Error(w, "Failed to post album", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "album.create", albumSlug, albumSlug, nil, updates)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Album posted successfully"))
 }
@@ -166,13 +314,18 @@ func HandlePostAlbumRow(w http.ResponseWriter, r *http.Request) {
 func HandlePostLinkRow(w http.ResponseWriter, r *http.Request) {
 	var updates types.Link
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if err := database.InsertAlbumLinkRow(updates); err != nil {
-		http.Error(w, "Failed to insert link", http.StatusInternalServerError)
+	if err := database.InsertAlbumLinkRow(r.Context(), updates); err != nil {
+		if database.IsDuplicate(err) {
+			net.Error(w, "Image is already in the album", http.StatusConflict)
+			return
+		}
+		net.Error(w, "Failed to insert link", http.StatusInternalServerError)
 		return
 	}
+	auth.Audit(r, "link.create", updates.ImageSlug, updates.AlbumSlug, nil, nil)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Link row inserted successfully"))
 }
@@ -180,13 +333,14 @@ func HandlePostLinkRow(w http.ResponseWriter, r *http.Request) {
 func HandleDeleteAlbumLinkRow(w http.ResponseWriter, r *http.Request) {
 	var updates types.Link
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if err := database.DeleteAlbumLinkRow(updates); err != nil {
-		http.Error(w, "Failed to insert link", http.StatusInternalServerError)
+	if err := database.DeleteAlbumLinkRow(r.Context(), updates); err != nil {
+		net.Error(w, "Failed to insert link", http.StatusInternalServerError)
 		return
 	}
+	auth.Audit(r, "link.delete", updates.ImageSlug, updates.AlbumSlug, nil, nil)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Link row inserted successfully"))
 }
@@ -195,19 +349,21 @@ func HandlePostLinkRows(w http.ResponseWriter, r *http.Request) {
 	var updates types.Links
 
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
 
-	for _, imageSlug := range updates.ImageSlugs {
-		update := types.Link{
-			AlbumSlug: updates.AlbumSlug,
-			ImageSlug: imageSlug,
-		}
-		if err := database.InsertAlbumLinkRow(update); err != nil {
-			http.Error(w, "Failed to insert link: "+err.Error(), http.StatusInternalServerError)
+	if imageSlug, err := database.InsertAlbumLinkRows(r.Context(), updates.AlbumSlug, updates.ImageSlugs); err != nil {
+		if database.IsDuplicate(err) {
+			net.ErrorWithDetails(w, "Image is already in the album", http.StatusConflict, map[string]string{"imageSlug": imageSlug})
 			return
 		}
+		slog.ErrorContext(r.Context(), "Failed to insert links", "albumSlug", updates.AlbumSlug, "imageSlug", imageSlug, "error", err)
+		net.InternalError(w)
+		return
+	}
+	for _, imageSlug := range updates.ImageSlugs {
+		auth.Audit(r, "link.create", imageSlug, updates.AlbumSlug, nil, nil)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -221,13 +377,19 @@ func HandlePatchAlbumCover(w http.ResponseWriter, r *http.Request) {
 	}
 	var updates CoverUpdate
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	album, ok := getAlbum(w, r, updates.AlbumSlug)
+	if !ok {
 		return
 	}
-	if err := database.UpdateAlbumCover(updates.AlbumSlug, updates.CoverSlug); err != nil {
-		http.Error(w, "Failed to insert link: "+err.Error(), http.StatusInternalServerError)
+	if err := database.UpdateAlbumCover(r.Context(), updates.AlbumSlug, updates.CoverSlug); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update album cover", "albumSlug", updates.AlbumSlug, "error", err)
+		net.InternalError(w)
 		return
 	}
+	auth.Audit(r, "album.cover", updates.AlbumSlug, updates.AlbumSlug, map[string]string{"coverSlug": album.CoverSlug}, map[string]string{"coverSlug": updates.CoverSlug})
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Cover rows updated successfully"))
 }
@@ -239,115 +401,327 @@ func HandlePatchAlbumName(w http.ResponseWriter, r *http.Request) {
 	}
 	var update AlbumNameUpdate
 	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
-	if err := database.UpdateAlbumName(update.AlbumSlug, update.AlbumName); err != nil {
-		http.Error(w, "Failed to udpate Album Name: "+err.Error(), http.StatusInternalServerError)
+	album, ok := getAlbum(w, r, update.AlbumSlug)
+	if !ok {
 		return
 	}
+	if err := database.UpdateAlbumName(r.Context(), update.AlbumSlug, update.AlbumName); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update album name", "albumSlug", update.AlbumSlug, "error", err)
+		net.InternalError(w)
+		return
+	}
+	auth.Audit(r, "album.rename", update.AlbumSlug, update.AlbumSlug, map[string]string{"name": album.Name}, map[string]string{"name": update.AlbumName})
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Album Name updated successfully"))
 }
 
+func HandlePatchAlbumVisibility(w http.ResponseWriter, r *http.Request) {
+	type AlbumVisibilityUpdate struct {
+		AlbumSlug  string
+		Visibility string
+	}
+	var update AlbumVisibilityUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if !isVisibility(update.Visibility) {
+		net.Error(w, "Visibility must be one of public, unlisted or private", http.StatusBadRequest)
+		return
+	}
+	album, ok := getAlbum(w, r, update.AlbumSlug)
+	if !ok {
+		return
+	}
+	if err := database.UpdateAlbumVisibility(r.Context(), update.AlbumSlug, update.Visibility); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update album visibility", "albumSlug", update.AlbumSlug, "error", err)
+		net.InternalError(w)
+		return
+	}
+	auth.Audit(r, "album.visibility", update.AlbumSlug, update.AlbumSlug, map[string]string{"visibility": album.Visibility}, map[string]string{"visibility": update.Visibility})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Album visibility updated successfully"))
+}
+
+func HandlePatchAlbumPassword(w http.ResponseWriter, r *http.Request) {
+	type AlbumPasswordUpdate struct {
+		AlbumSlug string
+		Password  string
+	}
+	var update AlbumPasswordUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	album, ok := getAlbum(w, r, update.AlbumSlug)
+	if !ok {
+		return
+	}
+
+	var err error
+	passwordHash := ""
+	if update.Password != "" {
+		passwordHash, err = auth.HashPassword(update.Password)
+		if err != nil {
+			net.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := database.UpdateAlbumPassword(r.Context(), update.AlbumSlug, passwordHash); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update album password", "albumSlug", update.AlbumSlug, "error", err)
+		net.InternalError(w)
+		return
+	}
+	auth.Audit(r, "album.password", update.AlbumSlug, update.AlbumSlug, map[string]bool{"protected": album.Protected}, map[string]bool{"protected": passwordHash != ""})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Album password updated successfully"))
+}
+
 func HandleDeleteAlbumRow(w http.ResponseWriter, r *http.Request) {
 	albumSlug := r.PathValue("albumSlug")
-	if err := database.DeleteAlbumRow(albumSlug); err != nil {
-		http.Error(w, "Failed to delete album", http.StatusInternalServerError)
+	album, ok := getAlbum(w, r, albumSlug)
+	if !ok {
+		return
+	}
+	if err := database.DeleteAlbumRow(r.Context(), albumSlug); err != nil {
+		net.Error(w, "Failed to delete album", http.StatusInternalServerError)
 		return
 	}
+	auth.Audit(r, "album.delete", albumSlug, albumSlug, album, nil)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Album deleted successfully"))
 }
 
 func HandleGetAlbumLinks(w http.ResponseWriter, r *http.Request) {
 	slug := r.PathValue("albumSlug")
-	links, err := database.GetAlbumLinks(slug)
+	album, ok := getAlbum(w, r, slug)
+	if !ok || !checkAlbumAccess(w, r, album) {
+		return
+	}
+	links, err := database.GetAlbumLinks(r.Context(), slug, canSeeHidden(r), canSeePending(r))
 
 	if err != nil {
-		http.Error(w, "Failed to retrieve album links", http.StatusInternalServerError)
+		net.Error(w, "Failed to retrieve album links", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(links); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetImageLinks(w http.ResponseWriter, r *http.Request) {
-	slug := r.PathValue("imageSlug")
-	links, err := database.GetImageLinks(slug)
+	slug := r.PathValue("slug")
+	if isHiddenImage(r, slug) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	links, err := database.GetImageLinks(r.Context(), slug, canSeeHidden(r))
 
 	if err != nil {
-		http.Error(w, "Failed to retrieve image links", http.StatusInternalServerError)
+		net.Error(w, "Failed to retrieve image links", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(links); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandlePostNewImage(w http.ResponseWriter, r *http.Request) {
 	file, fileHeader, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+		net.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
 	title := r.FormValue("title")
 	if title == "" {
-		http.Error(w, "Title is required", http.StatusBadRequest)
+		net.Error(w, "Title is required", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := auth.GetUser(r)
+	if user.Role == types.RoleUploader {
+		handleGuestUpload(w, r, user, file, fileHeader, title)
 		return
 	}
 
-	slug := image.UploadImage(file, fileHeader)
+	slug, err := image.UploadImage(r.Context(), file, fileHeader, types.VisibilityPublic, false)
+	if errors.Is(err, image.ErrUnsupportedImage) {
+		unsupportedImage(w, fileHeader)
+		return
+	}
+	if errors.Is(err, image.ErrDuplicateImage) {
+		net.ErrorWithDetails(w, "An image with this file name already exists", http.StatusConflict, map[string]string{"fileName": fileHeader.Filename})
+		return
+	}
+	if err != nil {
+		net.Error(w, "Failed to upload image", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "image.upload", slug, "", nil, map[string]string{"fileName": fileHeader.Filename, "title": title})
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(slug); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
+// handleGuestUpload adds an uploader's image to their drop-box album as a private
+// image, and queues it for an admin to approve before anyone else can see it.
+func handleGuestUpload(w http.ResponseWriter, r *http.Request, user types.User, file multipart.File, fileHeader *multipart.FileHeader, title string) {
+	if _, err := database.GetAlbum(r.Context(), user.UploadAlbum); err != nil {
+		net.Error(w, "Upload album not found", http.StatusForbidden)
+		return
+	}
+
+	slug, err := image.UploadImage(r.Context(), file, fileHeader, types.VisibilityPrivate, true)
+	if errors.Is(err, image.ErrUnsupportedImage) {
+		unsupportedImage(w, fileHeader)
+		return
+	}
+	if err != nil {
+		net.Error(w, "Failed to upload image", http.StatusInternalServerError)
+		return
+	}
+	if err := database.InsertAlbumLinkRow(r.Context(), types.Link{AlbumSlug: user.UploadAlbum, ImageSlug: slug}); err != nil {
+		net.Error(w, "Failed to add image to album", http.StatusInternalServerError)
+		return
+	}
+	if err := database.InsertModerationRow(r.Context(), slug, user.UploadAlbum, user.Username); err != nil {
+		net.Error(w, "Failed to queue image for moderation", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "image.upload", slug, user.UploadAlbum, nil, map[string]string{"fileName": fileHeader.Filename, "title": title})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(slug); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode uploaded slug", "error", err)
+	}
+}
+
+// unsupportedImage writes the 400 for an upload that UploadImage rejected as not an image.
+func unsupportedImage(w http.ResponseWriter, fileHeader *multipart.FileHeader) {
+	allowed := strings.Join(config.ImageExtensions, ", ")
+	net.ErrorWithDetails(w, "File must be an image with one of the extensions "+allowed, http.StatusBadRequest, map[string]string{"fileName": fileHeader.Filename})
+}
+
+func HandleGetPendingUploads(w http.ResponseWriter, r *http.Request) {
+	uploads, err := database.GetPendingUploads(r.Context())
+	if err != nil {
+		net.Error(w, "Failed to retrieve moderation queue", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(uploads); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandleApprovePendingUpload(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	upload, err := database.GetPendingUpload(r.Context(), slug)
+	if err != nil {
+		net.Error(w, "Pending upload not found", http.StatusNotFound)
+		return
+	}
+	// the upload takes the drop-box album's visibility, so a private drop-box stays private
+	visibility := types.VisibilityPrivate
+	if album, err := database.GetAlbum(r.Context(), upload.AlbumSlug); err == nil {
+		visibility = album.Visibility
+	}
+	if err := database.UpdateMetadataBySlug(r.Context(), slug, map[string]interface{}{"visibility": visibility}); err != nil {
+		net.Error(w, "Failed to approve upload", http.StatusInternalServerError)
+		return
+	}
+	if err := database.DeleteModerationRow(r.Context(), slug); err != nil {
+		net.Error(w, "Failed to approve upload", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "upload.approve", slug, upload.AlbumSlug, upload, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Upload approved successfully"))
+}
+
+// HandleRejectPendingUpload deletes a pending upload, along with its derived images and original file.
+func HandleRejectPendingUpload(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	upload, err := database.GetPendingUpload(r.Context(), slug)
+	if err != nil {
+		net.Error(w, "Pending upload not found", http.StatusNotFound)
+		return
+	}
+	if err := optimised.DeleteOptimisedBySlug(r.Context(), slug); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting optimised image for rejected upload", "slug", slug, "error", err)
+	}
+	if err := thumbnails.DeleteThumbnailBySlug(r.Context(), slug); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting thumbnail for rejected upload", "slug", slug, "error", err)
+	}
+	filename, err := database.DeleteImageBySlug(r.Context(), slug)
+	if err != nil {
+		net.Error(w, "Failed to reject upload", http.StatusInternalServerError)
+		return
+	}
+	if err := image.DeleteOriginalImage(r.Context(), filename); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting original for rejected upload", "slug", slug, "error", err)
+	}
+	auth.Audit(r, "upload.reject", slug, upload.AlbumSlug, upload, nil)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Upload rejected successfully"))
+}
+
 func HandleGetTags(w http.ResponseWriter, r *http.Request) {
-	tags, err := database.GetAllTags()
+	tags, err := database.GetAllTags(r.Context(), canSeeHidden(r), canSeePending(r))
 
 	if err != nil {
-		http.Error(w, "Failed to retrieve tags", http.StatusInternalServerError)
+		net.Error(w, "Failed to retrieve tags", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(tags); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetTagsBySlug(w http.ResponseWriter, r *http.Request) {
-	slug := r.PathValue("imageSlug")
-	tags, err := database.GetTagsForSlug(slug)
+	slug := r.PathValue("slug")
+	if isHiddenImage(r, slug) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	tags, err := database.GetTagsForSlug(r.Context(), slug)
 
 	if err != nil {
-		http.Error(w, "Failed to retrieve tags for slug", http.StatusInternalServerError)
+		net.Error(w, "Failed to retrieve tags for slug", http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(tags); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
 func HandleGetSlugsByTag(w http.ResponseWriter, r *http.Request) {
 	tag := r.PathValue("tag")
-	slugs, err := database.GetSlugsForTag(tag)
-
-	w.Header().Set("Content-Type", "application/json")
-
-	if err != nil || slugs == nil {
+	slugs, err := database.GetSlugsForTag(r.Context(), tag, canSeeHidden(r), canSeePending(r), auth.UnlockedAlbums(r))
+	if err != nil {
+		net.InternalError(w)
+		return
+	}
+	if slugs == nil {
 		slugs = []string{}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+
 	if err := json.NewEncoder(w).Encode(slugs); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
 	}
 }
 
@@ -355,19 +729,21 @@ func HandlePostNewTags(w http.ResponseWriter, r *http.Request) {
 	var updates types.Tags
 
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
 
-	for _, imageSlug := range updates.ImageSlugs {
-		update := types.Tag{
-			Tag:       updates.Tag,
-			ImageSlug: imageSlug,
-		}
-		if err := database.InsertTagsRow(update); err != nil {
-			http.Error(w, "Failed to insert tag: "+err.Error(), http.StatusInternalServerError)
+	if imageSlug, err := database.InsertTagRows(r.Context(), updates.Tag, updates.ImageSlugs); err != nil {
+		if database.IsDuplicate(err) {
+			net.ErrorWithDetails(w, "Image already has the tag", http.StatusConflict, map[string]string{"imageSlug": imageSlug})
 			return
 		}
+		slog.ErrorContext(r.Context(), "Failed to insert tags", "imageSlug", imageSlug, "error", err)
+		net.InternalError(w)
+		return
+	}
+	for _, imageSlug := range updates.ImageSlugs {
+		auth.Audit(r, "tag.create", imageSlug, "", nil, map[string]string{"tag": updates.Tag})
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -378,28 +754,224 @@ func HandleDeleteTagRow(w http.ResponseWriter, r *http.Request) {
 	var updates types.Tag
 
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
 
-	if err := database.DeleteTagsRow(updates); err != nil {
-		http.Error(w, "Failed to delete tag row", http.StatusInternalServerError)
+	if err := database.DeleteTagsRow(r.Context(), updates); err != nil {
+		net.Error(w, "Failed to delete tag row", http.StatusInternalServerError)
 		return
 	}
+	auth.Audit(r, "tag.delete", updates.ImageSlug, "", map[string]string{"tag": updates.Tag}, nil)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("Tag deleted successfully"))
 }
 
 func HandleGetDimensionsBySlug(w http.ResponseWriter, r *http.Request) {
-	slug := r.PathValue("imageSlug")
-	dimensions, err := database.GetDimensionForSlug(slug)
-
+	slug := r.PathValue("slug")
+	if isHiddenImage(r, slug) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	dimensions, err := database.GetDimensionForSlug(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		net.Error(w, "Dimensions not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to retrieve dimensions for slug", http.StatusInternalServerError)
+		net.Error(w, "Failed to retrieve dimensions for slug", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(dimensions); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		net.InternalError(w)
+	}
+}
+
+// getMetadataValues returns the current values of the metadata fields about to be updated, for the audit log.
+func getMetadataValues(ctx context.Context, slug string, updates map[string]interface{}) map[string]interface{} {
+	metadata, err := database.GetMetadataBySlug(ctx, slug)
+	if err != nil {
+		return nil
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil
+	}
+	var current map[string]interface{}
+	if err := json.Unmarshal(encoded, &current); err != nil {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	for field := range updates {
+		for key, value := range current {
+			if strings.EqualFold(key, field) {
+				values[field] = value
+			}
+		}
+	}
+	return values
+}
+
+func isVisibility(value any) bool {
+	visibility, ok := value.(string)
+	return ok && slices.Contains(types.Visibilities, visibility)
+}
+
+// canSeeHidden reports whether the request comes from a logged in user, who can see unlisted and private items.
+// Guest uploaders cannot.
+func canSeeHidden(r *http.Request) bool {
+	user, ok := auth.RequestUser(r)
+	return ok && auth.HasRole(user.Role, types.RoleViewer)
+}
+
+// canSeePending reports whether the request comes from an admin, who can see uploads waiting for moderation.
+func canSeePending(r *http.Request) bool {
+	user, ok := auth.RequestUser(r)
+	return ok && auth.HasRole(user.Role, types.RoleAdmin)
+}
+
+// getAlbum loads an album, writing a 404 and returning false if there is no such album.
+func getAlbum(w http.ResponseWriter, r *http.Request, albumSlug string) (types.Album, bool) {
+	album, err := database.GetAlbum(r.Context(), albumSlug)
+	if errors.Is(err, sql.ErrNoRows) {
+		net.Error(w, "Album not found", http.StatusNotFound)
+		return album, false
+	}
+	if err != nil {
+		net.InternalError(w)
+		return album, false
+	}
+	return album, true
+}
+
+// imageExists writes a 404 and returns false if there is no image with slug.
+func imageExists(w http.ResponseWriter, r *http.Request, slug string) bool {
+	_, err := database.GetImageVisibility(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		net.Error(w, "Image not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		net.InternalError(w)
+		return false
+	}
+	return true
+}
+
+// checkAlbumAccess writes an error and returns false when the request may not open an album.
+// Private albums need a logged in user, and password protected albums need the album's unlock cookie.
+func checkAlbumAccess(w http.ResponseWriter, r *http.Request, album types.Album) bool {
+	if canSeeHidden(r) {
+		return true
+	}
+	if album.Visibility == types.VisibilityPrivate {
+		net.Error(w, "Album not found", http.StatusNotFound)
+		return false
+	}
+	if album.Protected && !auth.HasAlbumUnlock(r, album) {
+		net.Error(w, "Album is password protected", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isHiddenImage reports whether slug is an image the request is not allowed to see.
+func isHiddenImage(r *http.Request, slug string) bool {
+	allowed, _ := imageAccess(r, slug)
+	return !allowed
+}
+
+// albumLocked reports whether slug is only reachable through password protected albums,
+// and if so whether none of them have been unlocked by the request.
+func albumLocked(r *http.Request, slug string) (bool, bool) {
+	albums, err := database.GetAlbumsForImage(r.Context(), slug)
+	if err != nil {
+		return true, true
+	}
+	if len(albums) == 0 {
+		return false, false
+	}
+	for _, album := range albums {
+		if !album.Protected {
+			return false, false
+		}
+	}
+	for _, album := range albums {
+		if auth.HasAlbumUnlock(r, album) {
+			return true, false
+		}
+	}
+	return true, true
+}
+
+// imageAccess reports whether the request may load an image file, and whether the
+// response may be kept in shared caches. Requests carrying a share token are checked
+// against the images the link was created for, as the token alone is not enough to view them.
+// Uploads waiting for moderation are only shown to admins, and images that are only in
+// password protected albums need one of those albums unlocked unless the request is logged in.
+func imageAccess(r *http.Request, slug string) (bool, bool) {
+	if !canSeePending(r) {
+		if pending, err := database.IsPendingUpload(r.Context(), slug); err != nil || pending {
+			return false, false
+		}
+	}
+	if r.URL.Query().Has("share") {
+		return auth.ShareLinkAllows(r, slug), false
+	}
+	visibility, err := database.GetImageVisibility(r.Context(), slug)
+	if err != nil {
+		return false, false
+	}
+	if visibility == types.VisibilityPrivate {
+		return canSeeHidden(r), false
+	}
+	protected, locked := albumLocked(r, slug)
+	if locked && !canSeeHidden(r) {
+		return false, false
+	}
+	// only public images outside password protected albums are cached by CDNs, as a CDN
+	// would serve the others to everyone
+	return true, visibility == types.VisibilityPublic && !protected
+}
+
+// imageDetailsAccess is imageAccess for an image whose visibility and albums have already
+// been loaded, so checking a batch of images needs no further queries. share is the opened
+// share link of a request with a "share" parameter, or nil.
+func imageDetailsAccess(r *http.Request, image types.ImageDetails, share *types.ShareLink) bool {
+	if image.Pending && !canSeePending(r) {
+		return false
+	}
+	if r.URL.Query().Has("share") {
+		if share == nil {
+			return false
+		}
+		if share.ImageSlug != "" {
+			return share.ImageSlug == image.Slug
+		}
+		return slices.ContainsFunc(image.InAlbums, func(album types.Album) bool {
+			return album.Slug == share.AlbumSlug
+		})
+	}
+	if image.Visibility == types.VisibilityPrivate {
+		return canSeeHidden(r)
+	}
+	if !canSeeHidden(r) && len(image.InAlbums) > 0 {
+		for _, album := range image.InAlbums {
+			if !album.Protected || auth.HasAlbumUnlock(r, album) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func setImageCaching(w http.ResponseWriter, public bool) {
+	if public {
+		net.EnableCdnCaching(w)
+	} else {
+		net.EnablePrivateCaching(w)
 	}
 }
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMetadataBatchLeavesOutHiddenImages(t *testing.T) {
+	setupDatabase(t)
+	insertImage(t, "public", "2024-06-30 12:00:00", types.VisibilityPublic)
+	insertImage(t, "unlisted", "2024-06-29 12:00:00", types.VisibilityUnlisted)
+	insertImage(t, "private", "2024-06-28 12:00:00", types.VisibilityPrivate)
+	insertImage(t, "pending", "2024-06-27 12:00:00", types.VisibilityPrivate)
+	if err := database.InsertModerationRow(t.Context(), "pending", "", "guest"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   []string
+	}{
+		{name: "anonymous", want: []string{"unlisted", "public"}},
+		{name: "viewer", cookie: loginAs(t, types.RoleViewer), want: []string{"private", "unlisted", "public"}},
+		{name: "admin", cookie: loginAs(t, types.RoleAdmin), want: []string{"private", "unlisted", "public", "pending"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"slugs": ["private", "unlisted", "public", "pending", "missing"]}`
+			request := httptest.NewRequest(http.MethodPost, "/api/metadata/batch", strings.NewReader(body))
+			if test.cookie != nil {
+				request.AddCookie(test.cookie)
+			}
+			recorder := httptest.NewRecorder()
+			HandlePostMetadataBatch(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("returned %d: %s", recorder.Code, recorder.Body)
+			}
+
+			var images []types.ImageDetails
+			if err := json.Unmarshal(recorder.Body.Bytes(), &images); err != nil {
+				t.Fatal(err)
+			}
+			slugs := []string{}
+			for _, image := range images {
+				slugs = append(slugs, image.Slug)
+			}
+			if !slices.Equal(slugs, test.want) {
+				t.Errorf("returned %v, want %v", slugs, test.want)
+			}
+		})
+	}
+}
+
+// uploadRequest returns a request uploading content as fileName.
+func uploadRequest(t *testing.T, fileName string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("title", fileName); err != nil {
+		t.Fatal(err)
+	}
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	return request
+}
+
+func TestUploadRejectsFilesThatAreNotImages(t *testing.T) {
+	setupDatabase(t)
+	config.ImageDirectory = t.TempDir()
+	config.ThumbnailDirectory = t.TempDir()
+	config.OptimisedDirectory = t.TempDir()
+	config.ImageExtensions = []string{".jpg", ".png"}
+	config.ThumbnailMaxPixels = 16
+	config.OptimisedMaxPixels = 16
+
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	page := []byte("<!DOCTYPE html><script>alert(document.cookie)</script>")
+
+	tests := []struct {
+		name     string
+		fileName string
+		content  []byte
+		status   int
+	}{
+		{name: "image", fileName: "picture.png", content: picture.Bytes(), status: http.StatusOK},
+		{name: "html", fileName: "page.html", content: page, status: http.StatusBadRequest},
+		{name: "html named as an image", fileName: "page.jpg", content: page, status: http.StatusBadRequest},
+		{name: "image with another extension", fileName: "picture.svg", content: picture.Bytes(), status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			HandlePostNewImage(recorder, uploadRequest(t, test.fileName, test.content))
+			if recorder.Code != test.status {
+				t.Fatalf("returned %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			_, err := os.Stat(filepath.Join(config.ImageDirectory, test.fileName))
+			if saved := err == nil; saved != (test.status == http.StatusOK) {
+				t.Errorf("saved the original: %t", saved)
+			}
+		})
+	}
+}
+
+func TestOriginalIsServedAsAnImage(t *testing.T) {
+	setupDatabase(t)
+	config.ImageDirectory = t.TempDir()
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"picture": picture.Bytes(),
+		"page":    []byte("<!DOCTYPE html><script>alert(document.cookie)</script>"),
+	}
+	for slug, content := range files {
+		if err := os.WriteFile(filepath.Join(config.ImageDirectory, slug+".jpg"), content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		insertImage(t, slug, "2024-06-30 12:00:00", types.VisibilityPublic)
+		if _, err := database.Database.Exec("UPDATE metadata SET filePath = ? WHERE slug = ?;", config.ImageDirectory, slug); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		slug        string
+		contentType string
+		disposition string
+	}{
+		{slug: "picture", contentType: "image/png"},
+		{slug: "page", contentType: "application/octet-stream", disposition: "attachment"},
+	}
+	for _, test := range tests {
+		t.Run(test.slug, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/original/"+test.slug, nil)
+			request.SetPathValue("slug", test.slug)
+			recorder := httptest.NewRecorder()
+			HandleGetOriginalImageBlobBySlug(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("returned %d: %s", recorder.Code, recorder.Body)
+			}
+			header := recorder.Header()
+			if header.Get("Content-Type") != test.contentType {
+				t.Errorf("Content-Type is %q, want %q", header.Get("Content-Type"), test.contentType)
+			}
+			if header.Get("Content-Disposition") != test.disposition {
+				t.Errorf("Content-Disposition is %q, want %q", header.Get("Content-Disposition"), test.disposition)
+			}
+			if header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("X-Content-Type-Options is %q", header.Get("X-Content-Type-Options"))
+			}
+		})
+	}
+}
+
+func TestOnlyPublicImagesAreCachedByCdns(t *testing.T) {
+	setupDatabase(t)
+	config.ImageDirectory = t.TempDir()
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	for _, visibility := range types.Visibilities {
+		if err := os.WriteFile(filepath.Join(config.ImageDirectory, visibility+".png"), picture.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		insertImage(t, visibility, "2024-06-30 12:00:00", visibility)
+		if _, err := database.Database.Exec("UPDATE metadata SET filePath = ?, fileName = ? WHERE slug = ?;", config.ImageDirectory, visibility+".png", visibility); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cookie := loginAs(t, types.RoleViewer)
+
+	for _, visibility := range types.Visibilities {
+		t.Run(visibility, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/original/"+visibility, nil)
+			request.SetPathValue("slug", visibility)
+			request.AddCookie(cookie)
+			recorder := httptest.NewRecorder()
+			HandleGetOriginalImageBlobBySlug(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("returned %d: %s", recorder.Code, recorder.Body)
+			}
+			cacheControl := recorder.Header().Get("Cache-Control")
+			if shared := strings.HasPrefix(cacheControl, "public"); shared != (visibility == types.VisibilityPublic) {
+				t.Errorf("Cache-Control is %q", cacheControl)
+			}
+		})
+	}
+}
+
+func TestBatchChangesAreAllOrNothing(t *testing.T) {
+	setupDatabase(t)
+	insertImage(t, "new", "2024-06-30 12:00:00", types.VisibilityPublic)
+	insertImage(t, "existing", "2024-06-29 12:00:00", types.VisibilityPublic)
+	albumSlug, err := database.InsertAlbumRow(t.Context(), types.Album{Name: "Holiday", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InsertAlbumLinkRow(t.Context(), types.Link{AlbumSlug: albumSlug, ImageSlug: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InsertTagsRow(t.Context(), types.Tag{Tag: "beach", ImageSlug: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		added   func() bool
+	}{
+		{
+			name:    "links",
+			handler: HandlePostLinkRows,
+			body:    `{"AlbumSlug": "` + albumSlug + `", "ImageSlugs": ["new", "existing"]}`,
+			added: func() bool {
+				slugs, _ := database.GetAlbumLinks(t.Context(), albumSlug, true, true)
+				return slices.Contains(slugs, "new")
+			},
+		},
+		{
+			name:    "tags",
+			handler: HandlePostNewTags,
+			body:    `{"Tag": "beach", "ImageSlugs": ["new", "existing"]}`,
+			added: func() bool {
+				tags, _ := database.GetTagsForSlug(t.Context(), "new")
+				return slices.Contains(tags, "beach")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.handler(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body)))
+			if recorder.Code != http.StatusConflict {
+				t.Fatalf("returned %d, want %d: %s", recorder.Code, http.StatusConflict, recorder.Body)
+			}
+			if !strings.Contains(recorder.Body.String(), `"imageSlug":"existing"`) {
+				t.Errorf("conflict does not name the image: %s", recorder.Body)
+			}
+			if test.added() {
+				t.Error("added the image before the conflict")
+			}
+		})
+	}
+}
+
+func TestUploadWithoutMetadataIsRemoved(t *testing.T) {
+	setupDatabase(t)
+	config.ImageDirectory = t.TempDir()
+	config.ImageExtensions = []string{".png"}
+	if _, err := database.Database.Exec(`CREATE TRIGGER failInsert BEFORE INSERT ON metadata BEGIN SELECT RAISE(ABORT, 'disk full'); END;`); err != nil {
+		t.Fatal(err)
+	}
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	HandlePostNewImage(recorder, uploadRequest(t, "picture.png", picture.Bytes()))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if _, err := os.Stat(filepath.Join(config.ImageDirectory, "picture.png")); !os.IsNotExist(err) {
+		t.Errorf("kept the original without metadata: %v", err)
+	}
+}
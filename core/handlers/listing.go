@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"gallery/core/auth"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSlugPageSize = 100
+	maxSlugPageSize     = 1000
+)
+
+var orientations = []string{"landscape", "portrait", "square"}
+
+// parseSlugQuery reads the filters and pagination parameters of the slug listings, writing
+// an error response if any are invalid. paginated is set when the caller sent limit or cursor,
+// and wants a page rather than every matching slug.
+func parseSlugQuery(w http.ResponseWriter, r *http.Request) (query types.SlugQuery, paginated bool, ok bool) {
+	values := r.URL.Query()
+	query = types.SlugQuery{
+		IncludeHidden:  canSeeHidden(r),
+		IncludePending: canSeePending(r),
+		From:           values.Get("from"),
+		To:             values.Get("to"),
+		Camera:         values.Get("camera"),
+		Lens:           values.Get("lens"),
+		Orientation:    values.Get("orientation"),
+		AlbumSlug:      values.Get("album"),
+		UnlockedAlbums: auth.UnlockedAlbums(r),
+	}
+
+	for parameter, date := range map[string]string{"from": query.From, "to": query.To} {
+		if _, err := time.Parse(time.DateOnly, date); date != "" && err != nil {
+			badParameter(w, parameter, "from and to must be dates such as 2024-06-30")
+			return query, false, false
+		}
+	}
+	if query.Orientation != "" && !slices.Contains(orientations, query.Orientation) {
+		badParameter(w, "orientation", "orientation must be one of landscape, portrait or square")
+		return query, false, false
+	}
+	if query.AlbumSlug != "" {
+		album, found := getAlbum(w, r, query.AlbumSlug)
+		if !found || !checkAlbumAccess(w, r, album) {
+			return query, false, false
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeSlugCursor(cursor)
+		if err != nil {
+			badParameter(w, "cursor", "Invalid cursor")
+			return query, false, false
+		}
+		query.After = &after
+		paginated = true
+	}
+	query.Limit = defaultSlugPageSize
+	if limit := values.Get("limit"); limit != "" {
+		number, err := strconv.Atoi(limit)
+		if err != nil || number < 1 || number > maxSlugPageSize {
+			badParameter(w, "limit", "limit must be between 1 and "+strconv.Itoa(maxSlugPageSize))
+			return query, false, false
+		}
+		query.Limit = number
+		paginated = true
+	}
+	if !paginated {
+		query.Limit = 0
+	}
+	return query, paginated, true
+}
+
+// badParameter writes a 400 naming the query parameter that was invalid.
+func badParameter(w http.ResponseWriter, parameter string, message string) {
+	net.ErrorWithDetails(w, message, http.StatusBadRequest, map[string]string{"parameter": parameter})
+}
+
+// writeSlugListing writes the images matching the request's filters, converted by item,
+// as an array or as a page depending on whether the caller asked for pagination. Images are
+// encoded as they are read from the database rather than collected first, so listing a large
+// library does not hold it all in memory; an error after the first image has been written
+// can only be logged, and leaves the client with truncated JSON.
+func writeSlugListing[T any](w http.ResponseWriter, r *http.Request, item func(types.ListedSlug) T) {
+	query, paginated, ok := parseSlugQuery(w, r)
+	if !ok {
+		return
+	}
+
+	limit := query.Limit
+	total := 0
+	if paginated {
+		counted := query
+		counted.After = nil
+		var err error
+		total, err = database.CountSlugs(r.Context(), counted)
+		if err != nil {
+			net.InternalError(w)
+			return
+		}
+		// One extra row tells whether there is a next page.
+		query.Limit = limit + 1
+	}
+
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "application/json")
+		opening := "["
+		if paginated {
+			opening = `{"items":[`
+		}
+		_, err := io.WriteString(w, opening)
+		return err
+	}
+
+	written := 0
+	var last types.SlugCursor
+	nextCursor := ""
+	err := database.QuerySlugs(r.Context(), query, func(slug types.ListedSlug) error {
+		if paginated && written == limit {
+			nextCursor = encodeSlugCursor(last)
+			return nil
+		}
+		encoded, err := json.Marshal(item(slug))
+		if err != nil {
+			return err
+		}
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		} else if _, err := io.WriteString(w, ","); err != nil {
+			return err
+		}
+		written++
+		last = slug.Cursor
+		_, err = w.Write(encoded)
+		return err
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err != nil {
+		if !started {
+			net.InternalError(w)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Listing interrupted", "error", err)
+		return
+	}
+
+	closing := "]"
+	if paginated {
+		if nextCursor != "" {
+			closing += `,"nextCursor":"` + nextCursor + `"`
+		}
+		closing += `,"total":` + strconv.Itoa(total) + "}"
+	}
+	closing += "\n"
+	if _, err := io.WriteString(w, closing); err != nil {
+		slog.ErrorContext(r.Context(), "Listing interrupted", "error", err)
+	}
+}
+
+func encodeSlugCursor(cursor types.SlugCursor) string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeSlugCursor(value string) (types.SlugCursor, error) {
+	var cursor types.SlugCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(decoded, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func setupDatabase(t *testing.T) {
+	t.Helper()
+	config.DatabaseDirectory = t.TempDir()
+	if database.Initialise() == nil {
+		t.Fatal("failed to initialise database")
+	}
+	t.Cleanup(database.Close)
+	// creates the tags and dimensions tables, with nothing to populate them from yet
+	database.InitialiseTags()
+	database.InitialiseDimensions(t.Context())
+	database.WaitForDimensions()
+}
+
+func insertImage(t *testing.T, slug string, dateTaken string, visibility string) {
+	t.Helper()
+	_, err := database.Database.Exec(`INSERT INTO metadata (slug, filePath, fileName, title, dateTaken, dateUploaded,
+			cameraMake, cameraModel, lensMake, lensModel, fStop, exposureTime, flashStatus, focalLength, iso,
+			exposureMode, whiteBalance, whiteBalanceMode, visibility)
+		VALUES (?, '', ?, ?, ?, ?, '', '', '', '', '', '', '', '', '', '', '', '', ?);`,
+		slug, slug+".jpg", slug, dateTaken, dateTaken, visibility)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loginAs creates a user with role and returns the session cookie of a request from them.
+func loginAs(t *testing.T, role string) *http.Cookie {
+	t.Helper()
+	config.SessionMaxAge = time.Hour
+	config.SessionIdleTimeout = time.Hour
+	if err := database.InsertUserRow(t.Context(), types.NewUser{Username: role, Password: "hash", Role: role}); err != nil {
+		t.Fatal(err)
+	}
+	token := "token-" + role
+	sum := sha256.Sum256([]byte(token))
+	if _, err := database.InsertSessionRow(t.Context(), hex.EncodeToString(sum[:]), role, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "appSession", Value: token}
+}
+
+type slugPage struct {
+	Items      []string `json:"items"`
+	NextCursor string   `json:"nextCursor"`
+	Total      int      `json:"total"`
+}
+
+func getSlugPage(t *testing.T, query string, cookie *http.Cookie) slugPage {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/api/slugs?"+query, nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	HandleGetSlugs(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /api/slugs?%s returned %d: %s", query, recorder.Code, recorder.Body)
+	}
+	var page slugPage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestSlugListingCursorContinuity(t *testing.T) {
+	setupDatabase(t)
+	// d, c and b share a date, so only the slug orders them
+	insertImage(t, "e", "2024-06-30 12:00:00", types.VisibilityPublic)
+	insertImage(t, "b", "2024-06-29 12:00:00", types.VisibilityPublic)
+	insertImage(t, "d", "2024-06-29 12:00:00", types.VisibilityPublic)
+	insertImage(t, "c", "2024-06-29 12:00:00", types.VisibilityPublic)
+	insertImage(t, "a", "2024-06-28 12:00:00", types.VisibilityPublic)
+	want := []string{"e", "d", "c", "b", "a"}
+
+	tests := []struct {
+		limit int
+		pages int
+	}{
+		{limit: 1, pages: 5},
+		{limit: 2, pages: 3},
+		{limit: 3, pages: 2},
+		{limit: 5, pages: 1},
+		{limit: 10, pages: 1},
+	}
+	for _, test := range tests {
+		t.Run("limit "+strconv.Itoa(test.limit), func(t *testing.T) {
+			var listed []string
+			pages := 0
+			cursor := ""
+			for {
+				page := getSlugPage(t, "limit="+strconv.Itoa(test.limit)+"&cursor="+cursor, nil)
+				pages++
+				if page.Total != len(want) {
+					t.Errorf("page %d has total %d, want %d", pages, page.Total, len(want))
+				}
+				listed = append(listed, page.Items...)
+				if page.NextCursor == "" {
+					break
+				}
+				if pages > len(want) {
+					t.Fatalf("listing did not end after %d pages", pages)
+				}
+				cursor = page.NextCursor
+			}
+			if !slices.Equal(listed, want) {
+				t.Errorf("listed %v, want %v", listed, want)
+			}
+			if pages != test.pages {
+				t.Errorf("listed %d pages, want %d", pages, test.pages)
+			}
+		})
+	}
+}
+
+func TestSlugListingTotalRespectsVisibility(t *testing.T) {
+	setupDatabase(t)
+	insertImage(t, "public", "2024-06-30 12:00:00", types.VisibilityPublic)
+	insertImage(t, "unlisted", "2024-06-29 12:00:00", types.VisibilityUnlisted)
+	insertImage(t, "private", "2024-06-28 12:00:00", types.VisibilityPrivate)
+	insertImage(t, "pending", "2024-06-27 12:00:00", types.VisibilityPrivate)
+	if err := database.InsertModerationRow(t.Context(), "pending", "", "guest"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   []string
+	}{
+		{name: "anonymous", want: []string{"public"}},
+		{name: "viewer", cookie: loginAs(t, types.RoleViewer), want: []string{"public", "unlisted", "private"}},
+		{name: "admin", cookie: loginAs(t, types.RoleAdmin), want: []string{"public", "unlisted", "private", "pending"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := getSlugPage(t, "limit=1", test.cookie)
+			if page.Total != len(test.want) {
+				t.Errorf("total is %d, want %d", page.Total, len(test.want))
+			}
+			full := getSlugPage(t, "limit=100", test.cookie)
+			if !slices.Equal(full.Items, test.want) {
+				t.Errorf("listed %v, want %v", full.Items, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"encoding/json"
+	"gallery/core/auth"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postShareLink asks to share what body describes with an editor's bearer token.
+func postShareLink(bearer string, body string) *httptest.ResponseRecorder {
+	handler := auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(auth.HandlePostShareLink))
+	request := httptest.NewRequest(http.MethodPost, "/api/shares", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+bearer)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// createShareLink shares what body describes as an editor, returning the link and its token.
+func createShareLink(t *testing.T, bearer string, body string) types.CreatedShareLink {
+	t.Helper()
+	recorder := postShareLink(bearer, body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("creating share link returned %d: %s", recorder.Code, recorder.Body)
+	}
+	var link types.CreatedShareLink
+	if err := json.Unmarshal(recorder.Body.Bytes(), &link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// openShareLink opens a share link with password from a browser holding cookies.
+func openShareLink(token string, password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	auth.OpenShareLinkHandler(recorder, shareRequest(token, password, cookies))
+	return recorder
+}
+
+func shareRequest(token string, password string, cookies []*http.Cookie) *http.Request {
+	body := ""
+	if password != "" {
+		body = `{"password": "` + password + `"}`
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/shared/"+token, strings.NewReader(body))
+	request.SetPathValue("token", token)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+// grantCookie returns the cookie a browser is given when it opens a share link.
+func grantCookie(t *testing.T, recorder *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range recorder.Result().Cookies() {
+		if strings.HasPrefix(cookie.Name, "share_") {
+			return cookie
+		}
+	}
+	t.Fatalf("opening share link returned %d without a grant cookie: %s", recorder.Code, recorder.Body)
+	return nil
+}
+
+// getSharedMetadata loads an image's metadata through a share token from a browser holding cookies.
+func getSharedMetadata(slug string, token string, cookies ...*http.Cookie) int {
+	request := httptest.NewRequest(http.MethodGet, "/api/metadata/"+slug+"?share="+token, nil)
+	request.SetPathValue("slug", slug)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	HandleGetMetadataBySlug(recorder, request)
+	return recorder.Code
+}
+
+func TestShareLinkExpiry(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	insertImage(t, "private", "2024-06-30 12:00:00", types.VisibilityPrivate)
+
+	_, bearer := createToken(t, types.RoleEditor, types.ScopeEdit)
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if recorder := postShareLink(bearer, `{"imageSlug": "private", "expires": "`+past+`"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("creating an expired share link returned %d", recorder.Code)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	link := createShareLink(t, bearer, `{"imageSlug": "private", "expires": "`+future+`"}`)
+	opened := openShareLink(link.Token, "")
+	if opened.Code != http.StatusOK {
+		t.Fatalf("opening share link returned %d: %s", opened.Code, opened.Body)
+	}
+	grant := grantCookie(t, opened)
+	if grant.MaxAge <= 0 || grant.MaxAge > int(time.Hour.Seconds()) {
+		t.Errorf("grant cookie lasts %ds, past the link's expiry", grant.MaxAge)
+	}
+	if status := getSharedMetadata("private", link.Token, grant); status != http.StatusOK {
+		t.Fatalf("shared image returned %d", status)
+	}
+
+	if _, err := database.Database.Exec(`UPDATE share_links SET expires = ? WHERE id = ?;`, time.Now().Add(-time.Minute).UTC(), link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := openShareLink(link.Token, "", grant); recorder.Code != http.StatusNotFound {
+		t.Errorf("opening expired share link returned %d", recorder.Code)
+	}
+	if status := getSharedMetadata("private", link.Token, grant); status != http.StatusNotFound {
+		t.Errorf("shared image returned %d after the link expired", status)
+	}
+}
+
+func TestShareLinkViewLimit(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	insertImage(t, "private", "2024-06-30 12:00:00", types.VisibilityPrivate)
+	_, bearer := createToken(t, types.RoleEditor, types.ScopeEdit)
+	link := createShareLink(t, bearer, `{"imageSlug": "private", "maxViews": 2}`)
+
+	first := openShareLink(link.Token, "")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first view returned %d: %s", first.Code, first.Body)
+	}
+	grant := grantCookie(t, first)
+	if recorder := openShareLink(link.Token, ""); recorder.Code != http.StatusOK {
+		t.Fatalf("second view returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder := openShareLink(link.Token, ""); recorder.Code != http.StatusGone {
+		t.Errorf("view past the limit returned %d", recorder.Code)
+	}
+
+	// a browser that has already opened the link keeps it open without another view
+	if recorder := openShareLink(link.Token, "", grant); recorder.Code != http.StatusOK {
+		t.Errorf("reopening with the grant cookie returned %d", recorder.Code)
+	}
+	if status := getSharedMetadata("private", link.Token, grant); status != http.StatusOK {
+		t.Errorf("shared image returned %d to a browser that opened the link", status)
+	}
+	stored, err := database.GetShareLink(t.Context(), link.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Views != 2 {
+		t.Errorf("counted %d views, want 2", stored.Views)
+	}
+}
+
+func TestShareGrantCookie(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	insertImage(t, "private", "2024-06-30 12:00:00", types.VisibilityPrivate)
+	insertImage(t, "other", "2024-06-29 12:00:00", types.VisibilityPrivate)
+	_, bearer := createToken(t, types.RoleEditor, types.ScopeEdit)
+	link := createShareLink(t, bearer, `{"imageSlug": "private"}`)
+	otherLink := createShareLink(t, bearer, `{"imageSlug": "other"}`)
+
+	if status := getSharedMetadata("private", link.Token); status != http.StatusNotFound {
+		t.Errorf("share token without opening the link returned %d", status)
+	}
+	grant := grantCookie(t, openShareLink(link.Token, ""))
+	otherGrant := grantCookie(t, openShareLink(otherLink.Token, ""))
+
+	tampered := *grant
+	tampered.Value = strings.Repeat("0", len(grant.Value))
+	// the other link's grant, sent under this link's cookie name
+	swapped := *otherGrant
+	swapped.Name = grant.Name
+
+	tests := []struct {
+		name   string
+		slug   string
+		token  string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "grant", slug: "private", token: link.Token, cookie: grant, status: http.StatusOK},
+		{name: "tampered grant", slug: "private", token: link.Token, cookie: &tampered, status: http.StatusNotFound},
+		{name: "another link's grant", slug: "private", token: link.Token, cookie: &swapped, status: http.StatusNotFound},
+		{name: "image outside the link", slug: "other", token: link.Token, cookie: grant, status: http.StatusNotFound},
+		{name: "wrong token", slug: "private", token: otherLink.Token, cookie: grant, status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := getSharedMetadata(test.slug, test.token, test.cookie); status != test.status {
+				t.Errorf("returned %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	insertImage(t, "private", "2024-06-30 12:00:00", types.VisibilityPrivate)
+	config.LoginMaxAttempts = 2
+	config.LoginLockoutDuration = time.Minute
+	config.LoginMaxLockoutDuration = time.Minute
+	t.Cleanup(func() {
+		config.LoginMaxAttempts = 0
+		config.LoginLockoutDuration = 0
+		config.LoginMaxLockoutDuration = 0
+	})
+	_, bearer := createToken(t, types.RoleEditor, types.ScopeEdit)
+	link := createShareLink(t, bearer, `{"imageSlug": "private", "password": "hunter2"}`)
+	// guessed from an address of its own, so the lockout does not reach other tests
+	open := func(password string) *httptest.ResponseRecorder {
+		request := shareRequest(link.Token, password, nil)
+		request.RemoteAddr = "198.51.100.11:1234"
+		recorder := httptest.NewRecorder()
+		auth.OpenShareLinkHandler(recorder, request)
+		return recorder
+	}
+
+	if recorder := open(""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("opening without the password returned %d", recorder.Code)
+	}
+	if recorder := open("guess"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("opening with the wrong password returned %d", recorder.Code)
+	}
+	recorder := open("hunter2")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("the right password after %d wrong ones returned %d", config.LoginMaxAttempts, recorder.Code)
+	}
+	stored, err := database.GetShareLink(t.Context(), link.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Views != 0 {
+		t.Errorf("counted %d views without the password", stored.Views)
+	}
+}
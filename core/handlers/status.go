@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gallery/core/config"
+	"gallery/core/database"
+	"gallery/core/logic"
+	"gallery/core/net"
+	"gallery/core/optimised"
+	"gallery/core/thumbnails"
+	"gallery/core/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// readinessTimeout bounds how long the database ping may take before the gallery is reported as not ready.
+const readinessTimeout = 2 * time.Second
+
+// HandleHealthz reports that the process is alive, without checking any dependencies.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+// HandleReadyz reports whether the database and the image, thumbnail and optimised
+// directories are usable, returning 503 when any check fails.
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := types.Readiness{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			readiness.Ready = false
+			readiness.Checks[name] = err.Error()
+		} else {
+			readiness.Checks[name] = "ok"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	check("database", checkDatabase(ctx))
+	check("images", checkDirectory(r.Context(), config.ImageDirectory))
+	check("thumbnails", checkDirectory(r.Context(), config.ThumbnailDirectory))
+	check("optimised", checkDirectory(r.Context(), config.OptimisedDirectory))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !readiness.Ready {
+		slog.WarnContext(r.Context(), "Readiness check failed", "checks", readiness.Checks)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(readiness); err != nil {
+		net.InternalError(w)
+	}
+}
+
+func HandleGetStatus(w http.ResponseWriter, r *http.Request) {
+	bootTime := logic.GetBootTime()
+	status := types.Status{
+		Version:       logic.GetVersion(),
+		BootTime:      bootTime,
+		UptimeSeconds: int64(time.Since(bootTime).Seconds()),
+		Disk:          map[string]types.DiskUsage{},
+	}
+
+	var err error
+	if status.Images, err = database.CountImagesByVisibility(r.Context()); err != nil {
+		net.InternalError(w)
+		return
+	}
+	if status.PendingUploads, err = database.CountPendingUploads(r.Context()); err != nil {
+		net.InternalError(w)
+		return
+	}
+	if status.Backlog.Dimensions, err = database.CountMissingDimensions(r.Context()); err != nil {
+		net.InternalError(w)
+		return
+	}
+	status.Backlog.Thumbnails = thumbnails.CountMissingThumbnails()
+	status.Backlog.Optimised = optimised.CountMissingOptimised()
+
+	for name, path := range map[string]string{"data": config.DatabaseDirectory, "images": config.ImageDirectory} {
+		usage, err := logic.GetDiskUsage(path)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to get disk usage", "path", path, "error", err)
+		}
+		status.Disk[name] = usage
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		net.InternalError(w)
+	}
+}
+
+// Readiness checks report only these errors, as /readyz is open to anyone and the
+// underlying errors name paths on the server. The details are logged instead.
+var (
+	errUnavailable = errors.New("unavailable")
+	errUnreadable  = errors.New("unreadable")
+	errUnwritable  = errors.New("unwritable")
+)
+
+// checkDatabase checks that the database answers a ping.
+func checkDatabase(ctx context.Context) error {
+	if err := database.Ping(ctx); err != nil {
+		slog.ErrorContext(ctx, "Database is not ready", "error", err)
+		return errUnavailable
+	}
+	return nil
+}
+
+// checkDirectory checks that path is a directory the gallery can list and create files in.
+func checkDirectory(ctx context.Context, path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		slog.ErrorContext(ctx, "Directory cannot be read", "path", path, "error", err)
+		return errUnreadable
+	}
+	_, err = dir.Readdirnames(1)
+	dir.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		slog.ErrorContext(ctx, "Directory cannot be read", "path", path, "error", err)
+		return errUnreadable
+	}
+	file, err := os.CreateTemp(path, ".ready-check-*")
+	if err != nil {
+		slog.ErrorContext(ctx, "Directory is not writable", "path", path, "error", err)
+		return errUnwritable
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		slog.ErrorContext(ctx, "Directory is not writable", "path", path, "error", err)
+		return errUnwritable
+	}
+	return nil
+}
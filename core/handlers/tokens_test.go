@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gallery/core/auth"
+	"gallery/core/database"
+	"gallery/core/types"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// createToken gives username an API token with scopes, returning the value sent as a bearer token.
+func createToken(t *testing.T, username string, scopes ...string) (types.ApiToken, string) {
+	t.Helper()
+	value := "gal_" + username + "-" + scopes[0]
+	sum := sha256.Sum256([]byte(value))
+	token, err := database.InsertApiTokenRow(t.Context(), hex.EncodeToString(sum[:]), username, types.NewApiToken{Name: value, Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, value
+}
+
+// serveWithToken sends a request with a bearer token through AuthMiddleware for requiredRole and requiredScope.
+func serveWithToken(method string, value string, requiredRole string, requiredScope string) int {
+	handler := auth.AuthMiddleware(requiredRole, requiredScope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := httptest.NewRequest(method, "/api/test", nil)
+	request.Header.Set("Authorization", "Bearer "+value)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestApiTokenScopes(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	loginAs(t, types.RoleViewer)
+	_, read := createToken(t, types.RoleEditor, types.ScopeRead)
+	_, upload := createToken(t, types.RoleEditor, types.ScopeUpload)
+	_, edit := createToken(t, types.RoleEditor, types.ScopeEdit)
+	// a viewer cannot create an admin token, but may hold one from before their role was lowered
+	_, demoted := createToken(t, types.RoleViewer, types.ScopeAdmin)
+
+	tests := []struct {
+		name   string
+		token  string
+		role   string
+		scope  string
+		status int
+	}{
+		{name: "read token reading", token: read, role: types.RoleViewer, scope: types.ScopeRead, status: http.StatusNoContent},
+		{name: "upload token reading", token: upload, role: types.RoleViewer, scope: types.ScopeRead, status: http.StatusNoContent},
+		{name: "read token editing", token: read, role: types.RoleEditor, scope: types.ScopeEdit, status: http.StatusForbidden},
+		{name: "upload token editing", token: upload, role: types.RoleEditor, scope: types.ScopeEdit, status: http.StatusForbidden},
+		{name: "edit token editing", token: edit, role: types.RoleEditor, scope: types.ScopeEdit, status: http.StatusNoContent},
+		{name: "edit token on an admin route", token: edit, role: types.RoleAdmin, scope: types.ScopeAdmin, status: http.StatusForbidden},
+		{name: "admin scope without the role", token: demoted, role: types.RoleEditor, scope: types.ScopeEdit, status: http.StatusForbidden},
+		{name: "unknown token", token: "gal_unknown", role: types.RoleViewer, scope: types.ScopeRead, status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := serveWithToken(http.MethodPost, test.token, test.role, test.scope); status != test.status {
+				t.Errorf("returned %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestApiTokensStopWorking(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	loginAs(t, types.RoleViewer)
+
+	t.Run("revoked", func(t *testing.T) {
+		token, value := createToken(t, types.RoleEditor, types.ScopeRead)
+		if err := database.DeleteApiTokenRow(t.Context(), token.ID); err != nil {
+			t.Fatal(err)
+		}
+		if status := serveWithToken(http.MethodGet, value, types.RoleViewer, types.ScopeRead); status != http.StatusUnauthorized {
+			t.Errorf("returned %d", status)
+		}
+	})
+
+	t.Run("owner disabled", func(t *testing.T) {
+		_, value := createToken(t, types.RoleViewer, types.ScopeRead)
+		if err := database.UpdateUserDisabled(t.Context(), types.RoleViewer, true); err != nil {
+			t.Fatal(err)
+		}
+		if status := serveWithToken(http.MethodGet, value, types.RoleViewer, types.ScopeRead); status != http.StatusUnauthorized {
+			t.Errorf("returned %d", status)
+		}
+	})
+
+	t.Run("without the prefix", func(t *testing.T) {
+		// stored like any other token, but a value without gal_ is never looked up
+		sum := sha256.Sum256([]byte("tok_editor"))
+		if _, err := database.InsertApiTokenRow(t.Context(), hex.EncodeToString(sum[:]), types.RoleEditor, types.NewApiToken{Name: "tok", Scopes: []string{types.ScopeRead}}); err != nil {
+			t.Fatal(err)
+		}
+		if status := serveWithToken(http.MethodGet, "tok_editor", types.RoleViewer, types.ScopeRead); status != http.StatusUnauthorized {
+			t.Errorf("returned %d", status)
+		}
+	})
+}
+
+func TestApiTokenLastUsedIsThrottled(t *testing.T) {
+	setupDatabase(t)
+	loginAs(t, types.RoleEditor)
+	token, value := createToken(t, types.RoleEditor, types.ScopeRead)
+	lastUsed := func() time.Time {
+		t.Helper()
+		token, err := database.GetApiToken(t.Context(), token.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.LastUsed == nil {
+			return time.Time{}
+		}
+		return *token.LastUsed
+	}
+
+	serveWithToken(http.MethodGet, value, types.RoleViewer, types.ScopeRead)
+	first := lastUsed()
+	if first.IsZero() {
+		t.Fatal("first use was not recorded")
+	}
+	serveWithToken(http.MethodGet, value, types.RoleViewer, types.ScopeRead)
+	if used := lastUsed(); !used.Equal(first) {
+		t.Errorf("use a moment later was recorded, moving lastUsed from %s to %s", first, used)
+	}
+
+	earlier := first.Add(-2 * time.Minute)
+	if _, err := database.Database.Exec(`UPDATE api_tokens SET lastUsed = ? WHERE id = ?;`, earlier, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	serveWithToken(http.MethodGet, value, types.RoleViewer, types.ScopeRead)
+	if used := lastUsed(); !used.After(earlier) {
+		t.Errorf("use two minutes later was not recorded, lastUsed is %s", used)
+	}
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"encoding/json"
+	"gallery/core/auth"
+	"gallery/core/database"
+	"gallery/core/net"
+	"gallery/core/types"
+	"net/http"
+	"time"
+)
+
+// The v2 handlers below cover the requests whose v1 bodies use Go field names or reply with
+// plain text. Request bodies have already been checked against the OpenAPI document by the
+// time they get here, so they only check what the document cannot, such as whether an album exists.
+
+func albumV2(album types.Album) types.AlbumV2 {
+	return types.AlbumV2{
+		Slug:        album.Slug,
+		Name:        album.Name,
+		DateCreated: album.DateCreated,
+		CoverSlug:   album.CoverSlug,
+		Visibility:  album.Visibility,
+		Protected:   album.Protected,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		net.InternalError(w)
+	}
+}
+
+// HandlePatchImageV2 updates an image's metadata. Unlike v1, only the editable fields are accepted.
+func HandlePatchImageV2(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if !imageExists(w, r, slug) {
+		return
+	}
+	var updates map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	// Store the date the way EXIF dates are stored, so it sorts alongside them.
+	if value, ok := updates["dateTaken"].(string); ok {
+		dateTaken, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			net.ErrorWithDetails(w, "dateTaken must be a date-time such as 2024-06-30T18:00:00Z", http.StatusBadRequest, map[string]string{"field": "dateTaken"})
+			return
+		}
+		updates["dateTaken"] = dateTaken
+	}
+	if updateMetadata(w, r, slug, updates) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func HandleDeleteImageV2(w http.ResponseWriter, r *http.Request) {
+	if deleteImage(w, r, r.PathValue("slug")) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandlePostImageTagV2 adds a tag to an image, replying 409 if the image already has it.
+func HandlePostImageTagV2(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if !imageExists(w, r, slug) {
+		return
+	}
+	var body struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if err := database.InsertTagsRow(r.Context(), types.Tag{Tag: body.Tag, ImageSlug: slug}); err != nil {
+		if database.IsDuplicate(err) {
+			net.Error(w, "Image already has the tag", http.StatusConflict)
+			return
+		}
+		net.Error(w, "Failed to insert tag", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "tag.create", slug, "", nil, map[string]string{"tag": body.Tag})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleDeleteImageTagV2(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	tag := r.PathValue("tag")
+	if !imageExists(w, r, slug) {
+		return
+	}
+	if err := database.DeleteTagsRow(r.Context(), types.Tag{Tag: tag, ImageSlug: slug}); err != nil {
+		net.Error(w, "Failed to delete tag", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "tag.delete", slug, "", map[string]string{"tag": tag}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleGetAlbumsV2(w http.ResponseWriter, r *http.Request) {
+	albums := []types.AlbumV2{}
+	for _, album := range database.GetAllAlbums(r.Context(), canSeeHidden(r)) {
+		albums = append(albums, albumV2(album))
+	}
+	writeJSON(w, http.StatusOK, albums)
+}
+
+func HandleGetAlbumV2(w http.ResponseWriter, r *http.Request) {
+	album, ok := getAlbum(w, r, r.PathValue("albumSlug"))
+	if !ok || !checkAlbumAccess(w, r, album) {
+		return
+	}
+	writeJSON(w, http.StatusOK, albumV2(album))
+}
+
+// HandlePostAlbumV2 creates an album and replies with it.
+func HandlePostAlbumV2(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name       string `json:"name"`
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	newAlbum := types.Album{Name: body.Name, Visibility: body.Visibility}
+	albumSlug, err := database.InsertAlbumRow(r.Context(), newAlbum)
+	if err != nil {
+		net.Error(w, "Failed to create album", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "album.create", albumSlug, albumSlug, nil, newAlbum)
+	album, ok := getAlbum(w, r, albumSlug)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, albumV2(album))
+}
+
+// HandlePatchAlbumV2 changes any of an album's name, cover, visibility and password in one
+// request. An empty password removes it.
+func HandlePatchAlbumV2(w http.ResponseWriter, r *http.Request) {
+	album, ok := getAlbum(w, r, r.PathValue("albumSlug"))
+	if !ok {
+		return
+	}
+	var body struct {
+		Name       *string `json:"name"`
+		CoverSlug  *string `json:"coverSlug"`
+		Visibility *string `json:"visibility"`
+		Password   *string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	if body.Name != nil {
+		if err := database.UpdateAlbumName(r.Context(), album.Slug, *body.Name); err != nil {
+			net.Error(w, "Failed to update album name", http.StatusInternalServerError)
+			return
+		}
+		auth.Audit(r, "album.rename", album.Slug, album.Slug, map[string]string{"name": album.Name}, map[string]string{"name": *body.Name})
+	}
+	if body.CoverSlug != nil {
+		if _, err := database.GetImageVisibility(r.Context(), *body.CoverSlug); err != nil {
+			net.ErrorWithDetails(w, "Cover image not found", http.StatusBadRequest, map[string]string{"field": "coverSlug"})
+			return
+		}
+		if err := database.UpdateAlbumCover(r.Context(), album.Slug, *body.CoverSlug); err != nil {
+			net.Error(w, "Failed to update album cover", http.StatusInternalServerError)
+			return
+		}
+		auth.Audit(r, "album.cover", album.Slug, album.Slug, map[string]string{"coverSlug": album.CoverSlug}, map[string]string{"coverSlug": *body.CoverSlug})
+	}
+	if body.Visibility != nil {
+		if err := database.UpdateAlbumVisibility(r.Context(), album.Slug, *body.Visibility); err != nil {
+			net.Error(w, "Failed to update album visibility", http.StatusInternalServerError)
+			return
+		}
+		auth.Audit(r, "album.visibility", album.Slug, album.Slug, map[string]string{"visibility": album.Visibility}, map[string]string{"visibility": *body.Visibility})
+	}
+	if body.Password != nil {
+		passwordHash := ""
+		if *body.Password != "" {
+			var err error
+			passwordHash, err = auth.HashPassword(*body.Password)
+			if err != nil {
+				net.Error(w, "Failed to hash password", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := database.UpdateAlbumPassword(r.Context(), album.Slug, passwordHash); err != nil {
+			net.Error(w, "Failed to update album password", http.StatusInternalServerError)
+			return
+		}
+		auth.Audit(r, "album.password", album.Slug, album.Slug, map[string]bool{"protected": album.Protected}, map[string]bool{"protected": passwordHash != ""})
+	}
+
+	album, ok = getAlbum(w, r, album.Slug)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, albumV2(album))
+}
+
+func HandleDeleteAlbumV2(w http.ResponseWriter, r *http.Request) {
+	album, ok := getAlbum(w, r, r.PathValue("albumSlug"))
+	if !ok {
+		return
+	}
+	if err := database.DeleteAlbumRow(r.Context(), album.Slug); err != nil {
+		net.Error(w, "Failed to delete album", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "album.delete", album.Slug, album.Slug, album, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePostAlbumImagesV2 adds images to an album, adding none of them if one is missing
+// (404) or already in it (409).
+func HandlePostAlbumImagesV2(w http.ResponseWriter, r *http.Request) {
+	album, ok := getAlbum(w, r, r.PathValue("albumSlug"))
+	if !ok {
+		return
+	}
+	var body struct {
+		ImageSlugs []string `json:"imageSlugs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		net.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	for _, imageSlug := range body.ImageSlugs {
+		if _, err := database.GetImageVisibility(r.Context(), imageSlug); err != nil {
+			net.ErrorWithDetails(w, "Image not found", http.StatusNotFound, map[string]string{"imageSlug": imageSlug})
+			return
+		}
+	}
+	if imageSlug, err := database.InsertAlbumLinkRows(r.Context(), album.Slug, body.ImageSlugs); err != nil {
+		if database.IsDuplicate(err) {
+			net.ErrorWithDetails(w, "Image is already in the album", http.StatusConflict, map[string]string{"imageSlug": imageSlug})
+			return
+		}
+		net.Error(w, "Failed to add image to album", http.StatusInternalServerError)
+		return
+	}
+	for _, imageSlug := range body.ImageSlugs {
+		auth.Audit(r, "link.create", imageSlug, album.Slug, nil, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func HandleDeleteAlbumImageV2(w http.ResponseWriter, r *http.Request) {
+	album, ok := getAlbum(w, r, r.PathValue("albumSlug"))
+	if !ok {
+		return
+	}
+	imageSlug := r.PathValue("imageSlug")
+	if err := database.DeleteAlbumLinkRow(r.Context(), types.Link{AlbumSlug: album.Slug, ImageSlug: imageSlug}); err != nil {
+		net.Error(w, "Failed to remove image from album", http.StatusInternalServerError)
+		return
+	}
+	auth.Audit(r, "link.delete", imageSlug, album.Slug, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
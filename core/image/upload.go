@@ -1,85 +1,158 @@
 package image
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"gallery/core/config"
 	"gallery/core/database"
 	"gallery/core/optimised"
 	"gallery/core/thumbnails"
 	"gallery/core/types"
+	stdimage "image"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	_ "golang.org/x/image/webp"
 )
 
-func UploadImage(file multipart.File, fileHeader *multipart.FileHeader) string {
-	fileName := fileHeader.Filename
-	ext := filepath.Ext(fileName)
-	fileName = strings.TrimSuffix(fileName, ext) + strings.ToLower(ext)
+// ErrDuplicateImage is returned by UploadImage when an original with the same file name already exists.
+var ErrDuplicateImage = errors.New("an image with this file name already exists")
+
+// ErrUnsupportedImage is returned by UploadImage when a file does not have one of the
+// configured image extensions, or cannot be decoded as an image.
+var ErrUnsupportedImage = errors.New("the file is not a supported image")
 
-	log.Printf("Uploading: %s", fileName)
-	saveOriginalImage(file, fileName)
+// UploadImage saves an uploaded file as a new original and adds it to the gallery, returning
+// its slug. When rename is set, a file name that is already taken gets a numbered suffix,
+// so uploads from guests cannot replace existing images; otherwise the upload fails with
+// ErrDuplicateImage. fileHeader.Filename is updated to the name the original was saved as.
+func UploadImage(ctx context.Context, file multipart.File, fileHeader *multipart.FileHeader, visibility string, rename bool) (string, error) {
+	ext := filepath.Ext(fileHeader.Filename)
+	fileName := strings.TrimSuffix(fileHeader.Filename, ext) + strings.ToLower(ext)
+	if err := checkImage(ctx, file, fileName); err != nil {
+		return "", err
+	}
+	outFile, fileName, err := createOriginal(fileName, rename)
+	if err != nil {
+		return "", err
+	}
+	fileHeader.Filename = fileName
 	filePath := filepath.Join(config.ImageDirectory, fileName)
-	slug, _ := database.PopulateMetadataForUpload(fileName)
-	thumbnails.GenerateThumbnail(filePath, slug)
-	err := optimised.GenerateOptimised(filePath, slug)
+
+	slog.InfoContext(ctx, "Uploading", "file", fileName)
+	if err := saveOriginalImage(ctx, file, outFile); err != nil {
+		return "", err
+	}
+	slug, err := database.PopulateMetadataForUpload(ctx, fileName, visibility)
+	if err != nil {
+		// without a metadata row the original would never be shown, nor deleted with the image
+		if removeErr := os.Remove(filePath); removeErr != nil {
+			slog.ErrorContext(ctx, "Failed to remove original without metadata", "file", fileName, "error", removeErr)
+		}
+		return "", err
+	}
+	thumbnails.GenerateThumbnail(context.WithoutCancel(ctx), filePath, slug)
+	err = optimised.GenerateOptimised(context.WithoutCancel(ctx), filePath, slug)
 	if err != nil {
-		log.Printf("Error generating optimised image: %s", err)
+		slog.ErrorContext(ctx, "Error generating optimised image", "error", err)
 	}
 
 	tags := types.TagsUpload{
 		Tags:      []string{},
 		ImageSlug: slug,
 	}
-	err = database.CreateTagsOnUpload(tags)
+	err = database.CreateTagsOnUpload(ctx, tags)
 	if err != nil {
-		log.Printf("Error creating tags on upload: %s", err)
+		slog.ErrorContext(ctx, "Error creating tags on upload", "error", err)
 	}
-	database.CreateDimsensionsOnUpload(slug)
-	return slug
+	database.CreateDimsensionsOnUpload(ctx, slug)
+	return slug, nil
 }
 
-func saveOriginalImage(file multipart.File, filename string) {
+// checkImage returns ErrUnsupportedImage unless fileName has one of the configured image
+// extensions and file decodes as an image, so nothing else can be served as an original.
+// file is rewound afterwards.
+func checkImage(ctx context.Context, file multipart.File, fileName string) error {
+	if !slices.Contains(config.ImageExtensions, filepath.Ext(fileName)) {
+		slog.WarnContext(ctx, "Rejected upload with an unsupported extension", "file", fileName)
+		return ErrUnsupportedImage
+	}
+	if _, _, err := stdimage.DecodeConfig(file); err != nil {
+		slog.WarnContext(ctx, "Rejected upload that is not an image", "file", fileName, "error", err)
+		return ErrUnsupportedImage
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
 
-	filePath := filepath.Join(config.ImageDirectory, filename)
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		log.Printf("failed to parse uploaded file: %v", err)
-		return
+// createOriginal creates the file for a new original, failing rather than opening a file
+// that already exists, even one created by a concurrent upload. With rename, it tries
+// numbered names until one is free and returns the name it used.
+func createOriginal(fileName string, rename bool) (*os.File, string, error) {
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	candidate := fileName
+	for i := 1; ; i++ {
+		outFile, err := os.OpenFile(filepath.Join(config.ImageDirectory, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return outFile, candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+		if !rename {
+			return nil, "", ErrDuplicateImage
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
 	}
-	defer outFile.Close()
+}
 
-	_, err = io.Copy(outFile, file)
+// saveOriginalImage writes the upload to outFile and closes it. If the upload cannot be
+// written in full, the partial file is removed so it is never added to the gallery.
+func saveOriginalImage(ctx context.Context, file multipart.File, outFile *os.File) error {
+	_, err := io.Copy(outFile, file)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		log.Printf("failed to write uploaded file: %v", err)
-		return
+		slog.ErrorContext(ctx, "Failed to write uploaded file", "file", outFile.Name(), "error", err)
+		if removeErr := os.Remove(outFile.Name()); removeErr != nil {
+			slog.ErrorContext(ctx, "Failed to remove partial upload", "file", outFile.Name(), "error", removeErr)
+		}
+		return err
 	}
 
-	log.Printf("Uploaded file to %s", filePath)
+	slog.InfoContext(ctx, "Uploaded file", "file", outFile.Name())
+	return nil
 }
 
-func DeleteOriginalImage(filename string) error {
+func DeleteOriginalImage(ctx context.Context, filename string) error {
 
-	existing := database.CheckMetadataByFileNameExists(filename)
+	existing := database.CheckMetadataByFileNameExists(ctx, filename)
 	if existing {
-		log.Printf("Original image %s is used by existing metadata, skipping deletion", filename)
+		slog.InfoContext(ctx, "Original image is used by existing metadata, skipping deletion", "file", filename)
 		return nil
 	}
 
 	filePath := filepath.Join(config.ImageDirectory, filename)
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Printf("Original file does not exist for filename %s", filename)
+		slog.WarnContext(ctx, "Original file does not exist", "file", filename)
 		return err
 	}
 	err := os.Remove(filePath)
 	if err != nil {
-		log.Printf("Error deleting original image %s: %s", filename, err)
+		slog.ErrorContext(ctx, "Error deleting original image", "file", filename, "error", err)
 		return err
 	}
-	log.Printf("Original image %s deleted", filename)
+	slog.InfoContext(ctx, "Original image deleted", "file", filename)
 
 	return err
 }
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"gallery/core/config"
+	gallerynet "gallery/core/net"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type contextKey string
+
+const requestIDContextKey contextKey = "requestID"
+
+// requestIDHeader is read from a trusted proxy and echoed on every response.
+const requestIDHeader = "X-Request-ID"
+
+// Setup replaces the default logger with one using LOG_FORMAT and LOG_LEVEL. Output
+// from the standard log package goes through it too, at info level.
+func Setup() {
+	options := &slog.HandlerOptions{Level: config.LogLevel}
+	var handler slog.Handler
+	if config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// contextHandler adds the request ID to records logged with a request's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("requestId", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestID returns the ID given to the request by Middleware, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// Middleware gives every request an ID, taken from X-Request-ID when a trusted proxy
+// has already assigned one, so it can be found in the logs of both. The ID is returned
+// in the response header, and each request is logged at debug level once it finishes.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !gallerynet.IsTrustedProxy(gallerynet.RemoteIP(r)) || !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+
+		recorder := gallerynet.NewResponseRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelDebug
+		if recorder.Status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "Request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.Status,
+			"bytes", recorder.Bytes,
+			"duration", time.Since(started),
+			"ip", gallerynet.ClientIP(r),
+		)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID limits IDs passed in by a proxy to characters that are safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
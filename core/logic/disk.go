@@ -0,0 +1,24 @@
+//go:build !windows
+
+package logic
+
+import (
+	"gallery/core/types"
+	"syscall"
+)
+
+// GetDiskUsage reports the size and free space of the filesystem holding path.
+func GetDiskUsage(path string) (types.DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return types.DiskUsage{Path: path}, err
+	}
+	total := stat.Blocks * uint64(stat.Bsize)
+	free := stat.Bavail * uint64(stat.Bsize)
+	return types.DiskUsage{
+		Path:       path,
+		TotalBytes: total,
+		FreeBytes:  free,
+		UsedBytes:  total - stat.Bfree*uint64(stat.Bsize),
+	}, nil
+}
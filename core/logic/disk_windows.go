@@ -0,0 +1,27 @@
+//go:build windows
+
+package logic
+
+import (
+	"gallery/core/types"
+
+	"golang.org/x/sys/windows"
+)
+
+// GetDiskUsage reports the size and free space of the volume holding path.
+func GetDiskUsage(path string) (types.DiskUsage, error) {
+	var free, total, totalFree uint64
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return types.DiskUsage{Path: path}, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &free, &total, &totalFree); err != nil {
+		return types.DiskUsage{Path: path}, err
+	}
+	return types.DiskUsage{
+		Path:       path,
+		TotalBytes: total,
+		FreeBytes:  free,
+		UsedBytes:  total - totalFree,
+	}, nil
+}
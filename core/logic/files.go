@@ -0,0 +1,44 @@
+package logic
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// partialSuffix marks a derivative file that is still being written. Leftovers are
+// cleaned up on the next boot along with any other unexpected files.
+const partialSuffix = ".partial"
+
+// contextWriter stops a write part way through once ctx is cancelled.
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (c contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.writer.Write(p)
+}
+
+// WriteFileAtomically writes a file through a temporary file that is renamed into
+// place once write succeeds, so a cancelled or failed write never leaves a half-written file at path.
+func WriteFileAtomically(ctx context.Context, path string, write func(io.Writer) error) error {
+	partialPath := path + partialSuffix
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+
+	err = write(contextWriter{ctx: ctx, writer: file})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, path)
+}
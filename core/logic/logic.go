@@ -3,7 +3,7 @@ package logic
 import (
 	"fmt"
 	"gallery/core/config"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"slices"
@@ -37,15 +37,15 @@ func GenerateSlug() string {
 
 func CreateDir(directoryPath string) {
 	if _, err := os.Stat(directoryPath); os.IsNotExist(err) {
-		log.Printf("Creating directory: %s", directoryPath)
+		slog.Info("Creating directory", "path", directoryPath)
 		err := os.MkdirAll(directoryPath, 0755)
 		if err != nil {
-			log.Printf("Error creating directory%s: %s", directoryPath, err)
+			slog.Error("Error creating directory", "path", directoryPath, "error", err)
 		} else {
-			log.Printf("Directory created: %s", directoryPath)
+			slog.Info("Directory created", "path", directoryPath)
 		}
 	} else {
-		log.Printf("Directory already exists: %s", directoryPath)
+		slog.Debug("Directory already exists", "path", directoryPath)
 	}
 }
 
@@ -57,7 +57,7 @@ func GetDirContents(directoryPath string) ([]string, error) {
 
 	err := filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("Error opening directory %s: %s", directoryPath, err)
+			slog.Error("Error opening directory", "path", directoryPath, "error", err)
 			return err
 		}
 		if !info.IsDir() {
@@ -71,7 +71,7 @@ func GetDirContents(directoryPath string) ([]string, error) {
 		}
 		return nil
 	})
-	log.Printf("Found: %d images in %s", len(foundFiles), directoryPath)
+	slog.Info("Found images", "count", len(foundFiles), "path", directoryPath)
 	return foundFiles, err
 }
 
@@ -104,6 +104,6 @@ func FormatTimeToString(dateString string) (string, error) {
 			return formattedTime, nil
 		}
 	}
-	log.Printf("unsupported date format: %s", dateString)
+	slog.Warn("Unsupported date format", "date", dateString)
 	return "0000-00-00 00:00:00", fmt.Errorf("unsupported date format: %s", dateString)
 }
@@ -0,0 +1,22 @@
+package logic
+
+import "runtime/debug"
+
+// Version is set at build time with -ldflags "-X gallery/core/logic.Version=v1.2.3".
+var Version string
+
+// GetVersion returns the build version, falling back to the VCS revision recorded by
+// the Go toolchain, or "dev" when neither is available.
+func GetVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	gallerynet "gallery/core/net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gallery_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gallery_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	httpResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gallery_http_response_bytes_total",
+		Help: "Bytes written in response bodies by endpoint type, after compression.",
+	}, []string{"endpoint"})
+
+	derivativeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gallery_derivative_duration_seconds",
+		Help:    "Time taken to generate thumbnails and optimised images.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"kind"})
+
+	derivativeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gallery_derivative_failures_total",
+		Help: "Thumbnails and optimised images that could not be generated.",
+	}, []string{"kind"})
+
+	workerPoolDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gallery_worker_pool_depth",
+		Help: "Slots in use in the background generation worker pools.",
+	}, []string{"kind"})
+
+	workerPoolCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gallery_worker_pool_capacity",
+		Help: "Size of the background generation worker pools.",
+	}, []string{"kind"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gallery_sqlite_query_duration_seconds",
+		Help:    "Time taken by SQLite statements by statement type.",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+	}, []string{"statement"})
+)
+
+// Derivative kinds used as the kind label.
+const (
+	Thumbnail = "thumbnail"
+	Optimised = "optimised"
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveDerivative records a finished thumbnail or optimised generation, counting
+// it as a failure if err is set. Generation stopped by shutdown is not recorded.
+func ObserveDerivative(kind string, started time.Time, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		derivativeFailures.WithLabelValues(kind).Inc()
+		return
+	}
+	derivativeDuration.WithLabelValues(kind).Observe(time.Since(started).Seconds())
+}
+
+// SetWorkerPool records how many of a worker pool's slots are in use.
+func SetWorkerPool(kind string, depth int, capacity int) {
+	workerPoolDepth.WithLabelValues(kind).Set(float64(depth))
+	workerPoolCapacity.WithLabelValues(kind).Set(float64(capacity))
+}
+
+// ObserveQuery records the time taken by an SQL statement, labelled by its first keyword.
+func ObserveQuery(query string, started time.Time) {
+	queryDuration.WithLabelValues(statementType(query)).Observe(time.Since(started).Seconds())
+}
+
+func statementType(query string) string {
+	keyword, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	keyword = strings.ToLower(strings.TrimRight(keyword, ";\n\t"))
+	switch keyword {
+	case "select", "insert", "update", "delete", "create", "alter", "pragma", "begin", "commit", "rollback":
+		return keyword
+	}
+	return "other"
+}
+
+// Middleware records requests by the pattern of the ServeMux route that handled them,
+// so it must wrap the mux without changing the *http.Request it passes on.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := gallerynet.NewResponseRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.Status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+		httpResponseBytes.WithLabelValues(endpointType(route)).Add(float64(recorder.Bytes))
+	})
+}
+
+// endpointType groups routes so image bytes can be told apart from API and frontend traffic.
+func endpointType(route string) string {
+	_, path, _ := strings.Cut(route, " ")
+	if path == "" {
+		path = route
+	}
+	switch {
+	case strings.HasPrefix(path, "/api/thumbnail/"):
+		return "thumbnail"
+	case strings.HasPrefix(path, "/api/optimised/"):
+		return "optimised"
+	case strings.HasPrefix(path, "/api/original/"):
+		return "original"
+	case strings.HasPrefix(path, "/api/"):
+		return "api"
+	case path == "/":
+		return "frontend"
+	}
+	return "other"
+}
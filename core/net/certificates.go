@@ -0,0 +1,71 @@
+package net
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often the certificate files are checked for changes.
+const certificateCheckInterval = 30 * time.Second
+
+// CertificateReloader serves a TLS certificate from a cert/key pair on disk, and
+// loads it again when either file changes, so renewed certificates are picked up without a restart.
+type CertificateReloader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+	lastChecked time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *CertificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &certificate
+	c.modified = c.lastModified()
+	c.lastChecked = time.Now()
+	return nil
+}
+
+func (c *CertificateReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If the files have changed but
+// cannot be loaded, for example while only one of them has been replaced, the previous certificate is kept.
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.lastChecked) >= certificateCheckInterval {
+		c.lastChecked = time.Now()
+		if !c.lastModified().Equal(c.modified) {
+			if err := c.load(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the previous one", "error", err)
+			} else {
+				slog.Info("TLS certificate reloaded", "file", c.certFile)
+			}
+		}
+	}
+	return c.certificate, nil
+}
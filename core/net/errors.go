@@ -0,0 +1,58 @@
+package net
+
+import (
+	"encoding/json"
+	"gallery/core/types"
+	"net/http"
+)
+
+// errorCodes names the error code sent with each status. Statuses that are not listed
+// fall back to "bad_request" or "internal_error".
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// ErrorCode returns the error code sent with status.
+func ErrorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status < http.StatusInternalServerError {
+		return "bad_request"
+	}
+	return "internal_error"
+}
+
+// Error replies with a JSON error envelope in place of http.Error. Like http.Error, it
+// does not end the request, so the handler should return straight after.
+func Error(w http.ResponseWriter, message string, status int) {
+	ErrorWithDetails(w, message, status, nil)
+}
+
+// ErrorWithDetails is Error with extra context for the client, such as which parameter was invalid.
+func ErrorWithDetails(w http.ResponseWriter, message string, status int, details any) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(types.ErrorResponse{
+		Code:    ErrorCode(status),
+		Message: message,
+		Details: details,
+	})
+}
+
+// InternalError replies with a 500 without any detail of what failed, which is only logged.
+func InternalError(w http.ResponseWriter) {
+	Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
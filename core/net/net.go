@@ -1,7 +1,10 @@
 package net
 
 import (
+	"gallery/core/config"
+	stdnet "net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -10,3 +13,60 @@ func EnableCdnCaching(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 	w.Header().Set("Expires", expiryDate.String())
 }
+
+// EnablePrivateCaching lets the browser cache a response that a CDN or shared proxy must not.
+func EnablePrivateCaching(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+}
+
+// InNetworks reports whether ip falls inside one of networks.
+func InNetworks(ip string, networks []*stdnet.IPNet) bool {
+	parsed := stdnet.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range networks {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrustedProxy reports whether ip falls inside one of the configured TRUSTED_PROXIES ranges.
+func IsTrustedProxy(ip string) bool {
+	return InNetworks(ip, config.TrustedProxies)
+}
+
+// RemoteIP returns the address of the peer connected to the server.
+func RemoteIP(r *http.Request) string {
+	host, _, err := stdnet.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP returns the address of the client making the request. X-Forwarded-For is
+// only honoured when the request arrives from a trusted proxy, and is read right to
+// left so a client cannot spoof its address by sending its own header.
+func ClientIP(r *http.Request) string {
+	ip := RemoteIP(r)
+	if !IsTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if stdnet.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
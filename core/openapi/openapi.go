@@ -0,0 +1,130 @@
+// Package openapi serves the OpenAPI document describing the v2 API, and checks requests
+// to the v2 API against it before they reach their handlers.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"gallery/core/net"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+//go:embed openapi.json
+var document []byte
+
+// Handler serves the OpenAPI document.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(document)
+	})
+}
+
+// Middleware answers requests that the OpenAPI document does not allow with a 400, or a
+// 404 or 405 for paths and methods it does not have, so next only sees valid requests.
+// Authentication is left to next. It returns an error if the document is invalid.
+func Middleware(next http.Handler) (http.Handler, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(document)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := router.FindRoute(r)
+		if errors.Is(err, routers.ErrMethodNotAllowed) {
+			net.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			net.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				// uploads can be large, and the upload handler checks the file and title itself
+				ExcludeRequestBody: isMultipart(r),
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "multipart/")
+}
+
+// writeValidationError replies with a 400 naming the parameter or the part of the body
+// that was invalid.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var requestErr *openapi3filter.RequestError
+	if !errors.As(err, &requestErr) {
+		net.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := requestErr.Reason
+	details := map[string]string{}
+	if requestErr.Parameter != nil {
+		details["parameter"] = requestErr.Parameter.Name
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		message = schemaErr.Reason
+		if schemaErr.SchemaField == "format" {
+			// the reason goes on to give the format's regular expression
+			message = `string doesn't match the format "` + schemaErr.Schema.Format + `"`
+		}
+		if requestErr.RequestBody != nil {
+			details["pointer"] = jsonPointer(schemaErr.JSONPointer())
+		}
+	}
+	if message == "" {
+		message = requestErr.Error()
+	}
+	if requestErr.Parameter != nil && !strings.Contains(message, requestErr.Parameter.Name) {
+		message = requestErr.Parameter.Name + ": " + message
+	}
+
+	if len(details) == 0 {
+		net.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	net.ErrorWithDetails(w, message, http.StatusBadRequest, details)
+}
+
+// jsonPointer joins the parts of a path into the body into an RFC 6901 pointer, which is
+// empty for the body itself.
+func jsonPointer(parts []string) string {
+	pointer := ""
+	for _, part := range parts {
+		part = strings.ReplaceAll(part, "~", "~0")
+		pointer += "/" + strings.ReplaceAll(part, "/", "~1")
+	}
+	return pointer
+}
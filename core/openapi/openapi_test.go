@@ -0,0 +1,78 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	reached := false
+	handler, err := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		status  int
+		message string
+		details map[string]string
+	}{
+		{name: "valid update", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{"title": "Beach", "dateTaken": "2024-06-30T12:00:00Z"}`, status: http.StatusNoContent},
+		{name: "unknown property", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{"title": "Beach", "filePath": "/etc"}`, status: http.StatusBadRequest, message: `property "filePath" is unsupported`},
+		{name: "bad date-time", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{"dateTaken": "yesterday"}`, status: http.StatusBadRequest, message: `doesn't match the format "date-time"`, details: map[string]string{"pointer": "/dateTaken"}},
+		{name: "bad enum", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{"visibility": "secret"}`, status: http.StatusBadRequest, details: map[string]string{"pointer": "/visibility"}},
+		{name: "wrong type", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{"title": 5}`, status: http.StatusBadRequest, details: map[string]string{"pointer": "/title"}},
+		{name: "empty update", method: http.MethodPatch, target: "/api/v2/images/abc", body: `{}`, status: http.StatusBadRequest},
+		{name: "unknown batch property", method: http.MethodPost, target: "/api/v2/images/batch", body: `{"slugs": [], "all": true}`, status: http.StatusBadRequest, message: `property "all" is unsupported`},
+		{name: "valid date parameter", method: http.MethodGet, target: "/api/v2/images?from=2024-06-30", status: http.StatusNoContent},
+		{name: "bad date parameter", method: http.MethodGet, target: "/api/v2/images?from=30-06-2024", status: http.StatusBadRequest, message: `doesn't match the format "date"`, details: map[string]string{"parameter": "from"}},
+		{name: "unknown path", method: http.MethodGet, target: "/api/v2/nothing", status: http.StatusNotFound},
+		{name: "unknown method", method: http.MethodPut, target: "/api/v2/images", status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reached = false
+			request := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if test.body != "" {
+				request.Header.Set("Content-Type", "application/json")
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("returned %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if reached != (test.status == http.StatusNoContent) {
+				t.Errorf("reached the handler: %t", reached)
+			}
+			if test.message == "" && test.details == nil {
+				return
+			}
+			var response struct {
+				Message string            `json:"message"`
+				Details map[string]string `json:"details"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(response.Message, test.message) {
+				t.Errorf("message is %q, want it to contain %q", response.Message, test.message)
+			}
+			for key, value := range test.details {
+				if response.Details[key] != value {
+					t.Errorf("details[%q] is %q, want %q (message %q)", key, response.Details[key], value, response.Message)
+				}
+			}
+		})
+	}
+}
@@ -1,23 +1,33 @@
 package optimised
 
 import (
+	"context"
 	"gallery/core/config"
 	"gallery/core/database"
 	"gallery/core/logic"
+	"gallery/core/metrics"
 	"gallery/core/types"
 	"image/jpeg"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/disintegration/imaging"
 )
 
+// wgOptimised tracks the background population started by InitialiseOptimised.
 var wgOptimised sync.WaitGroup
 
+// missingOptimised counts the images the background population has not yet found or made
+// an optimised image for, so that reporting the backlog does not check every image on disk.
+var missingOptimised atomic.Int64
+
 func optimisedAlreadyExists(slug string) bool {
 	optimisedPath := filepath.Join(config.OptimisedDirectory, (slug + ".jpeg"))
 	if _, err := os.Stat(optimisedPath); os.IsNotExist(err) {
@@ -26,15 +36,18 @@ func optimisedAlreadyExists(slug string) bool {
 	return true
 }
 
-func GenerateOptimised(imageFile string, slug string) error {
+func GenerateOptimised(ctx context.Context, imageFile string, slug string) error {
 
 	if optimisedAlreadyExists(slug) {
 		return nil
 	}
 
+	started := time.Now()
 	source, err := imaging.Open(imageFile)
 	if err != nil {
-		log.Printf("Failed to open image: %v", err)
+		slog.ErrorContext(ctx, "Failed to open image", "file", imageFile, "error", err)
+		metrics.ObserveDerivative(metrics.Optimised, started, err)
+		return err
 	}
 
 	defer func() {
@@ -55,18 +68,15 @@ func GenerateOptimised(imageFile string, slug string) error {
 	optimisedPath := filepath.Join(config.OptimisedDirectory, slug) + ".jpeg"
 	optimisedImage := imaging.Resize(source, width, height, imaging.Lanczos)
 
-	f, err := os.Create(optimisedPath)
-	if err != nil {
-		log.Printf("Error creating file: %v", err)
-	}
-	defer f.Close()
-
-	err = jpeg.Encode(f, optimisedImage, nil)
+	err = logic.WriteFileAtomically(ctx, optimisedPath, func(w io.Writer) error {
+		return jpeg.Encode(w, optimisedImage, nil)
+	})
+	metrics.ObserveDerivative(metrics.Optimised, started, err)
 	if err != nil {
-		log.Printf("Error encoding image: %s", err)
+		slog.ErrorContext(ctx, "Error encoding image", "error", err)
 		return err
 	} else {
-		log.Printf("Optimised created for %s: %s", imageFile, optimisedPath)
+		slog.DebugContext(ctx, "Optimised created", "file", imageFile, "optimised", optimisedPath)
 		return nil
 	}
 }
@@ -76,7 +86,7 @@ func getOptimisedDirContents() ([]string, error) {
 
 	err := filepath.Walk(config.OptimisedDirectory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("Error opening Optimised directory: %s", err)
+			slog.Error("Error opening Optimised directory", "error", err)
 			return err
 		}
 		if !info.IsDir() {
@@ -84,35 +94,48 @@ func getOptimisedDirContents() ([]string, error) {
 		}
 		return nil
 	})
-	log.Printf("Found %d optimised", len(foundOptimised))
+	slog.Info("Found optimised images", "count", len(foundOptimised))
 	return foundOptimised, err
 }
 
-func populateOptimised() {
+func populateOptimised(ctx context.Context) {
 	numWorkers := runtime.NumCPU() / 2 // Use half the available CPU cores
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
 	workerPool := make(chan struct{}, numWorkers)
-	for _, row := range database.GetExistingMetadataFilePaths() {
-		workerPool <- struct{}{} // Block if the pool is full
-		wgOptimised.Add(1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	rows := database.GetExistingMetadataFilePaths()
+	missingOptimised.Store(int64(len(rows)))
+	for _, row := range rows {
+		select {
+		case workerPool <- struct{}{}: // Block if the pool is full
+		case <-ctx.Done():
+			slog.Info("Stopped generating optimised images", "reason", ctx.Err())
+			return
+		}
+		metrics.SetWorkerPool(metrics.Optimised, len(workerPool), cap(workerPool))
+		wg.Add(1)
 		go func(row types.MetadataFile) {
-			defer func() { <-workerPool }()
-			wgOptimised.Add(1)
-			defer wgOptimised.Done()
+			defer func() {
+				<-workerPool
+				metrics.SetWorkerPool(metrics.Optimised, len(workerPool), cap(workerPool))
+			}()
+			defer wg.Done()
 			slug := row.Slug
 			filePath := row.FilePath
 			fileName := row.FileName
 			imageFullPath := filepath.Join(filePath, fileName)
-			_ = GenerateOptimised(imageFullPath, slug)
+			_ = GenerateOptimised(ctx, imageFullPath, slug)
+			if optimisedAlreadyExists(slug) {
+				missingOptimised.Add(-1)
+			}
 		}(row)
 	}
-
-	wgOptimised.Wait()
 }
 
-func deleteExtraneousOptimised() {
+func deleteExtraneousOptimised(ctx context.Context) {
 	optimisedDirContents, _ := getOptimisedDirContents()
 	for _, optimised := range optimisedDirContents {
 		ext := strings.Split(filepath.Ext(optimised), ".")[1]
@@ -120,7 +143,7 @@ func deleteExtraneousOptimised() {
 			deleteOptimisedByFilename(optimised)
 		} else {
 			slug := strings.TrimSuffix(filepath.Base(optimised), filepath.Ext(optimised))
-			_, err := database.GetMetadataBySlug(slug)
+			_, err := database.GetMetadataBySlug(ctx, slug)
 			if err != nil {
 				deleteOptimisedByFilename(optimised)
 			}
@@ -131,50 +154,65 @@ func deleteExtraneousOptimised() {
 func deleteOptimisedByFilename(filename string) {
 	err := os.Remove(filename)
 	if err != nil {
-		log.Printf("Error deleting optimised %s: %s", filename, err)
+		slog.Error("Error deleting optimised", "file", filename, "error", err)
 		return
 	}
-	log.Printf("Optimised %s deleted", filename)
+	slog.Info("Optimised deleted", "file", filename)
 }
 
-func DeleteOptimisedBySlug(slug string) error {
+func DeleteOptimisedBySlug(ctx context.Context, slug string) error {
 	optimisedPath := filepath.Join(config.OptimisedDirectory, slug+".jpeg")
 	if _, err := os.Stat(optimisedPath); os.IsNotExist(err) {
-		log.Printf("Optimised file does not exist for slug %s", slug)
+		slog.WarnContext(ctx, "Optimised file does not exist", "slug", slug)
 		return err
 	}
 	err := os.Remove(optimisedPath)
 	if err != nil {
-		log.Printf("Error deleting optimised %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error deleting optimised", "slug", slug, "error", err)
 		return err
 	}
-	log.Printf("Optimised %s deleted", slug)
+	slog.InfoContext(ctx, "Optimised deleted", "slug", slug)
 
 	return err
 }
 
-func GetOptimisedBySlug(slug string) ([]byte, error) {
+func GetOptimisedBySlug(ctx context.Context, slug string) ([]byte, error) {
 	optimisedPath := filepath.Join(config.OptimisedDirectory, slug+".jpeg")
 	if _, err := os.Stat(optimisedPath); os.IsNotExist(err) {
-		log.Printf("Optimised file does not exist: %s", optimisedPath)
-		metadata, _ := database.GetMetadataBySlug(slug)
+		slog.DebugContext(ctx, "Optimised file does not exist, generating it", "file", optimisedPath)
+		metadata, _ := database.GetMetadataBySlug(ctx, slug)
 		filePath, _ := filepath.Abs(filepath.Join(metadata.FilePath, metadata.FileName))
-		err = GenerateOptimised(filePath, slug)
+		err = GenerateOptimised(context.WithoutCancel(ctx), filePath, slug)
 		if err != nil {
-			log.Printf("Error getting optimised for slug %s: %s", slug, err)
+			slog.ErrorContext(ctx, "Error getting optimised", "slug", slug, "error", err)
 			return nil, err
 		}
 	}
 	optimisedBlob, err := os.ReadFile(optimisedPath)
 	if err != nil {
-		log.Printf("Error reading optimised for slug %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error reading optimised", "slug", slug, "error", err)
 		return nil, err
 	}
 	return optimisedBlob, nil
 }
 
-func InitialiseOptimised() {
+// CountMissingOptimised returns the number of images that do not have an optimised image yet, as
+// counted by the background population, including those it failed to make one for.
+func CountMissingOptimised() int {
+	return int(missingOptimised.Load())
+}
+
+func InitialiseOptimised(ctx context.Context) {
 	logic.CreateDir(config.OptimisedDirectory)
-	deleteExtraneousOptimised()
-	go populateOptimised()
+	deleteExtraneousOptimised(ctx)
+	wgOptimised.Add(1)
+	go func() {
+		defer wgOptimised.Done()
+		populateOptimised(ctx)
+	}()
+}
+
+// WaitForOptimised waits for background optimised generation to stop after its context is cancelled.
+func WaitForOptimised() {
+	wgOptimised.Wait()
 }
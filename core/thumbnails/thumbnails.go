@@ -1,23 +1,33 @@
 package thumbnails
 
 import (
+	"context"
 	"gallery/core/config"
 	"gallery/core/database"
 	"gallery/core/logic"
+	"gallery/core/metrics"
 	"gallery/core/types"
 	"image/jpeg"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/disintegration/imaging"
 )
 
+// wgThumbnails tracks the background population started by InitialiseThumbnails.
 var wgThumbnails sync.WaitGroup
 
+// missingThumbnails counts the images the background population has not yet found or made
+// a thumbnail for, so that reporting the backlog does not check every image on disk.
+var missingThumbnails atomic.Int64
+
 func thumbnailAlreadyExists(slug string) bool {
 	thumbnailPath := filepath.Join(config.ThumbnailDirectory, (slug + ".jpeg"))
 	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
@@ -26,15 +36,18 @@ func thumbnailAlreadyExists(slug string) bool {
 	return true
 }
 
-func GenerateThumbnail(imageFile string, slug string) {
+func GenerateThumbnail(ctx context.Context, imageFile string, slug string) {
 
 	if thumbnailAlreadyExists(slug) {
 		return
 	}
 
+	started := time.Now()
 	source, err := imaging.Open(imageFile)
 	if err != nil {
-		log.Printf("Failed to open image: %v", err)
+		slog.ErrorContext(ctx, "Failed to open image", "file", imageFile, "error", err)
+		metrics.ObserveDerivative(metrics.Thumbnail, started, err)
+		return
 	}
 
 	defer func() {
@@ -55,17 +68,14 @@ func GenerateThumbnail(imageFile string, slug string) {
 	thumbnailPath := filepath.Join(config.ThumbnailDirectory, slug) + ".jpeg"
 	thumbnailImage := imaging.Resize(source, width, height, imaging.Lanczos)
 
-	f, err := os.Create(thumbnailPath)
-	if err != nil {
-		log.Printf("Error creating file: %v", err)
-	}
-	defer f.Close()
-
-	err = jpeg.Encode(f, thumbnailImage, nil)
+	err = logic.WriteFileAtomically(ctx, thumbnailPath, func(w io.Writer) error {
+		return jpeg.Encode(w, thumbnailImage, nil)
+	})
+	metrics.ObserveDerivative(metrics.Thumbnail, started, err)
 	if err != nil {
-		log.Printf("Error encoding image: %s", err)
+		slog.ErrorContext(ctx, "Error encoding image", "error", err)
 	} else {
-		log.Printf("Thumbnail created for %s: %s", imageFile, thumbnailPath)
+		slog.DebugContext(ctx, "Thumbnail created", "file", imageFile, "thumbnail", thumbnailPath)
 	}
 }
 
@@ -74,7 +84,7 @@ func getThumbnailDirContents() ([]string, error) {
 
 	err := filepath.Walk(config.ThumbnailDirectory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("Error opening Thumbnail directory: %s", err)
+			slog.Error("Error opening Thumbnail directory", "error", err)
 			return err
 		}
 		if !info.IsDir() {
@@ -82,35 +92,48 @@ func getThumbnailDirContents() ([]string, error) {
 		}
 		return nil
 	})
-	log.Printf("Found %d thumbnail", len(foundThumbnail))
+	slog.Info("Found thumbnails", "count", len(foundThumbnail))
 	return foundThumbnail, err
 }
 
-func populateThumbnails() {
+func populateThumbnails(ctx context.Context) {
 	numWorkers := runtime.NumCPU() / 2 // Use half the available CPU cores
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
 	workerPool := make(chan struct{}, numWorkers)
-	for _, row := range database.GetExistingMetadataFilePaths() {
-		workerPool <- struct{}{} // Block if the pool is full
-		wgThumbnails.Add(1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	rows := database.GetExistingMetadataFilePaths()
+	missingThumbnails.Store(int64(len(rows)))
+	for _, row := range rows {
+		select {
+		case workerPool <- struct{}{}: // Block if the pool is full
+		case <-ctx.Done():
+			slog.Info("Stopped generating thumbnails", "reason", ctx.Err())
+			return
+		}
+		metrics.SetWorkerPool(metrics.Thumbnail, len(workerPool), cap(workerPool))
+		wg.Add(1)
 		go func(row types.MetadataFile) {
-			defer func() { <-workerPool }()
-			wgThumbnails.Add(1)
-			defer wgThumbnails.Done()
+			defer func() {
+				<-workerPool
+				metrics.SetWorkerPool(metrics.Thumbnail, len(workerPool), cap(workerPool))
+			}()
+			defer wg.Done()
 			slug := row.Slug
 			filePath := row.FilePath
 			fileName := row.FileName
 			imageFullPath := filepath.Join(filePath, fileName)
-			GenerateThumbnail(imageFullPath, slug)
+			GenerateThumbnail(ctx, imageFullPath, slug)
+			if thumbnailAlreadyExists(slug) {
+				missingThumbnails.Add(-1)
+			}
 		}(row)
 	}
-
-	wgThumbnails.Wait()
 }
 
-func deleteExtraneousThumbnails() {
+func deleteExtraneousThumbnails(ctx context.Context) {
 	thumbnailDirContents, _ := getThumbnailDirContents()
 	for _, thumbnail := range thumbnailDirContents {
 		ext := strings.Split(filepath.Ext(thumbnail), ".")[1]
@@ -118,9 +141,9 @@ func deleteExtraneousThumbnails() {
 			deleteThumbnailByFilename(thumbnail)
 		} else {
 			slug := strings.TrimSuffix(filepath.Base(thumbnail), filepath.Ext(thumbnail))
-			_, err := database.GetMetadataBySlug(slug)
+			_, err := database.GetMetadataBySlug(ctx, slug)
 			if err != nil {
-				log.Println(slug)
+				slog.Debug("Thumbnail has no metadata", "slug", slug)
 				deleteThumbnailByFilename(thumbnail)
 			}
 		}
@@ -130,44 +153,59 @@ func deleteExtraneousThumbnails() {
 func deleteThumbnailByFilename(filename string) {
 	err := os.Remove(filename)
 	if err != nil {
-		log.Printf("Error deleting thumbnail %s: %s", filename, err)
+		slog.Error("Error deleting thumbnail", "file", filename, "error", err)
 		return
 	}
-	log.Printf("Thumbnail %s deleted", filename)
+	slog.Info("Thumbnail deleted", "file", filename)
 }
 
-func DeleteThumbnailBySlug(slug string) error {
+func DeleteThumbnailBySlug(ctx context.Context, slug string) error {
 	thumbnailPath := filepath.Join(config.ThumbnailDirectory, slug+".jpeg")
 	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-		log.Printf("Thumbnail file does not exist for slug %s", slug)
+		slog.WarnContext(ctx, "Thumbnail file does not exist", "slug", slug)
 		return err
 	}
 	err := os.Remove(thumbnailPath)
 	if err != nil {
-		log.Printf("Error deleting thumbnail %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error deleting thumbnail", "slug", slug, "error", err)
 		return err
 	}
-	log.Printf("Thumbnail %s deleted", slug)
+	slog.InfoContext(ctx, "Thumbnail deleted", "slug", slug)
 
 	return err
 }
 
-func GetThumbnailBySlug(slug string) ([]byte, error) {
+func GetThumbnailBySlug(ctx context.Context, slug string) ([]byte, error) {
 	thumbnailPath := filepath.Join(config.ThumbnailDirectory, slug+".jpeg")
 	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-		log.Printf("Thumbnail file does not exist: %s", thumbnailPath)
+		slog.WarnContext(ctx, "Thumbnail file does not exist", "file", thumbnailPath)
 		return nil, err
 	}
 	thumbnailBlob, err := os.ReadFile(thumbnailPath)
 	if err != nil {
-		log.Printf("Error reading thumbnail for slug %s: %s", slug, err)
+		slog.ErrorContext(ctx, "Error reading thumbnail", "slug", slug, "error", err)
 		return nil, err
 	}
 	return thumbnailBlob, nil
 }
 
-func InitialiseThumbnails() {
+// CountMissingThumbnails returns the number of images that do not have a thumbnail yet, as
+// counted by the background population, including those it failed to make one for.
+func CountMissingThumbnails() int {
+	return int(missingThumbnails.Load())
+}
+
+func InitialiseThumbnails(ctx context.Context) {
 	logic.CreateDir(config.ThumbnailDirectory)
-	deleteExtraneousThumbnails()
-	go populateThumbnails()
+	deleteExtraneousThumbnails(ctx)
+	wgThumbnails.Add(1)
+	go func() {
+		defer wgThumbnails.Done()
+		populateThumbnails(ctx)
+	}()
+}
+
+// WaitForThumbnails waits for background thumbnail generation to stop after its context is cancelled.
+func WaitForThumbnails() {
+	wgThumbnails.Wait()
 }
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -110,18 +111,34 @@ type ImageMetadataWithDimensions struct {
 	ExposureMode     string    `json:"exposureMode"`
 	WhiteBalance     string    `json:"whiteBalance"`
 	WhiteBalanceMode string    `json:"whiteBalanceMode"`
+	Visibility       string    `json:"visibility"`
 	Width            int       `json:"width"`
 	Height           int       `json:"height"`
 	Orientation      string    `json:"orientation"`
 	Panoramic        bool      `json:"panoramic"`
 }
 
+// ImageDetails is everything the image page shows about an image, loaded for many images
+// at once by the batch metadata endpoint.
+type ImageDetails struct {
+	ImageMetadataWithDimensions
+	Placeholder string   `json:"placeholder"`
+	Tags        []string `json:"tags"`
+	Albums      []string `json:"albums"`
+	// InAlbums is every album the image is in, which decides who can see it and which of
+	// its albums are listed.
+	InAlbums []Album `json:"-"`
+	// Pending is set for uploads waiting for moderation.
+	Pending bool `json:"-"`
+}
+
 type DimensionsRow struct {
 	ImageSlug   string
 	Width       int
 	Height      int
 	Orientation string
 	Panoramic   bool
+	Placeholder string
 }
 
 type SlugWithDimensions struct {
@@ -130,6 +147,49 @@ type SlugWithDimensions struct {
 	Height int    `json:"height"`
 }
 
+// SlugQuery filters the slug listings, newest first. Dates are inclusive and given as YYYY-MM-DD.
+type SlugQuery struct {
+	IncludeHidden bool
+	// IncludePending lists uploads still waiting for moderation, which only admins can see.
+	IncludePending bool
+	From           string
+	To             string
+	Camera         string
+	Lens           string
+	Orientation    string
+	AlbumSlug      string
+	// UnlockedAlbums are the password protected albums the request has unlocked. Without
+	// IncludeHidden, images that are only in other password protected albums are left out.
+	UnlockedAlbums []string
+	// After continues the listing from the last image of the previous page.
+	After *SlugCursor
+	// Limit is the page size, or 0 to list every matching image.
+	Limit int
+}
+
+// SlugCursor is the sort key of the last image on a page.
+type SlugCursor struct {
+	DateTaken string `json:"d"`
+	Slug      string `json:"s"`
+}
+
+// ListedImage is an image in the image listing, with what a client needs to lay it out
+// and show a placeholder before the thumbnail has loaded.
+type ListedImage struct {
+	Slug        string    `json:"slug"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Title       string    `json:"title"`
+	DateTaken   time.Time `json:"dateTaken"`
+	Placeholder string    `json:"placeholder"`
+}
+
+// ListedSlug is an image in a slug listing, with the sort key it was listed by.
+type ListedSlug struct {
+	ListedImage
+	Cursor SlugCursor
+}
+
 type MetadataFile struct {
 	Slug     string
 	FilePath string
@@ -141,8 +201,32 @@ type Album struct {
 	Name        string
 	DateCreated string
 	CoverSlug   string
+	Visibility  string
+	// PasswordHash is set when anonymous visitors need a password to open the album.
+	PasswordHash string `json:"-"`
+	Protected    bool
+}
+
+// AlbumV2 is an album as returned by the v2 API, which uses camelCase names throughout.
+type AlbumV2 struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	DateCreated string `json:"dateCreated"`
+	CoverSlug   string `json:"coverSlug"`
+	Visibility  string `json:"visibility"`
+	Protected   bool   `json:"protected"`
 }
 
+// Public items are listed for everyone, unlisted items can be viewed by anyone with
+// the link but are not listed for anonymous visitors, and private items need a login or share link.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+var Visibilities = []string{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
 type Link struct {
 	AlbumSlug string
 	ImageSlug string
@@ -166,3 +250,202 @@ type TagsUpload struct {
 	Tags      []string
 	ImageSlug string
 }
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+	// RoleUploader is a guest who can only upload into their drop-box album, so it ranks below every other role.
+	RoleUploader = "uploader"
+)
+
+var RoleRanks = map[string]int{
+	RoleUploader: 0,
+	RoleViewer:   1,
+	RoleEditor:   2,
+	RoleAdmin:    3,
+}
+
+type User struct {
+	Username    string `json:"username"`
+	Password    string `json:"-"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	DateCreated string `json:"dateCreated"`
+	TotpEnabled bool   `json:"totpEnabled"`
+	TotpSecret  string `json:"-"`
+	// TotpLastStep is the most recent time step accepted, used to reject replayed codes.
+	TotpLastStep int64 `json:"-"`
+	// UploadAlbum is the album an uploader's images are added to.
+	UploadAlbum string `json:"uploadAlbum,omitempty"`
+	// OidcIssuer and OidcSubject identify the identity provider account that signs in as
+	// this user, and are empty for users who cannot use single sign-on.
+	OidcIssuer  string `json:"oidcIssuer,omitempty"`
+	OidcSubject string `json:"oidcSubject,omitempty"`
+}
+
+type NewUser struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Role        string `json:"role"`
+	UploadAlbum string `json:"uploadAlbum"`
+	OidcIssuer  string `json:"-"`
+	OidcSubject string `json:"-"`
+}
+
+// PendingUpload is an image from a guest uploader waiting for an admin to approve it.
+type PendingUpload struct {
+	Slug        string    `json:"slug"`
+	FileName    string    `json:"fileName"`
+	AlbumSlug   string    `json:"albumSlug"`
+	UploadedBy  string    `json:"uploadedBy"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+type Session struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	DateCreated time.Time `json:"dateCreated"`
+	LastSeen    time.Time `json:"lastSeen"`
+	IPAddress   string    `json:"ipAddress"`
+	UserAgent   string    `json:"userAgent"`
+	Current     bool      `json:"current"`
+}
+
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeEdit   = "edit"
+	ScopeAdmin  = "admin"
+)
+
+// ScopeRoles is the minimum role a user needs to hold a token with each scope.
+var ScopeRoles = map[string]string{
+	ScopeRead:   RoleViewer,
+	ScopeUpload: RoleEditor,
+	ScopeEdit:   RoleEditor,
+	ScopeAdmin:  RoleAdmin,
+}
+
+type ApiToken struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Username    string     `json:"username"`
+	Scopes      []string   `json:"scopes"`
+	DateCreated time.Time  `json:"dateCreated"`
+	LastUsed    *time.Time `json:"lastUsed"`
+}
+
+type NewApiToken struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type CreatedApiToken struct {
+	ApiToken
+	Token string `json:"token"`
+}
+
+type AuditEntry struct {
+	ID          int64           `json:"id"`
+	DateCreated time.Time       `json:"dateCreated"`
+	Actor       string          `json:"actor"`
+	Action      string          `json:"action"`
+	Target      string          `json:"target"`
+	AlbumSlug   string          `json:"albumSlug"`
+	Before      json.RawMessage `json:"before,omitempty"`
+	After       json.RawMessage `json:"after,omitempty"`
+	IPAddress   string          `json:"ipAddress"`
+}
+
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	Target    string
+	AlbumSlug string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+}
+
+type ShareLink struct {
+	ID           string     `json:"id"`
+	AlbumSlug    string     `json:"albumSlug,omitempty"`
+	ImageSlug    string     `json:"imageSlug,omitempty"`
+	PasswordHash string     `json:"-"`
+	Secret       string     `json:"-"`
+	HasPassword  bool       `json:"hasPassword"`
+	Expires      *time.Time `json:"expires"`
+	MaxViews     int        `json:"maxViews"`
+	Views        int        `json:"views"`
+	CreatedBy    string     `json:"createdBy"`
+	DateCreated  time.Time  `json:"dateCreated"`
+}
+
+type NewShareLink struct {
+	AlbumSlug string     `json:"albumSlug"`
+	ImageSlug string     `json:"imageSlug"`
+	Password  string     `json:"password"`
+	Expires   *time.Time `json:"expires"`
+	MaxViews  int        `json:"maxViews"`
+}
+
+// CreatedShareLink includes the token, which is only returned when the link is created.
+type CreatedShareLink struct {
+	ShareLink
+	Token string `json:"token"`
+}
+
+type SharedContent struct {
+	AlbumSlug  string     `json:"albumSlug,omitempty"`
+	AlbumName  string     `json:"albumName,omitempty"`
+	ImageSlugs []string   `json:"imageSlugs"`
+	Expires    *time.Time `json:"expires"`
+}
+
+// Readiness reports whether the gallery can serve requests, with the result of each check.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+type DiskUsage struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"totalBytes"`
+	UsedBytes  uint64 `json:"usedBytes"`
+	FreeBytes  uint64 `json:"freeBytes"`
+}
+
+// DerivativeBacklog counts images still waiting for background processing.
+type DerivativeBacklog struct {
+	Thumbnails int `json:"thumbnails"`
+	Optimised  int `json:"optimised"`
+	Dimensions int `json:"dimensions"`
+}
+
+type Status struct {
+	Version        string               `json:"version"`
+	BootTime       time.Time            `json:"bootTime"`
+	UptimeSeconds  int64                `json:"uptimeSeconds"`
+	Images         map[string]int       `json:"images"`
+	PendingUploads int                  `json:"pendingUploads"`
+	Backlog        DerivativeBacklog    `json:"backlog"`
+	Disk           map[string]DiskUsage `json:"disk"`
+}
+
+// ErrorResponse is the body of every API error. Code is a stable identifier for clients
+// to branch on, Message is for people, and Details carries extra context such as which
+// parameter was invalid.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
@@ -5,6 +5,8 @@ export interface Album {
   Name: string
   DateCreated: string
   CoverSlug: string
+  Visibility: string
+  Protected: boolean
 }
 
 export async function getAllAlbums(): Promise<Album[]> {
@@ -21,7 +23,7 @@ export async function getAllAlbums(): Promise<Album[]> {
 
 export async function getAlbumCoverSlugThumbnailAddress(album: Album) {
   const imageSlug = album.CoverSlug
-  return `/api/thumbnail/${imageSlug}`
+  return `api/thumbnail/${imageSlug}`
 }
 
 export async function addImageToAlbum(albumSlug: string, imageSlug: string) {
@@ -1,5 +1,19 @@
-export async function backendFetchRequest(path: string, options = {}): Promise<Response> {
-  const url = `/api/${path}`
+const safeMethods = ['GET', 'HEAD', 'OPTIONS']
+
+function getCsrfToken(): string | undefined {
+  const match = document.cookie.match(/(?:^|;\s*)csrfToken=([^;]*)/)
+  return match ? decodeURIComponent(match[1]) : undefined
+}
+
+export async function backendFetchRequest(path: string, options: RequestInit = {}): Promise<Response> {
+  const url = `api/${path}`
+  const method = (options.method ?? 'GET').toUpperCase()
+  const csrfToken = getCsrfToken()
+  if (!safeMethods.includes(method) && csrfToken) {
+    const headers = new Headers(options.headers)
+    headers.set('X-CSRF-Token', csrfToken)
+    options = { ...options, headers }
+  }
   const response = await fetch(url, options)
   return response
 }
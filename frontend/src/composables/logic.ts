@@ -6,5 +6,5 @@ export function niceDate(dateString: string): string {
 }
 
 export function getThumbnailPath(slug: string) {
-  return `/api/thumbnail/${slug}`
+  return `api/thumbnail/${slug}`
 }
@@ -22,7 +22,7 @@ const scrollBehavior: RouterScrollBehavior = async (to, from, savedPosition) =>
 }
 
 const router = createRouter({
-  history: createWebHistory(import.meta.env.BASE_URL),
+  history: createWebHistory(),
   routes,
   scrollBehavior,
 })
@@ -4,6 +4,21 @@ export interface SlugWithDimensions {
   height: number
 }
 
+export interface ListedImage {
+  slug: string
+  width: number
+  height: number
+  title: string
+  dateTaken: string
+  placeholder: string
+}
+
+export interface Page<T> {
+  items: T[]
+  nextCursor?: string
+  total: number
+}
+
 export interface ImageMetadata {
   filePath: string
   fileName: string
@@ -22,6 +37,7 @@ export interface ImageMetadata {
   exposureMode: string
   whiteBalance: string
   whiteBalanceMode: string
+  visibility: 'public' | 'unlisted' | 'private'
   width: number
   height: number
   orientation: string
@@ -10,6 +10,8 @@ import VueRouter from 'vue-router/vite'
 
 // https://vitejs.dev/config/
 export default defineConfig({
+  // assets are resolved against the <base> tag, which the server points at BASE_PATH
+  base: './',
   plugins: [
     VueRouter({
       dts: 'route-map.d.ts',
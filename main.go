@@ -1,19 +1,69 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"gallery/core/auth"
 	"gallery/core/config"
 	"gallery/core/database"
+	"gallery/core/logging"
+	"gallery/core/logic"
 	"gallery/core/optimised"
 	"gallery/core/thumbnails"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	config.LoadEnv()
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		if err := auth.HashPasswordCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "hash-password:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		if err := config.CheckCommand(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := config.LoadEnv(); err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+	logging.Setup()
+	// SIGTERM stops the server and background workers, then closes the database cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	logic.GetBootTime() // uptime is measured from here rather than from the first request
 	database.Initialise()
-	database.InitialiseMetadata()
-	database.InitialiseTags()
-	database.InitialiseDimensions()
-	thumbnails.InitialiseThumbnails()
-	optimised.InitialiseOptimised()
-	StartServer()
+	auth.InitialiseUsers()
+	auth.InitialiseSessions(ctx)
+	auth.InitialiseLoginAttempts(ctx)
+	database.InitialiseMetadata(ctx)
+	// a signal while the image directory is scanned stops startup here
+	if ctx.Err() == nil {
+		database.InitialiseTags()
+
+		database.InitialiseDimensions(ctx)
+		thumbnails.InitialiseThumbnails(ctx)
+		optimised.InitialiseOptimised(ctx)
+		StartServer(ctx)
+	}
+
+	slog.Info("Waiting for background workers to stop")
+	auth.WaitForSessions()
+	database.WaitForDimensions()
+	thumbnails.WaitForThumbnails()
+	optimised.WaitForOptimised()
+	database.Close()
+	slog.Info("Shutdown complete")
 }
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"embed"
 	"gallery/core/auth"
+	"gallery/core/config"
 	"gallery/core/handlers"
+	"gallery/core/logging"
 	"gallery/core/logic"
+	"gallery/core/metrics"
+	gallerynet "gallery/core/net"
+	"gallery/core/openapi"
+	"gallery/core/types"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 	"time"
@@ -22,90 +33,251 @@ var dist embed.FS
 var distSubFS fs.FS
 var err error
 
-func StartServer() {
+// shutdownTimeout is how long in-flight requests get to finish once shutdown starts.
+const shutdownTimeout = 30 * time.Second
+
+// StartServer serves the gallery until ctx is cancelled, then stops accepting
+// connections and waits for in-flight requests before returning.
+func StartServer(ctx context.Context) {
 	router := http.NewServeMux()
 
 	distSubFS, err = fs.Sub(dist, "frontend/dist")
 	if err != nil {
-		log.Fatal("Failed to create sub filesystem:", err)
+		slog.Error("Failed to create sub filesystem", "error", err)
+		os.Exit(1)
 	}
 
 	router.HandleFunc("/", HandleFrontend)
+	router.HandleFunc("GET /healthz", handlers.HandleHealthz)
+	router.HandleFunc("GET /readyz", handlers.HandleReadyz)
+	router.Handle("GET /metrics", auth.AuthMiddleware(types.RoleViewer, types.ScopeRead, metrics.Handler()))
 
 	//auth
 	router.HandleFunc("POST /api/login", auth.LoginHandler)
-	router.HandleFunc("GET /api/logout", auth.LogoutHandler)
+	router.HandleFunc("POST /api/login/totp", auth.LoginTotpHandler)
+	router.HandleFunc("POST /api/logout", auth.LogoutHandler)
+	router.HandleFunc("GET /api/oidc", auth.HandleGetOidc)
+	router.HandleFunc("GET /api/oidc/login", auth.OidcLoginHandler)
+	router.HandleFunc("GET /api/oidc/callback", auth.OidcCallbackHandler)
 	router.HandleFunc("GET /api/check-session", auth.CheckSessionHandler)
+	router.HandleFunc("POST /api/shared/{token}", auth.OpenShareLinkHandler)
+	router.HandleFunc("POST /api/albums/{albumSlug}/unlock", auth.UnlockAlbumHandler)
+
+	router.Handle("GET /api/sessions", auth.AuthMiddleware(types.RoleViewer, types.ScopeRead, http.HandlerFunc(auth.HandleGetSessions)))
+	router.Handle("DELETE /api/sessions/{id}", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteSession)))
+
+	router.Handle("POST /api/totp/enroll", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandlePostTotpEnroll)))
+	router.Handle("POST /api/totp/confirm", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandlePostTotpConfirm)))
+	router.Handle("DELETE /api/totp", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteTotp)))
+	router.Handle("GET /api/status", auth.AuthMiddleware(types.RoleViewer, types.ScopeRead, http.HandlerFunc(handlers.HandleGetStatus)))
+	router.Handle("GET /api/tokens", auth.AuthMiddleware(types.RoleViewer, types.ScopeRead, http.HandlerFunc(auth.HandleGetApiTokens)))
+	router.Handle("POST /api/tokens", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandlePostApiToken)))
+	router.Handle("DELETE /api/tokens/{id}", auth.AuthMiddleware(types.RoleViewer, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteApiToken)))
 
 	// standard routes
 	router.HandleFunc("GET /api/slugs", handlers.HandleGetSlugs)
 	router.HandleFunc("GET /api/slugs/random", handlers.HandleGetRandomSlugs)
 	router.HandleFunc("GET /api/slugs/with-dimensions", handlers.HandleGetSlugsWithDimensions)
+	router.HandleFunc("GET /api/images", handlers.HandleGetImages)
 	router.HandleFunc("GET /api/metadata/{slug}", handlers.HandleGetMetadataBySlug)
+	router.HandleFunc("POST /api/metadata/batch", handlers.HandlePostMetadataBatch)
 	router.HandleFunc("GET /api/thumbnail/{slug}", handlers.HandleGetThumbnailBySlug)
 	router.HandleFunc("GET /api/optimised/{slug}", handlers.HandleGetOptimisedBySlug)
 	router.HandleFunc("GET /api/original/{slug}", handlers.HandleGetOriginalImageBlobBySlug)
 	router.HandleFunc("GET /api/albums/{albumSlug}", handlers.HandleGetAlbum)
 	router.HandleFunc("GET /api/albums", handlers.HandleGetAllAlbums)
 	router.HandleFunc("GET /api/links/album/{albumSlug}", handlers.HandleGetAlbumLinks)
-	router.HandleFunc("GET /api/links/image/{imageSlug}", handlers.HandleGetImageLinks)
+	router.HandleFunc("GET /api/links/image/{slug}", handlers.HandleGetImageLinks)
 	router.HandleFunc("GET /api/tags", handlers.HandleGetTags)
-	router.HandleFunc("GET /api/tags/{imageSlug}", handlers.HandleGetTagsBySlug)
+	router.HandleFunc("GET /api/tags/{slug}", handlers.HandleGetTagsBySlug)
 	router.HandleFunc("GET /api/slugs/tag/{tag}", handlers.HandleGetSlugsByTag)
-	router.HandleFunc("GET /api/dimensions/{imageSlug}", handlers.HandleGetDimensionsBySlug)
+	router.HandleFunc("GET /api/dimensions/{slug}", handlers.HandleGetDimensionsBySlug)
 
 	// authenticated routes
-	router.Handle("DELETE /api/slugs/{slug}", auth.AuthMiddleware(http.HandlerFunc(handlers.HandleDeleteImageBySlug)))
-	router.Handle("PATCH /api/metadata/{slug}", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePatchMetadataBySlug)))
-	router.Handle("PATCH /api/albums/cover", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePatchAlbumCover)))
-	router.Handle("PATCH /api/albums/name", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePatchAlbumName)))
-	router.Handle("POST /api/albums", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePostAlbumRow)))
-	router.Handle("DELETE /api/albums/{albumSlug}", auth.AuthMiddleware(http.HandlerFunc(handlers.HandleDeleteAlbumRow)))
-	router.Handle("POST /api/link", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePostLinkRow)))
-	router.Handle("DELETE /api/link", auth.AuthMiddleware(http.HandlerFunc(handlers.HandleDeleteAlbumLinkRow)))
-	router.Handle("POST /api/links", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePostLinkRows)))
-	router.Handle("POST /api/upload", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePostNewImage)))
-	router.Handle("POST /api/tags", auth.AuthMiddleware(http.HandlerFunc(handlers.HandlePostNewTags)))
-	router.Handle("DELETE /api/tags", auth.AuthMiddleware(http.HandlerFunc(handlers.HandleDeleteTagRow)))
-
-	handler := cors.AllowAll().Handler(
-		compress.Middleware(router),
-	)
-
-	var serverAddress = ":8080"
-	log.Println("Application running at http://localhost:8080")
-	err := http.ListenAndServe(serverAddress, handler)
+	router.Handle("DELETE /api/slugs/{slug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteImageBySlug)))
+	router.Handle("PATCH /api/metadata/{slug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchMetadataBySlug)))
+	router.Handle("PATCH /api/albums/cover", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchAlbumCover)))
+	router.Handle("PATCH /api/albums/password", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchAlbumPassword)))
+	router.Handle("PATCH /api/albums/visibility", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchAlbumVisibility)))
+	router.Handle("PATCH /api/albums/name", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchAlbumName)))
+	router.Handle("POST /api/albums", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostAlbumRow)))
+	router.Handle("DELETE /api/albums/{albumSlug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteAlbumRow)))
+	router.Handle("POST /api/link", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostLinkRow)))
+	router.Handle("DELETE /api/link", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteAlbumLinkRow)))
+	router.Handle("POST /api/links", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostLinkRows)))
+	router.Handle("POST /api/upload", auth.UploadMiddleware(http.HandlerFunc(handlers.HandlePostNewImage)))
+	router.Handle("POST /api/tags", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostNewTags)))
+	router.Handle("DELETE /api/tags", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteTagRow)))
+	router.Handle("POST /api/shares", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(auth.HandlePostShareLink)))
+
+	// admin routes
+	router.Handle("GET /api/users", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleGetUsers)))
+	router.Handle("POST /api/users", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandlePostUser)))
+	router.Handle("PATCH /api/users/{username}", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandlePatchUserDisabled)))
+	router.Handle("DELETE /api/users/{username}", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteUser)))
+	router.Handle("DELETE /api/users/{username}/totp", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteUserTotp)))
+	router.Handle("PUT /api/users/{username}/oidc", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandlePutUserOidc)))
+	router.Handle("DELETE /api/users/{username}/oidc", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteUserOidc)))
+	router.Handle("GET /api/audit", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleGetAuditLog)))
+	router.Handle("GET /api/moderation", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(handlers.HandleGetPendingUploads)))
+	router.Handle("POST /api/moderation/{slug}", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(handlers.HandleApprovePendingUpload)))
+	router.Handle("DELETE /api/moderation/{slug}", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(handlers.HandleRejectPendingUpload)))
+	router.Handle("GET /api/shares", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleGetShareLinks)))
+	router.Handle("DELETE /api/shares/{id}", auth.AuthMiddleware(types.RoleAdmin, types.ScopeAdmin, http.HandlerFunc(auth.HandleDeleteShareLink)))
+
+	// v2, which will replace the routes above
+	v2Router := http.NewServeMux()
+	v2Router.HandleFunc("GET /api/v2/images", handlers.HandleGetImages)
+	v2Router.Handle("POST /api/v2/images", auth.UploadMiddleware(http.HandlerFunc(handlers.HandlePostNewImage)))
+	v2Router.HandleFunc("GET /api/v2/images/random", handlers.HandleGetRandomSlugs)
+	v2Router.HandleFunc("POST /api/v2/images/batch", handlers.HandlePostMetadataBatch)
+	v2Router.HandleFunc("GET /api/v2/images/{slug}", handlers.HandleGetMetadataBySlug)
+	v2Router.Handle("PATCH /api/v2/images/{slug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchImageV2)))
+	v2Router.Handle("DELETE /api/v2/images/{slug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteImageV2)))
+	v2Router.HandleFunc("GET /api/v2/images/{slug}/thumbnail", handlers.HandleGetThumbnailBySlug)
+	v2Router.HandleFunc("GET /api/v2/images/{slug}/optimised", handlers.HandleGetOptimisedBySlug)
+	v2Router.HandleFunc("GET /api/v2/images/{slug}/original", handlers.HandleGetOriginalImageBlobBySlug)
+	v2Router.HandleFunc("GET /api/v2/images/{slug}/tags", handlers.HandleGetTagsBySlug)
+	v2Router.Handle("POST /api/v2/images/{slug}/tags", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostImageTagV2)))
+	v2Router.Handle("DELETE /api/v2/images/{slug}/tags/{tag}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteImageTagV2)))
+	v2Router.HandleFunc("GET /api/v2/images/{slug}/albums", handlers.HandleGetImageLinks)
+	v2Router.HandleFunc("GET /api/v2/albums", handlers.HandleGetAlbumsV2)
+	v2Router.Handle("POST /api/v2/albums", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostAlbumV2)))
+	v2Router.HandleFunc("GET /api/v2/albums/{albumSlug}", handlers.HandleGetAlbumV2)
+	v2Router.Handle("PATCH /api/v2/albums/{albumSlug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePatchAlbumV2)))
+	v2Router.Handle("DELETE /api/v2/albums/{albumSlug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteAlbumV2)))
+	v2Router.HandleFunc("POST /api/v2/albums/{albumSlug}/unlock", auth.UnlockAlbumHandlerV2)
+	v2Router.HandleFunc("GET /api/v2/albums/{albumSlug}/images", handlers.HandleGetAlbumLinks)
+	v2Router.Handle("POST /api/v2/albums/{albumSlug}/images", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandlePostAlbumImagesV2)))
+	v2Router.Handle("DELETE /api/v2/albums/{albumSlug}/images/{imageSlug}", auth.AuthMiddleware(types.RoleEditor, types.ScopeEdit, http.HandlerFunc(handlers.HandleDeleteAlbumImageV2)))
+	v2Router.HandleFunc("GET /api/v2/tags", handlers.HandleGetTags)
+	v2Router.HandleFunc("GET /api/v2/tags/{tag}/images", handlers.HandleGetSlugsByTag)
+	v2Router.Handle("GET /api/v2/status", auth.AuthMiddleware(types.RoleViewer, types.ScopeRead, http.HandlerFunc(handlers.HandleGetStatus)))
+
+	v2Handler, err := openapi.Middleware(v2Router)
 	if err != nil {
-		log.Fatal("Server failed to start:", err)
+		slog.Error("Failed to load the OpenAPI document", "error", err)
+		os.Exit(1)
+	}
+	router.Handle("/api/v2/", v2Handler)
+	router.Handle("GET /api/openapi.json", openapi.Handler())
+
+	var handler http.Handler = logging.Middleware(metrics.Middleware(compress.Middleware(router)))
+	if config.CrossOriginEnabled() {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:   config.CorsAllowedOrigins,
+			AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "X-CSRF-Token"},
+			ExposedHeaders:   []string{"X-CSRF-Token"},
+			AllowCredentials: true,
+		}).Handler(handler)
+	}
+
+	if config.BasePath != "" {
+		handler = withBasePath(config.BasePath, handler)
+	}
+
+	listener, err := listen(config.ListenAddress)
+	if err != nil {
+		slog.Error("Server failed to start", "error", err)
+		os.Exit(1)
+	}
+	server := &http.Server{Handler: handler}
+
+	serverErr := make(chan error, 1)
+	if config.TlsEnabled() {
+		certificates, err := gallerynet.NewCertificateReloader(config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certificates.GetCertificate}
+		slog.Info("Application running", "url", serverURL("https"))
+		go func() { serverErr <- server.ServeTLS(listener, "", "") }()
+	} else {
+		slog.Info("Application running", "url", serverURL("http"))
+		go func() { serverErr <- server.Serve(listener) }()
+	}
+
+	select {
+	case err := <-serverErr:
+		slog.Error("Server failed to start", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down server", "error", err)
+	}
+}
+
+// listen opens a TCP address such as ":8080", or a Unix socket given as "unix:/path/to/socket".
+func listen(address string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(address, "unix:"); ok {
+		// a socket left behind by a previous run would stop us binding
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", address)
+}
+
+func serverURL(scheme string) string {
+	if strings.HasPrefix(config.ListenAddress, "unix:") {
+		return config.ListenAddress + " " + config.URLPath("/")
+	}
+	host, port, _ := net.SplitHostPort(config.ListenAddress)
+	if host == "" {
+		host = "localhost"
 	}
+	return scheme + "://" + net.JoinHostPort(host, port) + config.URLPath("/")
+}
+
+// withBasePath serves the gallery under basePath, such as /photos, redirecting the bare prefix to basePath + "/".
+func withBasePath(basePath string, handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(basePath+"/", http.StripPrefix(basePath, handler))
+	mux.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return mux
 }
 
 func HandleFrontend(w http.ResponseWriter, r *http.Request) {
 	bootTime := logic.GetBootTime().Truncate(time.Second).UTC()
 
 	cleanPath := path.Clean(r.URL.Path)
-	if cleanPath == "/" {
-		cleanPath = "/index.html"
-	} else {
-		cleanPath = strings.TrimPrefix(cleanPath, "/")
-	}
 
-	// static content
-	file, err := distSubFS.Open(cleanPath)
-	if err == nil {
-		defer file.Close()
+	// static content, apart from index.html which needs the base path filled in
+	if cleanPath != "/" && cleanPath != "/index.html" {
+		cleanPath = strings.TrimPrefix(cleanPath, "/")
+		file, err := distSubFS.Open(cleanPath)
+		if err == nil {
+			defer file.Close()
 
-		http.ServeContent(w, r, cleanPath, bootTime, file.(io.ReadSeeker))
-		return
+			http.ServeContent(w, r, cleanPath, bootTime, file.(io.ReadSeeker))
+			return
+		}
 	}
 
 	// serve index.html for vue-router content
-	indexFile, err := distSubFS.Open("index.html")
+	index, err := indexHtml()
 	if err != nil {
-		http.Error(w, "index.html not found", http.StatusNotFound)
+		gallerynet.Error(w, "index.html not found", http.StatusNotFound)
 		return
 	}
-	defer indexFile.Close()
 
-	http.ServeContent(w, r, "index.html", bootTime, indexFile.(io.ReadSeeker))
+	http.ServeContent(w, r, "index.html", bootTime, bytes.NewReader(index))
+}
+
+// indexHtml returns index.html with its <base> tag pointing at BASE_PATH, which the
+// frontend resolves its assets, API calls and routes against.
+func indexHtml() ([]byte, error) {
+	index, err := fs.ReadFile(distSubFS, "index.html")
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Replace(index, []byte(`<base href="/">`), []byte(`<base href="`+config.URLPath("/")+`">`), 1), nil
 }